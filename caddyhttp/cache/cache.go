@@ -0,0 +1,435 @@
+// Package cache is middleware that keeps the responses to anonymous
+// GET requests for objects, and serves them to later requests for
+// as long as they are fresh.
+package cache
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+// Cache is middleware that serves cached responses.
+type Cache struct {
+	Next   httpserver.Handler
+	Config *Config
+}
+
+// Config configures a cache. It is shared by the
+// Cache handlers of the sites the cache is set up for.
+type Config struct {
+	// Paths are the paths whose responses are cached.
+	Paths []string
+
+	// DefaultTTL is how long responses without expiration
+	// are fresh; they are not cached if it is 0.
+	DefaultTTL time.Duration
+
+	// MaxTTL limits how long responses are fresh.
+	MaxTTL time.Duration
+
+	// PurgeFrom are the networks that may purge responses.
+	PurgeFrom []*net.IPNet
+
+	store   *store
+	flights flights
+}
+
+// Results of requests, as reported in the X-Cache
+// header of responses and in the metrics.
+const (
+	resultHit         = "hit"
+	resultMiss        = "miss"
+	resultRevalidated = "revalidated"
+	resultCollapsed   = "collapsed"
+	resultBypass      = "bypass"
+)
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (c Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.Config.matches(r) {
+		return c.Next.ServeHTTP(w, r)
+	}
+	if r.Method == "PURGE" {
+		return c.purge(w, r)
+	}
+
+	key, ok := cacheKey(r)
+	if !ok {
+		prometheus.CountCacheRequest(resultBypass)
+		return c.Next.ServeHTTP(w, r)
+	}
+	_, revalidate := directives(r.Header)["no-cache"]
+	revalidate = revalidate || r.Header.Get("Pragma") == "no-cache"
+
+	e := c.Config.store.get(key, r)
+	if e != nil && e.fresh() && !revalidate {
+		return c.serve(w, r, e, resultHit)
+	}
+	if r.Method == http.MethodHead || (r.Header.Get("Range") != "" && e == nil) {
+		// not worth fetching the whole object for
+		prometheus.CountCacheRequest(resultMiss)
+		return c.Next.ServeHTTP(w, r)
+	}
+
+	// only one of concurrent requests for a key fetches
+	// the response; the others wait to get it from the cache
+	f, leader := c.Config.flights.join(key)
+	if !leader {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return http.StatusServiceUnavailable, r.Context().Err()
+		}
+		if e := c.Config.store.get(key, r); e != nil && e.fresh() {
+			return c.serve(w, r, e, resultCollapsed)
+		}
+		return c.fetch(w, r, key, nil)
+	}
+	defer c.Config.flights.leave(key, f)
+	return c.fetch(w, r, key, e)
+}
+
+// matches reports whether c caches responses to r.
+func (c *Config) matches(r *http.Request) bool {
+	for _, path := range c.Paths {
+		if httpserver.Path(r.URL.Path).Matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey returns the key of the response to r, and whether
+// it may be cached: r must be an anonymous request for an object.
+func cacheKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	if _, noStore := directives(r.Header)["no-store"]; noStore || r.Header.Get("Authorization") != "" {
+		return "", false
+	}
+	s3req := httpserver.GetS3Request(r)
+	if s3req == nil {
+		s3req = httpserver.ParseS3Request(r, nil)
+	}
+	if s3req.SignatureVersion != "" || s3req.Key == "" {
+		return "", false
+	}
+	key := s3req.Bucket + "/" + s3req.Key
+	if r.URL.RawQuery != "" {
+		key += "?" + r.URL.RawQuery
+	}
+	return key, true
+}
+
+// fetch gets the response to r from the next handler, keeping it
+// in the cache if allowed. A stale entry is revalidated.
+func (c Cache) fetch(w http.ResponseWriter, r *http.Request, key string, stale *entry) (int, error) {
+	if stale != nil && !stale.validators() {
+		// can only be fetched again
+		stale = nil
+	}
+	outreq := r
+	hold := false
+	if stale != nil || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		// the client's conditions and ranges are evaluated
+		// against the cached response, so they are not sent on
+		outreq = r.WithContext(r.Context())
+		outreq.Header = cloneHeader(r.Header)
+		for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+			outreq.Header.Del(h)
+		}
+		if stale != nil {
+			if etag := stale.header.Get("ETag"); etag != "" {
+				outreq.Header.Set("If-None-Match", etag)
+			}
+			if lastModified := stale.header.Get("Last-Modified"); lastModified != "" {
+				outreq.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+		hold = true
+	}
+
+	cw := &captureWriter{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+		config:                c.Config,
+		hold:                  hold,
+		revalidating:          stale != nil,
+	}
+	status, err := c.Next.ServeHTTP(cw, outreq)
+	if status != 0 || err != nil {
+		cw.release()
+		return status, err
+	}
+
+	switch {
+	case cw.notModified:
+		e := stale.revalidated(cw.responseHeader, c.Config)
+		c.Config.store.replace(stale, e)
+		return c.serve(w, r, e, resultRevalidated)
+	case cw.capturing && cw.complete(r):
+		e := cw.entry(key, r)
+		stored := c.Config.store.put(e)
+		if cw.held {
+			if !stored {
+				cw.release()
+				break
+			}
+			return c.serve(w, r, e, resultMiss)
+		}
+	default:
+		cw.release()
+	}
+	prometheus.CountCacheRequest(resultMiss)
+	return 0, nil
+}
+
+// serve writes the response of e to r, evaluating the
+// conditions and ranges of r.
+func (c Cache) serve(w http.ResponseWriter, r *http.Request, e *entry, result string) (int, error) {
+	body, closer, err := e.open()
+	if err != nil {
+		// evicted from disk in the meantime
+		return c.fetch(w, r, e.key, nil)
+	}
+	defer closer.Close()
+
+	prometheus.CountCacheRequest(result)
+	header := w.Header()
+	for name, values := range e.header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.FormatInt(int64(e.currentAge()/time.Second), 10))
+	header.Set("X-Cache", strings.ToUpper(result))
+	http.ServeContent(w, r, "", e.modTime, body)
+	return 0, nil
+}
+
+// purge removes the responses of the object or, if the key
+// ends in *, of all objects with that prefix, like
+//
+//	PURGE /bucket/key
+//	PURGE /bucket/images/*
+func (c Cache) purge(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.Config.purgeAllowed(r) {
+		return http.StatusForbidden, nil
+	}
+	s3req := httpserver.GetS3Request(r)
+	if s3req == nil {
+		s3req = httpserver.ParseS3Request(r, nil)
+	}
+	if s3req.Bucket == "" {
+		return http.StatusBadRequest, nil
+	}
+	key := s3req.Bucket + "/" + s3req.Key
+	prefix := s3req.Key == "" || strings.HasSuffix(key, "*")
+	key = strings.TrimSuffix(key, "*")
+	if r.URL.RawQuery != "" && !prefix {
+		key += "?" + r.URL.RawQuery
+	}
+	n := c.Config.store.purge(key, prefix)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(strconv.Itoa(n) + " responses purged\n"))
+	return 0, nil
+}
+
+// purgeAllowed reports whether r comes from a network
+// that may purge responses.
+func (c *Config) purgeAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.PurgeFrom {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureWriter keeps a copy of a cacheable response. When holding,
+// the response is not written until it turns out not to be stored.
+type captureWriter struct {
+	*httpserver.ResponseWriterWrapper
+	config       *Config
+	hold         bool
+	revalidating bool
+
+	wroteHeader    bool
+	status         int
+	responseHeader http.Header
+	ttl            time.Duration
+	age            time.Duration
+	capturing      bool // the body is kept for the cache
+	held           bool // the response is not written yet
+	notModified    bool // the revalidated response did not change
+	body           bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	header := cw.Header()
+
+	if cw.revalidating && status == http.StatusNotModified {
+		cw.notModified = true
+		cw.held = true
+		cw.responseHeader = cloneHeader(header)
+		return
+	}
+	if status == http.StatusOK {
+		cw.ttl, cw.age, cw.capturing = storable(header, cw.config.DefaultTTL, cw.config.MaxTTL)
+		if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && n > cw.config.store.objectMax() {
+			cw.capturing = false
+		}
+	}
+	if cw.capturing {
+		cw.responseHeader = cloneHeader(header)
+		if cw.hold {
+			cw.held = true
+			return
+		}
+	}
+	header.Set("X-Cache", "MISS")
+	cw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(b), nil
+	}
+	if cw.capturing {
+		if int64(cw.body.Len()+len(b)) > cw.config.store.objectMax() {
+			// too large to keep
+			cw.capturing = false
+			cw.release()
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	if cw.held {
+		return len(b), nil
+	}
+	return cw.ResponseWriterWrapper.Write(b)
+}
+
+// release writes the held response, if any.
+func (cw *captureWriter) release() {
+	if !cw.held || cw.notModified {
+		return
+	}
+	cw.held = false
+	cw.Header().Set("X-Cache", "MISS")
+	cw.ResponseWriterWrapper.WriteHeader(cw.status)
+	cw.ResponseWriterWrapper.Write(cw.body.Bytes())
+}
+
+// Flush implements http.Flusher; held responses are not flushed.
+func (cw *captureWriter) Flush() {
+	if !cw.held {
+		cw.ResponseWriterWrapper.Flush()
+	}
+}
+
+// complete reports whether the whole response to r was captured.
+func (cw *captureWriter) complete(r *http.Request) bool {
+	if r.Context().Err() != nil {
+		return false
+	}
+	n, err := strconv.ParseInt(cw.responseHeader.Get("Content-Length"), 10, 64)
+	return err != nil || n == int64(cw.body.Len())
+}
+
+// entry returns the captured response to r as a cache entry.
+func (cw *captureWriter) entry(key string, r *http.Request) *entry {
+	vary := varyHeaders(cw.responseHeader)
+	e := &entry{
+		key:       key,
+		vary:      vary,
+		varyValue: varyValue(vary, r),
+		header:    storedHeader(cw.responseHeader),
+		stored:    now(),
+		age:       cw.age,
+		ttl:       cw.ttl,
+		body:      cw.body.Bytes(),
+		size:      int64(cw.body.Len()),
+	}
+	e.modTime, _ = http.ParseTime(e.header.Get("Last-Modified"))
+	return e
+}
+
+// revalidated returns a copy of e updated by the header
+// of a 304 Not Modified response, and fresh again.
+func (e *entry) revalidated(header http.Header, config *Config) *entry {
+	updated := *e
+	updated.header = cloneHeader(e.header)
+	for name, values := range storedHeader(header) {
+		updated.header[name] = values
+	}
+	updated.ttl, updated.age, _ = storable(updated.header, config.DefaultTTL, config.MaxTTL)
+	updated.stored = now()
+	updated.elem = nil
+	return &updated
+}
+
+// flight is a fetch of a response that other
+// requests for the same key wait for.
+type flight struct {
+	done chan struct{}
+}
+
+// flights are the fetches in progress, by key.
+type flights struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// join returns the flight of key, and whether
+// the caller leads it, fetching the response.
+func (fs *flights) join(key string) (*flight, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f, ok := fs.m[key]; ok {
+		return f, false
+	}
+	if fs.m == nil {
+		fs.m = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	fs.m[key] = f
+	return f, true
+}
+
+// leave ends the flight f of key.
+func (fs *flights) leave(key string, f *flight) {
+	fs.mu.Lock()
+	delete(fs.m, key)
+	fs.mu.Unlock()
+	close(f.done)
+}
+
+// now is time.Now; it is a variable so tests can change the clock.
+var now = time.Now
+
+// Interface guards
+var _ httpserver.HTTPInterfaces = (*captureWriter)(nil)
@@ -0,0 +1,349 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// backend serves objects like yig, counting the requests.
+type backend struct {
+	requests int32
+	header   http.Header
+	body     string
+	handle   func(w http.ResponseWriter, r *http.Request) bool // true if handled
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	atomic.AddInt32(&b.requests, 1)
+	if b.handle != nil && b.handle(w, r) {
+		return 0, nil
+	}
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b.body)))
+	w.Write([]byte(b.body))
+	return 0, nil
+}
+
+func newTestCache(t *testing.T, b *backend, memoryObjectMax int64, dir string) Cache {
+	s, err := newStore(1<<20, memoryObjectMax, dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.1/8")
+	return Cache{
+		Next: b,
+		Config: &Config{
+			Paths:     []string{"/"},
+			MaxTTL:    time.Hour,
+			PurgeFrom: []*net.IPNet{loopback},
+			store:     s,
+		},
+	}
+}
+
+func get(c Cache, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	if status, _ := c.ServeHTTP(w, r); status != 0 {
+		w.Code = status
+	}
+	return w
+}
+
+func TestCacheHit(t *testing.T) {
+	b := &backend{
+		header: http.Header{"Cache-Control": {"public, max-age=60"}, "Content-Type": {"text/css"}},
+		body:   "body { color: red }",
+	}
+	c := newTestCache(t, b, 1<<20, "")
+
+	w := get(c, "/assets/site.css")
+	if w.Body.String() != b.body || w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected miss with the object, got %q, %v", w.Body.String(), w.Header())
+	}
+	w = get(c, "/assets/site.css")
+	if w.Body.String() != b.body || w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Type") != "text/css" {
+		t.Fatalf("Expected hit with the object, got %q, %v", w.Body.String(), w.Header())
+	}
+	if n := atomic.LoadInt32(&b.requests); n != 1 {
+		t.Errorf("Expected 1 backend request, got %d", n)
+	}
+
+	// signed and bucket level requests bypass the cache
+	get(c, "/assets/site.css", "Authorization", "AWS AKIDEXAMPLE:signature")
+	get(c, "/assets/site.css?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIDEXAMPLE%2F20180101%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Signature=abc")
+	get(c, "/assets")
+	get(c, "/assets")
+	if n := atomic.LoadInt32(&b.requests); n != 5 {
+		t.Errorf("Expected 5 backend requests, got %d", n)
+	}
+
+	// expired
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return time.Now().Add(time.Minute) }
+	if w := get(c, "/assets/site.css"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected expired response to be fetched again, got %v", w.Header())
+	}
+}
+
+func TestCacheConditionalsAndRanges(t *testing.T) {
+	b := &backend{
+		header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Etag":          {`"v1"`},
+			"Last-Modified": {"Mon, 01 Jan 2018 00:00:00 GMT"},
+		},
+		body: "0123456789",
+	}
+	c := newTestCache(t, b, 1<<20, "")
+
+	// the first request is conditional; the object is fetched
+	// and cached whole, and the condition evaluated against it
+	w := get(c, "/bucket/key", "If-None-Match", `"v1"`)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", w.Code)
+	}
+	w = get(c, "/bucket/key", "If-Modified-Since", "Tue, 02 Jan 2018 00:00:00 GMT")
+	if w.Code != http.StatusNotModified || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected 304 from cache, got %d, %v", w.Code, w.Header())
+	}
+	w = get(c, "/bucket/key", "Range", "bytes=2-5")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Errorf("Expected bytes 2-5, got %d, %q", w.Code, w.Body.String())
+	}
+	w = get(c, "/bucket/key", "If-None-Match", `"v0"`)
+	if w.Code != http.StatusOK || w.Body.String() != b.body {
+		t.Errorf("Expected the object for another ETag, got %d, %q", w.Code, w.Body.String())
+	}
+	if n := atomic.LoadInt32(&b.requests); n != 1 {
+		t.Errorf("Expected 1 backend request, got %d", n)
+	}
+
+	// ranges are not fetched on a miss
+	w = get(c, "/bucket/other", "Range", "bytes=0-1")
+	if n := atomic.LoadInt32(&b.requests); n != 2 {
+		t.Errorf("Expected range request to be sent on, got %d backend requests", n)
+	}
+	if w := get(c, "/bucket/other"); w.Header().Get("X-Cache") != "MISS" {
+		t.Error("Expected range request not to be cached")
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	b := &backend{
+		header: http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}},
+		body:   "object",
+	}
+	var conditional int32
+	b.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	c := newTestCache(t, b, 1<<20, "")
+
+	get(c, "/bucket/key")
+	w := get(c, "/bucket/key")
+	if w.Body.String() != "object" || w.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("Expected revalidated object, got %q, %v", w.Body.String(), w.Header())
+	}
+	if atomic.LoadInt32(&conditional) != 1 {
+		t.Error("Expected the cached ETag to be sent on")
+	}
+	// the 304 made the response fresh for a minute
+	if w := get(c, "/bucket/key"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected hit after revalidation, got %v", w.Header())
+	}
+	// clients may ask for revalidation
+	if w := get(c, "/bucket/key", "Cache-Control", "no-cache"); w.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("Expected revalidation for no-cache request, got %v", w.Header())
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}}
+	b.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("encoding:" + r.Header.Get("Accept-Encoding")))
+		return true
+	}
+	c := newTestCache(t, b, 1<<20, "")
+
+	get(c, "/bucket/key", "Accept-Encoding", "gzip")
+	get(c, "/bucket/key")
+	if w := get(c, "/bucket/key", "Accept-Encoding", "gzip"); w.Body.String() != "encoding:gzip" || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected gzip variant from cache, got %q, %v", w.Body.String(), w.Header())
+	}
+	if w := get(c, "/bucket/key"); w.Body.String() != "encoding:" || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected identity variant from cache, got %q, %v", w.Body.String(), w.Header())
+	}
+	if n := atomic.LoadInt32(&b.requests); n != 2 {
+		t.Errorf("Expected 2 backend requests, got %d", n)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for i, header := range []http.Header{
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{"Expires": {"0"}},
+		{}, // no default TTL
+	} {
+		b := &backend{header: header, body: "object"}
+		c := newTestCache(t, b, 1<<20, "")
+		get(c, "/bucket/key")
+		get(c, "/bucket/key")
+		if n := atomic.LoadInt32(&b.requests); n != 2 {
+			t.Errorf("Test %d: expected response not to be cached, got %d backend requests", i, n)
+		}
+	}
+
+	// too large for memory without disk tier
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}, body: strings.Repeat("x", 100)}
+	c := newTestCache(t, b, 10, "")
+	if w := get(c, "/bucket/key"); w.Body.String() != b.body {
+		t.Errorf("Expected large object to be served, got %d bytes", w.Body.Len())
+	}
+	get(c, "/bucket/key")
+	if n := atomic.LoadInt32(&b.requests); n != 2 {
+		t.Errorf("Expected large object not to be cached, got %d backend requests", n)
+	}
+}
+
+func TestCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}, body: strings.Repeat("x", 100)}
+	c := newTestCache(t, b, 10, dir)
+	get(c, "/bucket/large")
+	if w := get(c, "/bucket/large"); w.Body.String() != b.body || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("Expected large object from disk, got %d bytes, %v", w.Body.Len(), w.Header())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 file on disk, got %d", len(files))
+	}
+
+	c.Config.store.purge("bucket/large", false)
+	files, _ = ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Expected purged file to be removed, got %d files", len(files))
+	}
+}
+
+func TestCacheCollapse(t *testing.T) {
+	release := make(chan struct{})
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "object"}
+	b.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		<-release
+		return false
+	}
+	c := newTestCache(t, b, 1<<20, "")
+
+	var wg sync.WaitGroup
+	results := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := get(c, "/bucket/key")
+			results <- w.Body.String()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for body := range results {
+		if body != "object" {
+			t.Errorf("Expected the object, got %q", body)
+		}
+	}
+	if n := atomic.LoadInt32(&b.requests); n != 1 {
+		t.Errorf("Expected concurrent misses to be collapsed, got %d backend requests", n)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "object"}
+	c := newTestCache(t, b, 1<<20, "")
+	for _, path := range []string{"/bucket/a", "/bucket/a?versionId=1", "/bucket/img/1", "/bucket/img/2", "/other/a"} {
+		get(c, path)
+	}
+
+	purge := func(path, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PURGE", path, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		if status, _ := c.ServeHTTP(w, r); status != 0 {
+			w.Code = status
+		}
+		return w
+	}
+	if w := purge("/bucket/a", "10.0.0.1:1234"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected purge from other networks to be forbidden, got %d", w.Code)
+	}
+	if w := purge("/bucket/a", "127.0.0.1:1234"); w.Body.String() != "2 responses purged\n" {
+		t.Errorf("Expected both versions to be purged, got %q", w.Body.String())
+	}
+	if w := purge("/bucket/img/*", "127.0.0.1:1234"); w.Body.String() != "2 responses purged\n" {
+		t.Errorf("Expected prefix to be purged, got %q", w.Body.String())
+	}
+	if w := get(c, "/other/a"); w.Header().Get("X-Cache") != "HIT" {
+		t.Error("Expected other bucket to stay cached")
+	}
+	if w := purge("/other", "127.0.0.1:1234"); w.Body.String() != "1 responses purged\n" {
+		t.Errorf("Expected bucket to be purged, got %q", w.Body.String())
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	s, err := newStore(10, 10, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, key := range []string{"a", "b", "c"} {
+		s.put(&entry{key: key, header: http.Header{}, body: []byte("xxxx"), size: 4})
+		if key == "b" {
+			// a was used more recently than b
+			s.get("a", r)
+		}
+	}
+	if s.get("a", r) == nil || s.get("b", r) != nil || s.get("c", r) == nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if s.memory.used != 8 {
+		t.Errorf("Expected 8 bytes in use, got %d", s.memory.used)
+	}
+}
+
+var _ httpserver.Handler = (*backend)(nil)
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives returns the Cache-Control directives of h
+// with their values, which are empty for most.
+func directives(h http.Header) map[string]string {
+	d := make(map[string]string)
+	for _, value := range h["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			d[strings.ToLower(name)] = arg
+		}
+	}
+	return d
+}
+
+// storable reports whether a 200 response with header may be
+// cached, for how long it is fresh and how old it already is.
+// Responses that must be revalidated are only cached if they
+// can be, which requires an ETag or Last-Modified header.
+func storable(header http.Header, defaultTTL, maxTTL time.Duration) (ttl, age time.Duration, ok bool) {
+	cc := directives(header)
+	for _, d := range []string{"no-store", "private"} {
+		if _, found := cc[d]; found {
+			return 0, 0, false
+		}
+	}
+	if header.Get("Set-Cookie") != "" || header.Get("Content-Range") != "" ||
+		strings.TrimSpace(header.Get("Vary")) == "*" {
+		return 0, 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if _, noCache := cc["no-cache"]; noCache {
+		ttl = 0
+	} else if seconds, found := maxAge(cc, "s-maxage"); found {
+		ttl = seconds
+	} else if seconds, found := maxAge(cc, "max-age"); found {
+		ttl = seconds
+	} else if expires := header.Get("Expires"); expires != "" {
+		// invalid dates mean already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now()
+			}
+			ttl = t.Sub(date)
+		}
+	} else {
+		ttl = defaultTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	revalidatable := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	return ttl, age, ttl > age || revalidatable
+}
+
+// maxAge returns the duration of the directive name of cc.
+func maxAge(cc map[string]string, name string) (time.Duration, bool) {
+	arg, found := cc[name]
+	if !found {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// varyHeaders returns the canonical names of the
+// request headers that a response varies by.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// notStored are the response headers that are not cached; those
+// of the connection, and those set when a response is served.
+var notStored = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length", "Date", "Age", "X-Cache",
+}
+
+// storedHeader returns a copy of header as it is cached.
+func storedHeader(header http.Header) http.Header {
+	h := cloneHeader(header)
+	for _, name := range notStored {
+		h.Del(name)
+	}
+	return h
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for name, values := range h {
+		c[name] = append([]string(nil), values...)
+	}
+	return c
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("cache", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// Defaults of the cache directive.
+const (
+	defaultMemory          = 64 * 1024 * 1024
+	defaultMemoryObjectMax = 1024 * 1024
+	defaultDiskObjectMax   = 64 * 1024 * 1024
+	defaultMaxTTL          = 24 * time.Hour
+)
+
+// defaultPurgeFrom are the networks allowed to purge by default.
+var defaultPurgeFrom = []string{"127.0.0.1/8", "::1/128"}
+
+// setup configures a new Cache middleware instance.
+func setup(c *caddy.Controller) error {
+	config, err := cacheParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Cache{Next: next, Config: config}
+	})
+
+	return nil
+}
+
+// cacheParse parses a block like:
+//
+//	cache [paths...] {
+//		memory <size> [object_max]
+//		disk <dir> <size> [object_max]
+//		default_ttl <duration>
+//		max_ttl <duration>
+//		purge_from <ip|cidr...>
+//	}
+//
+// Sizes are like 512KB or 64MB. Responses larger than the memory
+// object_max are kept on disk, if a disk directory is configured.
+func cacheParse(c *caddy.Controller) (*Config, error) {
+	config := &Config{MaxTTL: defaultMaxTTL}
+	memory, memoryObjectMax := int64(defaultMemory), int64(defaultMemoryObjectMax)
+	var dir string
+	var disk, diskObjectMax int64
+	var purgeFrom []string
+
+	for c.Next() {
+		if config.Paths != nil {
+			return nil, c.Err("cache: can only be configured once per site")
+		}
+		config.Paths = c.RemainingArgs()
+		if len(config.Paths) == 0 {
+			config.Paths = []string{"/"}
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "memory":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				sizes, err := parseSizes(args)
+				if err != nil {
+					return nil, c.Errf("cache: %v", err)
+				}
+				memory = sizes[0]
+				if len(sizes) > 1 {
+					memoryObjectMax = sizes[1]
+				}
+			case "disk":
+				args := c.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+				sizes, err := parseSizes(args[1:])
+				if err != nil {
+					return nil, c.Errf("cache: %v", err)
+				}
+				dir, disk, diskObjectMax = args[0], sizes[0], defaultDiskObjectMax
+				if len(sizes) > 1 {
+					diskObjectMax = sizes[1]
+				}
+			case "default_ttl", "max_ttl":
+				what := c.Val()
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ttl, err := time.ParseDuration(c.Val())
+				if err != nil || ttl < 0 {
+					return nil, c.Errf("cache: %s must be a non-negative duration", what)
+				}
+				if what == "default_ttl" {
+					config.DefaultTTL = ttl
+				} else {
+					config.MaxTTL = ttl
+				}
+			case "purge_from":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				purgeFrom = append(purgeFrom, args...)
+			default:
+				return nil, c.Errf("cache: unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if purgeFrom == nil {
+		purgeFrom = defaultPurgeFrom
+	}
+	for _, s := range purgeFrom {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, c.Errf("cache: invalid purge_from network: %v", err)
+		}
+		config.PurgeFrom = append(config.PurgeFrom, network)
+	}
+
+	store, err := newStore(memory, memoryObjectMax, dir, disk, diskObjectMax)
+	if err != nil {
+		return nil, c.Errf("cache: %v", err)
+	}
+	config.store = store
+	return config, nil
+}
+
+var validUnits = []struct {
+	symbol     string
+	multiplier int64
+}{
+	{"KB", 1024},
+	{"MB", 1024 * 1024},
+	{"GB", 1024 * 1024 * 1024},
+	{"B", 1},
+	{"", 1}, // defaulting to "B"
+}
+
+// parseSizes parses positive sizes like 512KB or 64MB in bytes.
+func parseSizes(args []string) ([]int64, error) {
+	var sizes []int64
+	for _, s := range args {
+		size, err := parseSize(s)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// parseSize parses a positive size like 512KB or 64MB in bytes.
+func parseSize(s string) (int64, error) {
+	upper := strings.ToUpper(s)
+	for _, unit := range validUnits {
+		if strings.HasSuffix(upper, unit.symbol) {
+			size, err := strconv.ParseInt(upper[:len(upper)-len(unit.symbol)], 10, 64)
+			if err != nil || size < 1 {
+				return 0, fmt.Errorf("'%s' is not a positive size", s)
+			}
+			return size * unit.multiplier, nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not a positive size", s)
+}
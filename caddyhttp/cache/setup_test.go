@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `cache`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Cache)
+	if !ok {
+		t.Fatalf("Expected handler to be type Cache, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestCacheParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stale := filepath.Join(dir, "0123-1"+fileSuffix)
+	if err := ioutil.WriteFile(stale, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := cacheParse(caddy.NewTestController("http", `cache /public /assets {
+		memory 16MB 512KB
+		disk `+dir+` 1GB 128MB
+		default_ttl 5m
+		max_ttl 1h
+		purge_from 10.0.0.0/8 192.168.1.1
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(config.Paths) != 2 || config.DefaultTTL != 5*time.Minute || config.MaxTTL != time.Hour || len(config.PurgeFrom) != 2 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	s := config.store
+	if s.memory.max != 16<<20 || s.memory.objectMax != 512<<10 || s.disk.max != 1<<30 || s.disk.objectMax != 128<<20 {
+		t.Errorf("Unexpected tiers %+v, %+v", s.memory, s.disk)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Expected files of an earlier process to be removed")
+	}
+
+	config, err = cacheParse(caddy.NewTestController("http", `cache`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Paths[0] != "/" || config.DefaultTTL != 0 || config.MaxTTL != defaultMaxTTL || config.store.disk != nil {
+		t.Errorf("Unexpected default config %+v", config)
+	}
+
+	for i, input := range []string{
+		"cache {\n memory\n}",
+		"cache {\n memory lots\n}",
+		"cache {\n disk /tmp\n}",
+		"cache {\n default_ttl -1s\n}",
+		"cache {\n max_ttl forever\n}",
+		"cache {\n purge_from everywhere\n}",
+		"cache {\n shared true\n}",
+		"cache /a\ncache /b",
+	} {
+		if _, err := cacheParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, input)
+		}
+	}
+}
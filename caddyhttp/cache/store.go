@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+// entry is a cached response. Entries are not changed once
+// stored; revalidating one replaces it by a fresh copy.
+type entry struct {
+	// key identifies the object; the variant of the
+	// response is identified by the request headers it
+	// varies by, and their values.
+	key       string
+	vary      []string
+	varyValue string
+
+	header  http.Header
+	modTime time.Time
+	stored  time.Time
+	age     time.Duration // age of the response when stored
+	ttl     time.Duration
+	size    int64
+
+	// the body is in memory or in the file at path
+	body []byte
+	path string
+
+	elem *list.Element
+}
+
+// fresh reports whether e may be served without revalidation.
+func (e *entry) fresh() bool {
+	return e.currentAge() < e.ttl
+}
+
+// currentAge returns the age of the response of e.
+func (e *entry) currentAge() time.Duration {
+	return e.age + now().Sub(e.stored)
+}
+
+// validators reports whether e can be revalidated.
+func (e *entry) validators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// matches reports whether e is the variant for r.
+func (e *entry) matches(r *http.Request) bool {
+	return varyValue(e.vary, r) == e.varyValue
+}
+
+// open returns the body of e.
+func (e *entry) open() (io.ReadSeeker, io.Closer, error) {
+	if e.path == "" {
+		return bytes.NewReader(e.body), ioutil.NopCloser(nil), nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
+// varyValue returns the values of the request headers
+// named by vary, which select a variant of a response.
+func varyValue(vary []string, r *http.Request) string {
+	var values []string
+	for _, name := range vary {
+		values = append(values, strings.Join(r.Header[name], ","))
+	}
+	return strings.Join(values, "\n")
+}
+
+// tier is a part of the store with a size
+// limit, from which the least recently used
+// entries are evicted.
+type tier struct {
+	name      string
+	max       int64 // bytes for all entries
+	objectMax int64 // bytes for an entry
+	used      int64
+	lru       *list.List
+}
+
+func newTier(name string, max, objectMax int64) *tier {
+	return &tier{name: name, max: max, objectMax: objectMax, lru: list.New()}
+}
+
+// store holds the cached responses in memory and, for
+// responses too large for memory, optionally on disk.
+type store struct {
+	mu      sync.Mutex
+	entries map[string][]*entry // variants by key
+	memory  *tier
+	disk    *tier // nil without disk tier
+	dir     string
+	seq     int64 // for unique file names
+}
+
+// newStore returns a store that keeps up to memory bytes in
+// memory, in entries of up to memoryObjectMax bytes. Larger
+// entries are kept in dir if it is not empty.
+func newStore(memory, memoryObjectMax int64, dir string, disk, diskObjectMax int64) (*store, error) {
+	s := &store{
+		entries: make(map[string][]*entry),
+		memory:  newTier("memory", memory, memoryObjectMax),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		// files of an earlier process are not indexed
+		old, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range old {
+			os.Remove(path)
+		}
+		s.dir = dir
+		s.disk = newTier("disk", disk, diskObjectMax)
+	}
+	return s, nil
+}
+
+const fileSuffix = ".cache"
+
+// objectMax returns the size of the largest response s can keep.
+func (s *store) objectMax() int64 {
+	if s.disk != nil && s.disk.objectMax > s.memory.objectMax {
+		return s.disk.objectMax
+	}
+	return s.memory.objectMax
+}
+
+// get returns the variant of key for r, or nil.
+func (s *store) get(key string, r *http.Request) *entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries[key] {
+		if e.matches(r) {
+			s.tierOf(e).lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// put stores e, with its body in memory, replacing the same
+// variant. It reports whether e fits into the store.
+func (s *store) put(e *entry) bool {
+	t := s.memory
+	if e.size > t.objectMax || e.size > t.max {
+		if s.disk == nil || e.size > s.disk.objectMax || e.size > s.disk.max {
+			return false
+		}
+		t = s.disk
+		if err := s.writeFile(e); err != nil {
+			return false
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insert(t, e)
+	return true
+}
+
+// replace stores e, a revalidated copy of old sharing its body.
+func (s *store) replace(old, e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old.elem == nil {
+		// evicted in the meantime, with its file
+		return
+	}
+	s.unlink(old)
+	s.insert(s.tierOf(e), e)
+}
+
+// insert adds e to t, removing the variant it replaces and as
+// many entries as needed to fit; s.mu must be held.
+func (s *store) insert(t *tier, e *entry) {
+	variants := s.entries[e.key]
+	for _, old := range variants {
+		if old.varyValue == e.varyValue && strings.Join(old.vary, ",") == strings.Join(e.vary, ",") {
+			s.remove(old)
+			break
+		}
+	}
+	for t.used+e.size > t.max && t.lru.Len() > 0 {
+		s.remove(t.lru.Back().Value.(*entry))
+	}
+	e.elem = t.lru.PushFront(e)
+	t.used += e.size
+	s.entries[e.key] = append(s.entries[e.key], e)
+	prometheus.SetCacheSize(t.name, t.used)
+}
+
+// remove drops e and its file; s.mu must be held.
+func (s *store) remove(e *entry) {
+	s.unlink(e)
+	if e.path != "" {
+		os.Remove(e.path)
+	}
+}
+
+// unlink drops e but keeps its file; s.mu must be held.
+func (s *store) unlink(e *entry) {
+	t := s.tierOf(e)
+	t.lru.Remove(e.elem)
+	e.elem = nil
+	t.used -= e.size
+	prometheus.SetCacheSize(t.name, t.used)
+
+	variants := s.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(s.entries, e.key)
+	} else {
+		s.entries[e.key] = variants
+	}
+}
+
+func (s *store) tierOf(e *entry) *tier {
+	if e.path != "" {
+		return s.disk
+	}
+	return s.memory
+}
+
+// purge removes the entries of key, or of all keys
+// starting with key if prefix is true, and returns
+// how many it removed.
+func (s *store) purge(key string, prefix bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []*entry
+	for k, variants := range s.entries {
+		object := k
+		if i := strings.IndexByte(object, '?'); i >= 0 {
+			object = object[:i]
+		}
+		if object == key || k == key || (prefix && strings.HasPrefix(object, key)) {
+			removed = append(removed, variants...)
+		}
+	}
+	for _, e := range removed {
+		s.remove(e)
+	}
+	return len(removed)
+}
+
+// writeFile moves the body of e into a file.
+func (s *store) writeFile(e *entry) error {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(e.key + "\n" + e.varyValue))
+	path := filepath.Join(s.dir, hex.EncodeToString(sum[:8])+"-"+strconv.FormatInt(seq, 10)+fileSuffix)
+	if err := ioutil.WriteFile(path, e.body, 0600); err != nil {
+		os.Remove(path)
+		return err
+	}
+	e.path = path
+	e.body = nil
+	return nil
+}
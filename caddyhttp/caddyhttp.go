@@ -22,6 +22,7 @@ import (
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/basicauth"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/bind"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/browse"
+	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/cache"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/errors"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/expvar"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/extensions"
@@ -38,12 +39,16 @@ import (
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/proxy"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/push"
+	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/ratelimit"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/redirect"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/requestid"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/rewrite"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/root"
+	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/s3auth"
+	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/s3endpoint"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/status"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/templates"
+	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/throttle"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/timeouts"
 	_ "github.com/journeymidnight/yig-front-caddy/caddyhttp/websocket"
 	_ "github.com/journeymidnight/yig-front-caddy/onevent"
@@ -53,6 +53,12 @@ func (h ErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, er
 		errMsg := fmt.Sprintf("%s [ERROR %d %s] %v", time.Now().Format(timeFormat), status, r.URL.Path, err)
 		if h.Debug {
 			// Write error to response instead of to log
+			if s3Errors, _ := r.Context().Value(httpserver.S3ErrorsCtxKey).(bool); s3Errors {
+				s3err := httpserver.S3ErrorForStatus(status)
+				s3err.Message = errMsg
+				httpserver.WriteS3Error(w, r, s3err)
+				return 0, err
+			}
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(status)
 			fmt.Fprintln(w, errMsg)
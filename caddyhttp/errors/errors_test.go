@@ -16,6 +16,7 @@ package errors
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -164,6 +165,63 @@ func TestVisibleErrorWithPanic(t *testing.T) {
 	}
 }
 
+func TestS3Errors(t *testing.T) {
+	buf := bytes.Buffer{}
+	em := ErrorHandler{
+		ErrorPages: make(map[int]string),
+		Log:        httpserver.NewTestLogger(&buf),
+	}
+	backendErr := errors.New("dial tcp: connection refused")
+
+	req, err := http.NewRequest("PUT", "/bucket/obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(req.Context(), httpserver.S3ErrorsCtxKey, true)
+	ctx = context.WithValue(ctx, httpserver.RequestIDCtxKey, "0f3ef3b1-a6e8-4b7a-9b5c-4c3e1c7f2a1d")
+	req = req.WithContext(ctx)
+
+	for i, test := range []struct {
+		next           httpserver.Handler
+		debug          bool
+		expectedStatus int
+		expectedBody   []string
+	}{
+		{genErrorHandler(http.StatusBadGateway, backendErr, ""), false, http.StatusBadGateway, []string{
+			"<Code>ServiceUnavailable</Code>",
+			"<Resource>/bucket/obj</Resource>",
+			"<RequestId>0f3ef3b1-a6e8-4b7a-9b5c-4c3e1c7f2a1d</RequestId>",
+		}},
+		{genErrorHandler(http.StatusRequestEntityTooLarge, nil, ""), false, http.StatusRequestEntityTooLarge, []string{
+			"<Code>EntityTooLarge</Code>",
+		}},
+		{genErrorHandler(http.StatusBadGateway, backendErr, ""), true, http.StatusBadGateway, []string{
+			"<Code>ServiceUnavailable</Code>",
+			"connection refused",
+		}},
+	} {
+		em.Next = test.next
+		em.Debug = test.debug
+		rec := httptest.NewRecorder()
+
+		code, _ := em.ServeHTTP(rec, req)
+		if code != 0 {
+			t.Errorf("Test %d: expected status code 0, got %d", i, code)
+		}
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: expected response status %d, got %d", i, test.expectedStatus, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("Test %d: expected Content-Type application/xml, got %s", i, ct)
+		}
+		for _, expected := range test.expectedBody {
+			if !strings.Contains(rec.Body.String(), expected) {
+				t.Errorf("Test %d: expected body to contain %s, got %s", i, expected, rec.Body.String())
+			}
+		}
+	}
+}
+
 func TestGenericErrorPage(t *testing.T) {
 	// create temporary generic error page
 	const genericErrorContent = "This is a generic error page"
@@ -60,7 +60,19 @@ func errorsParse(c *caddy.Controller) (*ErrorHandler, error) {
 			what := c.Val()
 			where := c.RemainingArgs()
 
-			if httpserver.IsLogRollerSubdirective(what) {
+			if what == "format" {
+				if len(where) != 1 {
+					return c.ArgErr()
+				}
+				switch where[0] {
+				case "text":
+					cfg.S3Errors = false
+				case "s3":
+					cfg.S3Errors = true
+				default:
+					return c.Errf("Unknown error format '%s'", where[0])
+				}
+			} else if httpserver.IsLogRollerSubdirective(what) {
 				var err error
 				err = httpserver.ParseRoller(handler.Log.Roller, what, where...)
 				if err != nil {
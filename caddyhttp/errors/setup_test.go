@@ -197,3 +197,42 @@ func TestErrorsParse(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorsParseFormat(t *testing.T) {
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		expectedS3Errors bool
+	}{
+		{`errors`, false, false},
+		{`errors {
+			format s3
+		}`, false, true},
+		{`errors errors.txt {
+			format text
+			404 404.html
+		}`, false, false},
+		{`errors {
+			format json
+		}`, true, false},
+		{`errors {
+			format
+		}`, true, false},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("http", test.input)
+		_, err := errorsParse(c)
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if s3Errors := httpserver.GetConfig(c).S3Errors; s3Errors != test.expectedS3Errors {
+			t.Errorf("Test %d: expected S3Errors %v, got %v", i, test.expectedS3Errors, s3Errors)
+		}
+	}
+}
@@ -225,4 +225,13 @@ const (
 
 	// RequestIDCtxKey is the key for the U4 UUID value
 	RequestIDCtxKey caddy.CtxKey = "request_id"
+
+	// S3RequestCtxKey is the key for the parsed *S3Request (s3endpoint)
+	S3RequestCtxKey caddy.CtxKey = "s3_request"
+
+	// S3ErrorsCtxKey is set if errors are rendered as S3 XML documents
+	S3ErrorsCtxKey caddy.CtxKey = "s3_errors"
+
+	// S3ChunkSignerCtxKey is the key for the *S3ChunkSigner of a verified aws-chunked upload (s3auth)
+	S3ChunkSignerCtxKey caddy.CtxKey = "s3_chunk_signer"
 )
@@ -599,6 +599,7 @@ var directives = []string{
 	"on",
 	"supervisor", // github.com/lucaslorentz/caddy-supervisor
 	"request_id",
+	"s3endpoint",
 	"realip", // github.com/captncraig/caddy-realip
 	"git",    // github.com/abiosoft/caddy-git
 
@@ -608,7 +609,6 @@ var directives = []string{
 	// directives that add middleware to the stack
 	"locale", // github.com/simia-tech/caddy-locale
 	"log",
-	"cache", // github.com/nicolasazrak/caddy-cache
 	"rewrite",
 	"ext",
 	"minify", // github.com/hacdias/caddy-minify
@@ -616,13 +616,16 @@ var directives = []string{
 	"header",
 	"geoip", // github.com/kodnaplakal/caddy-geoip
 	"errors",
-	"authz",        // github.com/casbin/caddy-authz
-	"filter",       // github.com/echocat/caddy-filter
-	"ipfilter",     // github.com/pyed/ipfilter
-	"ratelimit",    // github.com/xuqingfeng/caddy-rate-limit
+	"authz",    // github.com/casbin/caddy-authz
+	"filter",   // github.com/echocat/caddy-filter
+	"ipfilter", // github.com/pyed/ipfilter
+	"throttle",
 	"expires",      // github.com/epicagency/caddy-expires
 	"forwardproxy", // github.com/caddyserver/forwardproxy
 	"basicauth",
+	"s3auth",
+	"ratelimit",
+	"cache",
 	"redir",
 	"status",
 	"cors",   // github.com/captncraig/cors/caddy
@@ -641,6 +644,7 @@ var directives = []string{
 	"datadog",    // github.com/payintech/caddy-datadog
 	"prometheus", // github.com/miekg/caddy-prometheus
 	"templates",
+	"proxy_admin",
 	"proxy",
 	"fastcgi",
 	"cgi", // github.com/jung-kurt/caddy-cgi
@@ -397,6 +397,30 @@ func (r *replacer) getSubstitution(key string) string {
 			}
 		}
 		return requestReplacer.Replace(r.requestBody.String())
+	case "{s3_bucket}", "{s3_key}", "{s3_operation}", "{s3_access_key}", "{s3_signature_version}":
+		s3req := GetS3Request(r.request)
+		if s3req == nil {
+			// without s3endpoint we cannot tell virtual-host style
+			// requests apart, so treat everything as path style
+			s3req = ParseS3Request(r.request, nil)
+		}
+		var value string
+		switch key {
+		case "{s3_bucket}":
+			value = s3req.Bucket
+		case "{s3_key}":
+			value = s3req.Key
+		case "{s3_operation}":
+			value = s3req.Operation
+		case "{s3_access_key}":
+			value = s3req.AccessKey
+		case "{s3_signature_version}":
+			value = s3req.SignatureVersion
+		}
+		if value == "" {
+			return r.emptyValue
+		}
+		return value
 	case "{mitm}":
 		if val, ok := r.request.Context().Value(caddy.CtxKey("mitm")).(bool); ok {
 			if val {
@@ -532,27 +556,6 @@ func convertToMilliseconds(d time.Duration) int64 {
 	return nanoToMilliseconds(d.Nanoseconds())
 }
 
-func getBucketAndObjectInfoFromRequest(s3Endpoint string, r *http.Request) (bucketName string, objectName string) {
-	splits := strings.SplitN(r.URL.Path[1:], "/", 2)
-	v := strings.Split(r.Host, ":")
-	hostWithOutPort := v[0]
-	if strings.HasSuffix(hostWithOutPort, "."+s3Endpoint) {
-		bucketName = strings.TrimSuffix(hostWithOutPort, "."+s3Endpoint)
-		if len(splits) == 1 {
-			objectName = splits[0]
-		}
-	} else {
-		if len(splits) == 1 {
-			bucketName = splits[0]
-		}
-		if len(splits) == 2 {
-			bucketName = splits[0]
-			objectName = splits[1]
-		}
-	}
-	return
-}
-
 // Set sets key to value in the r.customReplacements map.
 func (r *replacer) Set(key, value string) {
 	r.customReplacements["{"+key+"}"] = value
@@ -317,6 +317,29 @@ func BenchmarkReplaceEscaped(b *testing.B) {
 	}
 }
 
+func TestS3Replace(t *testing.T) {
+	request, err := http.NewRequest("PUT", "http://bucket.s3.example.com/dir/obj?partNumber=1&uploadId=abc", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=fe5f80f77d5f")
+
+	// without s3endpoint, every request is path style
+	repl := NewReplacer(request, nil, "-")
+	if expected, actual := "bucket.s3.example.com dir UploadPart AKIDEXAMPLE v4",
+		repl.Replace("{host} {s3_bucket} {s3_operation} {s3_access_key} {s3_signature_version}"); expected != actual {
+		t.Errorf("Expected '%s', got '%s'", expected, actual)
+	}
+
+	s3req := ParseS3Request(request, []string{"s3.example.com"})
+	request = request.WithContext(context.WithValue(request.Context(), S3RequestCtxKey, s3req))
+	repl = NewReplacer(request, nil, "-")
+	if expected, actual := "bucket dir/obj UploadPart AKIDEXAMPLE v4",
+		repl.Replace("{s3_bucket} {s3_key} {s3_operation} {s3_access_key} {s3_signature_version}"); expected != actual {
+		t.Errorf("Expected '%s', got '%s'", expected, actual)
+	}
+}
+
 func TestResponseRecorderNil(t *testing.T) {
 
 	reader := strings.NewReader(`{"username": "dennis"}`)
@@ -0,0 +1,47 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// S3StreamingPayload is the X-Amz-Content-Sha256 of aws-chunked
+// uploads whose chunks are signed one after another, each chunk
+// signature chaining from the one before it.
+const S3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+// S3ChunkSigner computes the signatures of the chunks of an
+// aws-chunked upload. It is attached to a request once its seed
+// signature, the signature of the request itself, was verified.
+type S3ChunkSigner struct {
+	Key   []byte // the SigV4 signing key of the credential scope
+	Date  string // the time of the request, like 20130524T000000Z
+	Scope string // the credential scope without the access key
+	Seed  string // the signature of the request
+}
+
+// Sign returns the hex encoded signature of a chunk whose SHA-256
+// hash is chunkHash and which follows the chunk signed with prev,
+// or the request itself for the first chunk.
+func (s *S3ChunkSigner) Sign(prev string, chunkHash []byte) string {
+	const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	stringToSign := S3SignV4Algorithm + "-PAYLOAD\n" +
+		s.Date + "\n" +
+		s.Scope + "\n" +
+		prev + "\n" +
+		emptySHA256 + "\n" +
+		hex.EncodeToString(chunkHash)
+
+	h := hmac.New(sha256.New, s.Key)
+	h.Write([]byte(stringToSign))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetS3ChunkSigner returns the chunk signer attached to r, or
+// nil if r is not an aws-chunked upload verified by s3auth.
+func GetS3ChunkSigner(r *http.Request) *S3ChunkSigner {
+	signer, _ := r.Context().Value(S3ChunkSignerCtxKey).(*S3ChunkSigner)
+	return signer
+}
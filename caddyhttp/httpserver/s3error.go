@@ -0,0 +1,130 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// S3Error is an error that is reported to clients the way
+// the S3 API does it, as an XML document with an error code
+// that the AWS SDKs understand.
+type S3Error struct {
+	// Code is the S3 error code, for example "AccessDenied".
+	Code string
+
+	// Message is a human readable description of the error.
+	Message string
+
+	// HTTPStatus is the status code of the response.
+	HTTPStatus int
+}
+
+// Error implements the error interface.
+func (e S3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// s3StatusErrors maps the status codes that middleware commonly
+// responds with to the S3 errors that mean the same to clients.
+var s3StatusErrors = map[int]S3Error{
+	http.StatusBadRequest: {
+		Code: "InvalidRequest", Message: "The request is invalid."},
+	http.StatusUnauthorized: {
+		Code: "AccessDenied", Message: "Access Denied."},
+	http.StatusForbidden: {
+		Code: "AccessDenied", Message: "Access Denied."},
+	http.StatusNotFound: {
+		Code: "NotFound", Message: "The specified resource does not exist."},
+	http.StatusMethodNotAllowed: {
+		Code: "MethodNotAllowed", Message: "The specified method is not allowed against this resource."},
+	http.StatusRequestTimeout: {
+		Code: "RequestTimeout", Message: "Your socket connection to the server was not read from or written to within the timeout period."},
+	http.StatusLengthRequired: {
+		Code: "MissingContentLength", Message: "You must provide the Content-Length HTTP header."},
+	http.StatusPreconditionFailed: {
+		Code: "PreconditionFailed", Message: "At least one of the preconditions you specified did not hold."},
+	http.StatusRequestEntityTooLarge: {
+		Code: "EntityTooLarge", Message: "Your proposed upload exceeds the maximum allowed object size."},
+	http.StatusRequestedRangeNotSatisfiable: {
+		Code: "InvalidRange", Message: "The requested range cannot be satisfied."},
+	http.StatusTooManyRequests: {
+		Code: "SlowDown", Message: "Please reduce your request rate."},
+	http.StatusInternalServerError: {
+		Code: "InternalError", Message: "We encountered an internal error. Please try again."},
+	http.StatusNotImplemented: {
+		Code: "NotImplemented", Message: "A header you provided implies functionality that is not implemented."},
+	http.StatusBadGateway: {
+		Code: "ServiceUnavailable", Message: "The backend is unavailable. Please try again."},
+	http.StatusServiceUnavailable: {
+		Code: "ServiceUnavailable", Message: "Please reduce your request rate."},
+	http.StatusGatewayTimeout: {
+		Code: "ServiceUnavailable", Message: "The backend did not respond in time. Please try again."},
+}
+
+// S3ErrorForStatus returns the S3Error to report for the
+// HTTP status code status. Status codes S3 has no specific
+// error for are reported with a code derived from their
+// status text, like "Conflict" for 409.
+func S3ErrorForStatus(status int) S3Error {
+	s3err, ok := s3StatusErrors[status]
+	if !ok {
+		text := http.StatusText(status)
+		if text == "" {
+			text = "Internal Error"
+		}
+		s3err = S3Error{Code: strings.Replace(text, " ", "", -1), Message: text + "."}
+	}
+	s3err.HTTPStatus = status
+	return s3err
+}
+
+// s3ErrorResponse is the XML representation of an S3Error.
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+// WriteS3Error writes err to w as an S3 XML error document. The
+// resource and request ID in the document are taken from r.
+func WriteS3Error(w http.ResponseWriter, r *http.Request, err S3Error) {
+	resource := r.URL.Path
+	if u, ok := r.Context().Value(OriginalURLCtxKey).(url.URL); ok {
+		resource = u.Path
+	}
+	reqid, _ := r.Context().Value(RequestIDCtxKey).(string)
+
+	body, _ := xml.Marshal(s3ErrorResponse{
+		Code:      err.Code,
+		Message:   err.Message,
+		Resource:  resource,
+		RequestID: reqid,
+	})
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if reqid != "" {
+		w.Header().Set("X-Amz-Request-Id", reqid)
+	}
+	w.WriteHeader(err.HTTPStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy/caddytls"
+)
+
+func TestWriteS3Error(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://s3.example.com/bucket/obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), RequestIDCtxKey, "71a75329-d9f9-4d25-957e-e689a7b68d78"))
+	w := httptest.NewRecorder()
+
+	WriteS3Error(w, r, S3Error{Code: "AccessDenied", Message: "Access Denied.", HTTPStatus: http.StatusForbidden})
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("Expected Content-Type application/xml, got %s", ct)
+	}
+	if id := w.Header().Get("X-Amz-Request-Id"); id != "71a75329-d9f9-4d25-957e-e689a7b68d78" {
+		t.Errorf("Expected X-Amz-Request-Id header, got '%s'", id)
+	}
+	expected := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<Error><Code>AccessDenied</Code><Message>Access Denied.</Message>` +
+		`<Resource>/bucket/obj</Resource><RequestId>71a75329-d9f9-4d25-957e-e689a7b68d78</RequestId></Error>`
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Expected body:\n%s\ngot:\n%s", expected, body)
+	}
+}
+
+func TestS3ErrorForStatus(t *testing.T) {
+	for i, test := range []struct {
+		status       int
+		expectedCode string
+	}{
+		{http.StatusRequestEntityTooLarge, "EntityTooLarge"},
+		{http.StatusTooManyRequests, "SlowDown"},
+		{http.StatusBadGateway, "ServiceUnavailable"},
+		{http.StatusServiceUnavailable, "ServiceUnavailable"},
+		{http.StatusGatewayTimeout, "ServiceUnavailable"},
+		{http.StatusRequestTimeout, "RequestTimeout"},
+		{http.StatusConflict, "Conflict"},
+		{599, "InternalError"},
+	} {
+		s3err := S3ErrorForStatus(test.status)
+		if s3err.Code != test.expectedCode {
+			t.Errorf("Test %d: expected code %s, got %s", i, test.expectedCode, s3err.Code)
+		}
+		if s3err.HTTPStatus != test.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.status, s3err.HTTPStatus)
+		}
+		if s3err.Message == "" {
+			t.Errorf("Test %d: expected a message", i)
+		}
+	}
+}
+
+func TestDefaultErrorFuncS3(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/bucket/obj", nil)
+
+	w := httptest.NewRecorder()
+	DefaultErrorFunc(w, r, http.StatusRequestEntityTooLarge)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected plain text error without S3 errors, got %s", ct)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), S3ErrorsCtxKey, true))
+	w = httptest.NewRecorder()
+	DefaultErrorFunc(w, r, http.StatusRequestEntityTooLarge)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "<Code>EntityTooLarge</Code>") {
+		t.Errorf("Expected EntityTooLarge error document, got %s", w.Body.String())
+	}
+}
+
+func TestStrictHostMatchingS3Error(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", []*SiteConfig{{
+		Addr:               Address{Host: "example.com"},
+		StrictHostMatching: true,
+		S3Errors:           true,
+		TLS:                new(caddytls.Config),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "https://example.com/bucket/obj", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "other.example.com"}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "<Code>AccessDenied</Code>") {
+		t.Errorf("Expected AccessDenied error document, got %s", w.Body.String())
+	}
+}
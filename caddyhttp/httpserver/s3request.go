@@ -0,0 +1,298 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// S3AddressingStyle describes how the bucket of an S3 request
+// was addressed by the client.
+type S3AddressingStyle string
+
+const (
+	// S3PathStyle is used for requests like
+	// http://s3.example.com/bucket/key.
+	S3PathStyle S3AddressingStyle = "path"
+
+	// S3VirtualHostStyle is used for requests like
+	// http://bucket.s3.example.com/key.
+	S3VirtualHostStyle S3AddressingStyle = "virtual-host"
+)
+
+// S3Request holds the S3 specific information of a request, as
+// parsed by ParseS3Request. It is attached to the request context
+// by the s3endpoint directive and can be obtained from there with
+// GetS3Request.
+type S3Request struct {
+	// Bucket is the name of the addressed bucket;
+	// empty for service level requests.
+	Bucket string
+
+	// Key is the (unescaped) object key; empty for
+	// service and bucket level requests.
+	Key string
+
+	// Style is the addressing style the client used.
+	Style S3AddressingStyle
+
+	// Operation is the name of the S3 API operation
+	// inferred from method, query and headers, for
+	// example "GetObject" or "UploadPart".
+	Operation string
+
+	// AccessKey is the AWS access key ID the request
+	// claims to be signed with; empty for anonymous
+	// requests. It is not verified.
+	AccessKey string
+
+	// SignatureVersion is "v2" or "v4" for signed
+	// requests and empty for anonymous ones.
+	SignatureVersion string
+}
+
+// Signature versions of S3 requests.
+const (
+	S3SignatureV2 = "v2"
+	S3SignatureV4 = "v4"
+)
+
+// S3SignV4Algorithm is the algorithm identifier of AWS Signature
+// Version 4, as used in Authorization headers and presigned URLs.
+const S3SignV4Algorithm = "AWS4-HMAC-SHA256"
+
+// ParseS3Request parses r as a request to an S3 endpoint. endpoints
+// is the list of domains the S3 service is served on; a request whose
+// host is a subdomain of one of them is treated as virtual-host style,
+// all other requests are treated as path style.
+func ParseS3Request(r *http.Request, endpoints []string) *S3Request {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(host)
+
+	// pick the longest endpoint the host belongs to, so that
+	// overlapping endpoints like s3.example.com and example.com
+	// resolve to the most specific one
+	var endpoint string
+	for _, e := range endpoints {
+		e = strings.ToLower(e)
+		if e == "" || len(e) <= len(endpoint) {
+			continue
+		}
+		if host == e || strings.HasSuffix(host, "."+e) {
+			endpoint = e
+		}
+	}
+
+	s3req := &S3Request{Style: S3PathStyle}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if endpoint != "" && host != endpoint {
+		s3req.Style = S3VirtualHostStyle
+		s3req.Bucket = strings.TrimSuffix(host, "."+endpoint)
+		s3req.Key = path
+	} else {
+		parts := strings.SplitN(path, "/", 2)
+		s3req.Bucket = parts[0]
+		if len(parts) == 2 {
+			s3req.Key = parts[1]
+		}
+	}
+	query := r.URL.Query()
+	s3req.Operation = inferS3Operation(r.Method, s3req.Bucket, s3req.Key, query, r.Header)
+	s3req.AccessKey, s3req.SignatureVersion = parseS3Credential(r.Header.Get("Authorization"), query)
+
+	return s3req
+}
+
+// GetS3Request returns the S3 request information attached to r,
+// or nil if the s3endpoint directive is not in use.
+func GetS3Request(r *http.Request) *S3Request {
+	s3req, _ := r.Context().Value(S3RequestCtxKey).(*S3Request)
+	return s3req
+}
+
+// parseS3Credential extracts the access key ID and signature version
+// from an Authorization header value or, if there is none, from the
+// query parameters of a presigned URL.
+func parseS3Credential(auth string, query url.Values) (accessKey, version string) {
+	switch {
+	case strings.HasPrefix(auth, S3SignV4Algorithm+" "):
+		// AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request,
+		// SignedHeaders=host;range;x-amz-date, Signature=fe5f80f77d5f...
+		for _, field := range strings.Split(auth[len(S3SignV4Algorithm)+1:], ",") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "Credential=") {
+				return credentialAccessKey(strings.TrimPrefix(field, "Credential=")), S3SignatureV4
+			}
+		}
+		return "", S3SignatureV4
+	case strings.HasPrefix(auth, "AWS "):
+		// AWS AKID:frJIUN8DYpKDtOLCwo//yllqDzg=
+		credential := auth[len("AWS "):]
+		if i := strings.LastIndex(credential, ":"); i >= 0 {
+			credential = credential[:i]
+		}
+		return credential, S3SignatureV2
+	}
+
+	if query.Get("X-Amz-Algorithm") == S3SignV4Algorithm {
+		return credentialAccessKey(query.Get("X-Amz-Credential")), S3SignatureV4
+	}
+	if accessKey := query.Get("AWSAccessKeyId"); accessKey != "" {
+		return accessKey, S3SignatureV2
+	}
+	return "", ""
+}
+
+// credentialAccessKey returns the access key ID of a SigV4
+// credential scope like AKID/20130524/us-east-1/s3/aws4_request.
+func credentialAccessKey(credential string) string {
+	if i := strings.Index(credential, "/"); i >= 0 {
+		return credential[:i]
+	}
+	return credential
+}
+
+// s3Subresource maps a bucket or object subresource to the
+// operations it stands for, keyed by HTTP method.
+type s3Subresource map[string]string
+
+// s3BucketSubresources lists the bucket subresources in the order in
+// which they are checked; the order matters for requests that carry
+// more than one of them.
+var s3BucketSubresources = []struct {
+	name string
+	ops  s3Subresource
+}{
+	{"uploads", s3Subresource{"GET": "ListMultipartUploads"}},
+	{"versions", s3Subresource{"GET": "ListObjectVersions"}},
+	{"delete", s3Subresource{"POST": "DeleteObjects"}},
+	{"location", s3Subresource{"GET": "GetBucketLocation"}},
+	{"acl", s3Subresource{"GET": "GetBucketAcl", "PUT": "PutBucketAcl"}},
+	{"cors", s3Subresource{"GET": "GetBucketCors", "PUT": "PutBucketCors", "DELETE": "DeleteBucketCors"}},
+	{"lifecycle", s3Subresource{"GET": "GetBucketLifecycle", "PUT": "PutBucketLifecycle", "DELETE": "DeleteBucketLifecycle"}},
+	{"policy", s3Subresource{"GET": "GetBucketPolicy", "PUT": "PutBucketPolicy", "DELETE": "DeleteBucketPolicy"}},
+	{"versioning", s3Subresource{"GET": "GetBucketVersioning", "PUT": "PutBucketVersioning"}},
+	{"website", s3Subresource{"GET": "GetBucketWebsite", "PUT": "PutBucketWebsite", "DELETE": "DeleteBucketWebsite"}},
+	{"logging", s3Subresource{"GET": "GetBucketLogging", "PUT": "PutBucketLogging"}},
+	{"tagging", s3Subresource{"GET": "GetBucketTagging", "PUT": "PutBucketTagging", "DELETE": "DeleteBucketTagging"}},
+	{"encryption", s3Subresource{"GET": "GetBucketEncryption", "PUT": "PutBucketEncryption", "DELETE": "DeleteBucketEncryption"}},
+	{"notification", s3Subresource{"GET": "GetBucketNotification", "PUT": "PutBucketNotification"}},
+	{"replication", s3Subresource{"GET": "GetBucketReplication", "PUT": "PutBucketReplication", "DELETE": "DeleteBucketReplication"}},
+}
+
+// s3ObjectSubresources is like s3BucketSubresources, but for
+// object level requests.
+var s3ObjectSubresources = []struct {
+	name string
+	ops  s3Subresource
+}{
+	{"uploads", s3Subresource{"POST": "CreateMultipartUpload"}},
+	{"acl", s3Subresource{"GET": "GetObjectAcl", "PUT": "PutObjectAcl"}},
+	{"tagging", s3Subresource{"GET": "GetObjectTagging", "PUT": "PutObjectTagging", "DELETE": "DeleteObjectTagging"}},
+	{"restore", s3Subresource{"POST": "RestoreObject"}},
+	{"append", s3Subresource{"POST": "AppendObject"}},
+}
+
+// inferS3Operation returns the name of the S3 API operation of a
+// request, or "Unknown" if it cannot be determined.
+func inferS3Operation(method, bucket, key string, query url.Values, header http.Header) string {
+	has := func(name string) bool {
+		_, ok := query[name]
+		return ok
+	}
+
+	if method == http.MethodOptions {
+		return "PreflightRequest"
+	}
+
+	if bucket == "" {
+		if method == http.MethodGet {
+			return "ListBuckets"
+		}
+		return "Unknown"
+	}
+
+	if key == "" {
+		for _, sub := range s3BucketSubresources {
+			if has(sub.name) {
+				if op, ok := sub.ops[method]; ok {
+					return op
+				}
+				return "Unknown"
+			}
+		}
+		switch method {
+		case http.MethodGet:
+			if query.Get("list-type") == "2" {
+				return "ListObjectsV2"
+			}
+			return "ListObjects"
+		case http.MethodHead:
+			return "HeadBucket"
+		case http.MethodPut:
+			return "CreateBucket"
+		case http.MethodDelete:
+			return "DeleteBucket"
+		case http.MethodPost:
+			return "PostObject"
+		}
+		return "Unknown"
+	}
+
+	if has("uploadId") {
+		switch method {
+		case http.MethodPut:
+			if header.Get("X-Amz-Copy-Source") != "" {
+				return "UploadPartCopy"
+			}
+			return "UploadPart"
+		case http.MethodPost:
+			return "CompleteMultipartUpload"
+		case http.MethodDelete:
+			return "AbortMultipartUpload"
+		case http.MethodGet:
+			return "ListParts"
+		}
+		return "Unknown"
+	}
+	for _, sub := range s3ObjectSubresources {
+		if has(sub.name) {
+			if op, ok := sub.ops[method]; ok {
+				return op
+			}
+			return "Unknown"
+		}
+	}
+	switch method {
+	case http.MethodGet:
+		return "GetObject"
+	case http.MethodHead:
+		return "HeadObject"
+	case http.MethodPut:
+		if header.Get("X-Amz-Copy-Source") != "" {
+			return "CopyObject"
+		}
+		return "PutObject"
+	case http.MethodDelete:
+		return "DeleteObject"
+	}
+	return "Unknown"
+}
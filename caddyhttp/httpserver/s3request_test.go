@@ -0,0 +1,133 @@
+// Copyright 2015 Light Code Labs, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseS3Request(t *testing.T) {
+	endpoints := []string{"example.com", "s3.example.com", ""}
+
+	for i, test := range []struct {
+		method   string
+		url      string
+		header   http.Header
+		expected S3Request
+	}{
+		{"GET", "http://s3.example.com/", nil,
+			S3Request{Style: S3PathStyle, Operation: "ListBuckets"}},
+		{"GET", "http://s3.example.com/bucket", nil,
+			S3Request{Bucket: "bucket", Style: S3PathStyle, Operation: "ListObjects"}},
+		{"GET", "http://s3.example.com/bucket/?list-type=2", nil,
+			S3Request{Bucket: "bucket", Style: S3PathStyle, Operation: "ListObjectsV2"}},
+		{"GET", "http://s3.example.com:8080/bucket/dir/obj", nil,
+			S3Request{Bucket: "bucket", Key: "dir/obj", Style: S3PathStyle, Operation: "GetObject"}},
+		{"GET", "http://Bucket.S3.example.com/dir/obj", nil,
+			S3Request{Bucket: "bucket", Key: "dir/obj", Style: S3VirtualHostStyle, Operation: "GetObject"}},
+		{"HEAD", "http://bucket.s3.example.com:8080/", nil,
+			S3Request{Bucket: "bucket", Style: S3VirtualHostStyle, Operation: "HeadBucket"}},
+		{"PUT", "http://my.bucket.s3.example.com/", nil,
+			S3Request{Bucket: "my.bucket", Style: S3VirtualHostStyle, Operation: "CreateBucket"}},
+		{"GET", "http://other.org/bucket/obj", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "GetObject"}},
+		{"GET", "http://s3.example.com/bucket/a%20b", nil,
+			S3Request{Bucket: "bucket", Key: "a b", Style: S3PathStyle, Operation: "GetObject"}},
+		{"PUT", "http://s3.example.com/bucket?acl", nil,
+			S3Request{Bucket: "bucket", Style: S3PathStyle, Operation: "PutBucketAcl"}},
+		{"GET", "http://s3.example.com/bucket/obj?acl", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "GetObjectAcl"}},
+		{"GET", "http://s3.example.com/bucket?uploads", nil,
+			S3Request{Bucket: "bucket", Style: S3PathStyle, Operation: "ListMultipartUploads"}},
+		{"POST", "http://s3.example.com/bucket/obj?uploads", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "CreateMultipartUpload"}},
+		{"PUT", "http://s3.example.com/bucket/obj?partNumber=1&uploadId=x", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "UploadPart"}},
+		{"PUT", "http://s3.example.com/bucket/obj?partNumber=1&uploadId=x", http.Header{"X-Amz-Copy-Source": {"/b/o"}},
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "UploadPartCopy"}},
+		{"POST", "http://s3.example.com/bucket/obj?uploadId=x", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "CompleteMultipartUpload"}},
+		{"DELETE", "http://s3.example.com/bucket/obj?uploadId=x", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "AbortMultipartUpload"}},
+		{"GET", "http://s3.example.com/bucket/obj?uploadId=x", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "ListParts"}},
+		{"PUT", "http://s3.example.com/bucket/obj", http.Header{"X-Amz-Copy-Source": {"/b/o"}},
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "CopyObject"}},
+		{"POST", "http://s3.example.com/bucket?delete", nil,
+			S3Request{Bucket: "bucket", Style: S3PathStyle, Operation: "DeleteObjects"}},
+		{"POST", "http://s3.example.com/bucket?acl", nil,
+			S3Request{Bucket: "bucket", Style: S3PathStyle, Operation: "Unknown"}},
+		{"OPTIONS", "http://s3.example.com/bucket/obj", nil,
+			S3Request{Bucket: "bucket", Key: "obj", Style: S3PathStyle, Operation: "PreflightRequest"}},
+	} {
+		r, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if test.header != nil {
+			r.Header = test.header
+		}
+		actual := ParseS3Request(r, endpoints)
+		if *actual != test.expected {
+			t.Errorf("Test %d (%s %s): expected %+v, got %+v", i, test.method, test.url, test.expected, *actual)
+		}
+	}
+}
+
+func TestParseS3Credential(t *testing.T) {
+	for i, test := range []struct {
+		auth              string
+		query             string
+		expectedAccessKey string
+		expectedVersion   string
+	}{
+		{"", "", "", ""},
+		{"Bearer foo", "", "", ""},
+		{"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;range;x-amz-date, Signature=fe5f80f77d5f", "",
+			"AKIDEXAMPLE", S3SignatureV4},
+		{"AWS4-HMAC-SHA256 SignedHeaders=host,Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request", "",
+			"AKIDEXAMPLE", S3SignatureV4},
+		{"AWS4-HMAC-SHA256 Signature=fe5f80f77d5f", "", "", S3SignatureV4},
+		{"AWS AKIDEXAMPLE:frJIUN8DYpKDtOLCwo//yllqDzg=", "", "AKIDEXAMPLE", S3SignatureV2},
+		{"", "X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIDEXAMPLE%2F20130524%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Signature=aeeed9bbccd4",
+			"AKIDEXAMPLE", S3SignatureV4},
+		{"", "AWSAccessKeyId=AKIDEXAMPLE&Expires=1141889120&Signature=vjbyPxybdZaNmGa%2ByT272YEAiv4%3D",
+			"AKIDEXAMPLE", S3SignatureV2},
+	} {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		accessKey, version := parseS3Credential(test.auth, query)
+		if accessKey != test.expectedAccessKey {
+			t.Errorf("Test %d: expected access key '%s', got '%s'", i, test.expectedAccessKey, accessKey)
+		}
+		if version != test.expectedVersion {
+			t.Errorf("Test %d: expected signature version '%s', got '%s'", i, test.expectedVersion, version)
+		}
+	}
+}
+
+func TestGetS3Request(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3req := GetS3Request(r); s3req != nil {
+		t.Errorf("Expected no S3 request, got %+v", s3req)
+	}
+}
@@ -417,6 +417,11 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 		return 0, nil
 	}
 
+	if vhost.S3Errors {
+		c = context.WithValue(r.Context(), S3ErrorsCtxKey, true)
+		r = r.WithContext(c)
+	}
+
 	// we still check for ACME challenge if the vhost exists,
 	// because we must apply its HTTP challenge config settings
 	if caddytls.HTTPChallengeHandler(w, r, vhost.ListenHost) {
@@ -439,10 +444,23 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 		r.Close = true
 		log.Printf("[ERROR] %s - strict host matching: SNI (%s) and HTTP Host (%s) values differ",
 			vhost.Addr, r.TLS.ServerName, hostname)
+		if vhost.S3Errors {
+			DefaultErrorFunc(w, r, http.StatusForbidden)
+			return 0, nil
+		}
 		return http.StatusForbidden, nil
 	}
 
-	return vhost.middlewareChain.ServeHTTP(w, r)
+	status, err := vhost.middlewareChain.ServeHTTP(w, r)
+
+	// the fallback error response of ServeHTTP does not see
+	// the context of the site, so S3 errors are written here
+	if status >= 400 && vhost.S3Errors {
+		DefaultErrorFunc(w, r, status)
+		return 0, err
+	}
+
+	return status, err
 }
 
 func trimPathPrefix(u *url.URL, prefix string) *url.URL {
@@ -544,8 +562,13 @@ func (ln tcpKeepAliveListener) File() (*os.File, error) {
 var ErrMaxBytesExceeded = errors.New("http: request body too large")
 
 // DefaultErrorFunc responds to an HTTP request with a simple description
-// of the specified HTTP status code.
+// of the specified HTTP status code. If the site renders S3 errors, the
+// description is an S3 XML error document.
 func DefaultErrorFunc(w http.ResponseWriter, r *http.Request, status int) {
+	if s3Errors, _ := r.Context().Value(S3ErrorsCtxKey).(bool); s3Errors {
+		WriteS3Error(w, r, S3ErrorForStatus(status))
+		return
+	}
 	WriteTextResponse(w, status, fmt.Sprintf("%d %s\n", status, http.StatusText(status)))
 }
 
@@ -83,6 +83,15 @@ type SiteConfig struct {
 	// If true, any requests not matching other site definitions
 	// may be served by this site.
 	FallbackSite bool
+
+	// The domains S3 requests to this site are addressed to,
+	// used to tell virtual-host style requests from path
+	// style ones (see the s3endpoint directive)
+	S3Endpoints []string
+
+	// If true, error responses are S3 XML documents
+	// rather than plain text (see the errors directive)
+	S3Errors bool
 }
 
 // Timeouts specify various timeouts for a server to use.
@@ -106,6 +115,7 @@ type Timeouts struct {
 type Limits struct {
 	MaxRequestHeaderSize int64
 	MaxRequestBodySizes  []PathLimit
+	S3                   *S3Limits // nil unless uploads are limited like S3 does
 }
 
 // PathLimit is a mapping from a site's path to its corresponding
@@ -115,6 +125,15 @@ type PathLimit struct {
 	Limit int64
 }
 
+// S3Limits are the limits S3 puts on uploads. They apply
+// to the requests for objects in addition to the limits of
+// their paths.
+type S3Limits struct {
+	MaxObjectSize int64 // of the body of a PutObject request
+	MaxPartSize   int64 // of the body of an UploadPart request
+	MaxParts      int   // part numbers go from 1 to MaxParts
+}
+
 // AddMiddleware adds a middleware to a site's middleware stack.
 func (s *SiteConfig) AddMiddleware(m Middleware) {
 	s.middleware = append(s.middleware, m)
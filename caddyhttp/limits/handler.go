@@ -25,21 +25,26 @@ import (
 type Limit struct {
 	Next       httpserver.Handler
 	BodyLimits []httpserver.PathLimit
+	S3         *httpserver.S3Limits
+	// S3Endpoints are those of the site; limits runs
+	// before s3endpoint puts the S3 request on the context
+	S3Endpoints []string
 }
 
 func (l Limit) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	if r.Body == nil {
-		return l.Next.ServeHTTP(w, r)
-	}
-
-	// apply the path-based request body size limit.
-	for _, bl := range l.BodyLimits {
-		if httpserver.Path(r.URL.Path).Matches(bl.Path) {
-			r.Body = MaxBytesReader(w, r.Body, bl.Limit)
-			break
+	if r.Body != nil {
+		// apply the path-based request body size limit.
+		for _, bl := range l.BodyLimits {
+			if httpserver.Path(r.URL.Path).Matches(bl.Path) {
+				r.Body = MaxBytesReader(w, r.Body, bl.Limit)
+				break
+			}
 		}
 	}
 
+	if l.S3 != nil {
+		return l.serveS3(w, r)
+	}
 	return l.Next.ServeHTTP(w, r)
 }
 
@@ -0,0 +1,231 @@
+package limits
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+const (
+	// uploadIdleTimeout is how long a multipart upload
+	// without requests is considered in progress.
+	uploadIdleTimeout = 24 * time.Hour
+
+	// sweepInterval is how often idle uploads are forgotten.
+	sweepInterval = time.Minute
+
+	// maxInitiateResponse bounds the part of the response to
+	// CreateMultipartUpload kept to find the upload ID in.
+	maxInitiateResponse = 4096
+
+	// minChunkSize is the smallest size S3 allows for all
+	// but the last chunk of an aws-chunked upload.
+	minChunkSize = 8 * 1024
+
+	// maxChunkOverhead bounds what aws-chunked encoding adds to
+	// a chunk: its size, its signature and the line breaks.
+	maxChunkOverhead = 128
+
+	// maxTrailerSize bounds the trailing headers of an
+	// aws-chunked upload.
+	maxTrailerSize = 1024
+)
+
+// defaultS3Limits returns the limits of Amazon S3.
+func defaultS3Limits() *httpserver.S3Limits {
+	return &httpserver.S3Limits{
+		MaxObjectSize: 5 * 1024 * 1024 * 1024,
+		MaxPartSize:   5 * 1024 * 1024 * 1024,
+		MaxParts:      10000,
+	}
+}
+
+// serveS3 serves the request r for an object after applying the
+// S3 limits to it, and keeps track of the multipart uploads.
+func (l Limit) serveS3(w http.ResponseWriter, r *http.Request) (int, error) {
+	s3req := httpserver.GetS3Request(r)
+	if s3req == nil {
+		s3req = httpserver.ParseS3Request(r, l.S3Endpoints)
+	}
+
+	var max int64
+	switch s3req.Operation {
+	case "PutObject":
+		max = l.S3.MaxObjectSize
+	case "UploadPart", "UploadPartCopy":
+		n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || n < 1 || n > l.S3.MaxParts {
+			httpserver.WriteS3Error(w, r, httpserver.S3Error{
+				Code:       "InvalidArgument",
+				Message:    "Part number must be an integer between 1 and " + strconv.Itoa(l.S3.MaxParts) + ", inclusive.",
+				HTTPStatus: http.StatusBadRequest,
+			})
+			return 0, nil
+		}
+		if s3req.Operation == "UploadPart" {
+			max = l.S3.MaxPartSize
+		}
+	case "CreateMultipartUpload", "CompleteMultipartUpload", "AbortMultipartUpload":
+	default:
+		return l.Next.ServeHTTP(w, r)
+	}
+
+	if max > 0 {
+		// the body of aws-chunked uploads is larger than the object
+		rawMax := max
+		tooLarge := r.ContentLength > rawMax
+		if isChunked(r.Header) {
+			rawMax = max + (max/minChunkSize+2)*maxChunkOverhead + maxTrailerSize
+			decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+			tooLarge = (err == nil && decoded > max) || r.ContentLength > rawMax
+		}
+		if tooLarge {
+			httpserver.WriteS3Error(w, r, httpserver.S3ErrorForStatus(http.StatusRequestEntityTooLarge))
+			return 0, nil
+		}
+		if r.Body != nil {
+			r.Body = MaxBytesReader(w, r.Body, rawMax)
+		}
+	}
+
+	rec := &uploadRecorder{ResponseRecorder: httpserver.NewResponseRecorder(w)}
+	status, err := l.Next.ServeHTTP(rec, r)
+	result := status
+	if result == 0 {
+		result = rec.Status()
+	}
+	if result >= 300 {
+		if result == http.StatusNotFound && s3req.Operation == "AbortMultipartUpload" {
+			uploads.remove(s3req.Bucket, r.URL.Query().Get("uploadId"))
+		}
+		return status, err
+	}
+
+	switch s3req.Operation {
+	case "CreateMultipartUpload":
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if xml.Unmarshal(rec.body.Bytes(), &result) == nil && result.UploadID != "" {
+			uploads.touch(s3req.Bucket, result.UploadID)
+		}
+	case "UploadPart", "UploadPartCopy":
+		// uploads created before a restart are tracked again
+		// once they get parts
+		uploads.touch(s3req.Bucket, r.URL.Query().Get("uploadId"))
+	case "CompleteMultipartUpload", "AbortMultipartUpload":
+		// S3 may report a failed completion with status 200; the
+		// upload is tracked again if the client uploads more parts
+		uploads.remove(s3req.Bucket, r.URL.Query().Get("uploadId"))
+	}
+	return status, err
+}
+
+// isChunked reports whether header is that of an aws-chunked
+// upload, whose X-Amz-Decoded-Content-Length is the object size.
+func isChunked(header http.Header) bool {
+	return strings.HasPrefix(header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(header.Get("Content-Encoding"), "aws-chunked")
+}
+
+// uploadRecorder records the response to a request for a multipart
+// upload, keeping the start of the body, which has the upload ID
+// of a new upload.
+type uploadRecorder struct {
+	*httpserver.ResponseRecorder
+	body bytes.Buffer
+}
+
+func (w *uploadRecorder) Write(buf []byte) (int, error) {
+	if room := maxInitiateResponse - w.body.Len(); room > 0 {
+		if len(buf) < room {
+			room = len(buf)
+		}
+		w.body.Write(buf[:room])
+	}
+	return w.ResponseRecorder.Write(buf)
+}
+
+// uploadTracker keeps track of the multipart uploads in
+// progress, by bucket.
+type uploadTracker struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]time.Time // last request by upload ID
+	swept   time.Time
+}
+
+// uploads are the multipart uploads in progress to all sites,
+// which are kept across restarts.
+var uploads = &uploadTracker{buckets: make(map[string]map[string]time.Time)}
+
+// touch records a request for the upload id to bucket.
+func (t *uploadTracker) touch(bucket, id string) {
+	if id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids, ok := t.buckets[bucket]
+	if !ok {
+		ids = make(map[string]time.Time)
+		t.buckets[bucket] = ids
+	}
+	ids[id] = now()
+	t.report(bucket)
+	t.sweep()
+}
+
+// remove forgets the upload id to bucket.
+func (t *uploadTracker) remove(bucket, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ids, ok := t.buckets[bucket]; ok {
+		delete(ids, id)
+		t.report(bucket)
+	}
+	t.sweep()
+}
+
+// count returns the number of uploads in progress to bucket.
+func (t *uploadTracker) count(bucket string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.buckets[bucket])
+}
+
+// sweep forgets the uploads that have been idle for too
+// long, at most once every sweepInterval; t.mu must be held.
+func (t *uploadTracker) sweep() {
+	current := now()
+	if current.Sub(t.swept) < sweepInterval {
+		return
+	}
+	t.swept = current
+	for bucket, ids := range t.buckets {
+		for id, last := range ids {
+			if current.Sub(last) > uploadIdleTimeout {
+				delete(ids, id)
+			}
+		}
+		t.report(bucket)
+	}
+}
+
+// report updates the number of uploads in progress to bucket,
+// forgetting buckets without any; t.mu must be held.
+func (t *uploadTracker) report(bucket string) {
+	n := len(t.buckets[bucket])
+	if n == 0 {
+		delete(t.buckets, bucket)
+	}
+	prometheus.SetMultipartUploads(bucket, n)
+}
+
+var now = time.Now
@@ -0,0 +1,151 @@
+package limits
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestS3Limits(t *testing.T) {
+	var requests int
+	var readErr error
+	l := Limit{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			requests++
+			_, readErr = ioutil.ReadAll(r.Body)
+			return 0, nil
+		}),
+		S3:          &httpserver.S3Limits{MaxObjectSize: 10, MaxPartSize: 5, MaxParts: 3},
+		S3Endpoints: []string{"s3.example.com"},
+	}
+
+	for i, test := range []struct {
+		method, target, body string
+		header               http.Header
+		code                 string // S3 error code, if rejected
+	}{
+		{method: "PUT", target: "/bucket/key", body: "0123456789"},
+		{method: "PUT", target: "/bucket/key", body: "0123456789a", code: "EntityTooLarge"},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=3", body: "01234"},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=1", body: "012345", code: "EntityTooLarge"},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=4", body: "0", code: "InvalidArgument"},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=0", body: "0", code: "InvalidArgument"},
+		{method: "PUT", target: "/bucket/key?uploadId=1", body: "0", code: "InvalidArgument"},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=x", code: "InvalidArgument",
+			header: http.Header{"X-Amz-Copy-Source": {"/bucket/other"}}},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=2",
+			header: http.Header{"X-Amz-Copy-Source": {"/bucket/other"}}},
+		// the size of the object of an aws-chunked upload counts
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=2", body: "0123456789abcdef",
+			header: http.Header{"X-Amz-Content-Sha256": {"STREAMING-AWS4-HMAC-SHA256-PAYLOAD"}, "X-Amz-Decoded-Content-Length": {"5"}}},
+		{method: "PUT", target: "/bucket/key?uploadId=1&partNumber=2", body: "0",
+			header: http.Header{"Content-Encoding": {"aws-chunked"}, "X-Amz-Decoded-Content-Length": {"6"}}, code: "EntityTooLarge"},
+		{method: "PUT", target: "/bucket/key", body: "0123456789a",
+			header: http.Header{"X-Amz-Decoded-Content-Length": {"1"}}, code: "EntityTooLarge"},
+		// virtual-host style requests
+		{method: "PUT", target: "http://bucket.s3.example.com/key", body: "0123456789"},
+		{method: "PUT", target: "http://bucket.s3.example.com/key", body: "0123456789a", code: "EntityTooLarge"},
+		{method: "PUT", target: "http://bucket.s3.example.com/key?uploadId=1&partNumber=4", body: "0", code: "InvalidArgument"},
+		// only uploads are limited
+		{method: "PUT", target: "/bucket/key?tagging", body: "0123456789abcdef"},
+		{method: "POST", target: "/bucket?delete", body: "0123456789abcdef"},
+	} {
+		requests = 0
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		for name, values := range test.header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		if _, err := l.ServeHTTP(w, r); err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		}
+		if test.code == "" {
+			if requests != 1 || readErr != nil {
+				t.Errorf("Test %d: expected request to be served, got %d requests, %v", i, requests, readErr)
+			}
+			continue
+		}
+		if requests != 0 || !strings.Contains(w.Body.String(), "<Code>"+test.code+"</Code>") {
+			t.Errorf("Test %d: expected %s, got %d requests, %q", i, test.code, requests, w.Body.String())
+		}
+	}
+
+	// the size of bodies of unknown length is limited while reading
+	r := httptest.NewRequest("PUT", "/bucket/key?uploadId=1&partNumber=1", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+	l.ServeHTTP(httptest.NewRecorder(), r)
+	if readErr != httpserver.ErrMaxBytesExceeded {
+		t.Errorf("Expected error %v, got %v", httpserver.ErrMaxBytesExceeded, readErr)
+	}
+
+	// and so is the size of bodies longer than they claim
+	r = httptest.NewRequest("PUT", "/bucket/key", strings.NewReader("0123456789a"))
+	r.ContentLength = 1
+	l.ServeHTTP(httptest.NewRecorder(), r)
+	if readErr != httpserver.ErrMaxBytesExceeded {
+		t.Errorf("Expected error %v, got %v", httpserver.ErrMaxBytesExceeded, readErr)
+	}
+}
+
+func TestS3UploadTracking(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	start := time.Unix(1500000000, 0)
+	now = func() time.Time { return start }
+	defer func(old *uploadTracker) { uploads = old }(uploads)
+	uploads = &uploadTracker{buckets: make(map[string]map[string]time.Time)}
+
+	next := httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		query := r.URL.Query()
+		switch {
+		case query.Get("uploadId") == "missing":
+			return http.StatusNotFound, nil
+		case r.Method == "POST" && r.URL.RawQuery == "uploads":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<InitiateMultipartUploadResult><Bucket>tracked</Bucket><Key>key</Key><UploadId>` +
+				strings.TrimPrefix(r.URL.Path, "/tracked/") + `</UploadId></InitiateMultipartUploadResult>`))
+		case query.Get("uploadId") == "failing":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return 0, nil
+	})
+	l := Limit{Next: next, S3: defaultS3Limits(), S3Endpoints: []string{"s3.example.com"}}
+	serve := func(method, target string) {
+		l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil))
+	}
+
+	serve("POST", "/tracked/a?uploads")
+	serve("POST", "/tracked/b?uploads")
+	serve("PUT", "/tracked/c?uploadId=c&partNumber=1")
+	serve("PUT", "/tracked/d?uploadId=failing&partNumber=1")
+	if n := uploads.count("tracked"); n != 3 {
+		t.Fatalf("Expected 3 uploads, got %d", n)
+	}
+
+	serve("POST", "/tracked/a?uploadId=a")
+	serve("DELETE", "/tracked/b?uploadId=b")
+	serve("DELETE", "/tracked/e?uploadId=missing")
+	if n := uploads.count("tracked"); n != 1 {
+		t.Errorf("Expected 1 upload, got %d", n)
+	}
+
+	// idle uploads are forgotten eventually
+	now = func() time.Time { return start.Add(uploadIdleTimeout + sweepInterval) }
+	serve("PUT", "/tracked/f?uploadId=f&partNumber=1")
+	uploads.mu.Lock()
+	_, idle := uploads.buckets["tracked"]["c"]
+	uploads.mu.Unlock()
+	if n := uploads.count("tracked"); n != 1 || idle {
+		t.Errorf("Expected idle upload to be forgotten, got %d uploads", n)
+	}
+
+	// uploads are tracked by the bucket of virtual-host style requests
+	serve("PUT", "http://hosted.s3.example.com/key?uploadId=g&partNumber=1")
+	if n := uploads.count("hosted"); n != 1 {
+		t.Errorf("Expected 1 upload to the virtual-host style bucket, got %d", n)
+	}
+}
@@ -48,8 +48,10 @@ func setupLimits(c *caddy.Controller) error {
 		return err
 	}
 
-	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		return Limit{Next: next, BodyLimits: bls}
+	config := httpserver.GetConfig(c)
+	config.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		// s3endpoint has been set up by the time the middleware is built
+		return Limit{Next: next, BodyLimits: bls, S3: config.Limits.S3, S3Endpoints: config.S3Endpoints}
 	})
 	return nil
 }
@@ -71,12 +73,47 @@ func parseLimits(c *caddy.Controller) ([]httpserver.PathLimit, error) {
 		//	header <limit>
 		//	body <path> <limit>
 		//	body <limit>
+		//	s3
+		//	s3_object_size <limit>
+		//	s3_part_size <limit>
+		//	s3_max_parts <number>
 		//	...
 		// }
 		for c.NextBlock() {
 			kind := c.Val()
 			pathOrLimit := c.RemainingArgs()
 			switch kind {
+			case "s3":
+				if len(pathOrLimit) != 0 {
+					return nil, c.ArgErr()
+				}
+				if config.Limits.S3 == nil {
+					config.Limits.S3 = defaultS3Limits()
+				}
+			case "s3_object_size", "s3_part_size", "s3_max_parts":
+				if len(pathOrLimit) != 1 {
+					return nil, c.ArgErr()
+				}
+				if config.Limits.S3 == nil {
+					config.Limits.S3 = defaultS3Limits()
+				}
+				if kind == "s3_max_parts" {
+					n, err := strconv.Atoi(pathOrLimit[0])
+					if err != nil || n < 1 {
+						return nil, c.Errf("s3_max_parts must be a positive number, got '%s'", pathOrLimit[0])
+					}
+					config.Limits.S3.MaxParts = n
+					break
+				}
+				size := parseSize(pathOrLimit[0])
+				if size < 1 {
+					return nil, c.ArgErr()
+				}
+				if kind == "s3_object_size" {
+					config.Limits.S3.MaxObjectSize = size
+				} else {
+					config.Limits.S3.MaxPartSize = size
+				}
 			case "header":
 				if len(pathOrLimit) != 1 {
 					return nil, c.ArgErr()
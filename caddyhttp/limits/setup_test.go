@@ -79,6 +79,50 @@ func TestParseLimits(t *testing.T) {
 				},
 			},
 		},
+		"s3Defaults": {
+			input: `limits {
+				s3
+			}`,
+			expect: httpserver.Limits{
+				S3: &httpserver.S3Limits{MaxObjectSize: 5 * GB, MaxPartSize: 5 * GB, MaxParts: 10000},
+			},
+		},
+		"s3": {
+			input: `limits {
+				body 1gb
+				s3_object_size 100mb
+				s3_part_size 64mb
+				s3_max_parts 1000
+			}`,
+			expect: httpserver.Limits{
+				MaxRequestBodySizes: []httpserver.PathLimit{{Path: "/", Limit: 1 * GB}},
+				S3:                  &httpserver.S3Limits{MaxObjectSize: 100 * MB, MaxPartSize: 64 * MB, MaxParts: 1000},
+			},
+		},
+		"invalidS3": {
+			input: `limits {
+				s3 on
+			}`,
+			shouldErr: true,
+		},
+		"invalidS3MaxParts": {
+			input: `limits {
+				s3_max_parts 0
+			}`,
+			shouldErr: true,
+			expect: httpserver.Limits{
+				S3: &httpserver.S3Limits{MaxObjectSize: 5 * GB, MaxPartSize: 5 * GB, MaxParts: 10000},
+			},
+		},
+		"invalidS3PartSize": {
+			input: `limits {
+				s3_part_size 5tb
+			}`,
+			shouldErr: true,
+			expect: httpserver.Limits{
+				S3: &httpserver.S3Limits{MaxObjectSize: 5 * GB, MaxPartSize: 5 * GB, MaxParts: 10000},
+			},
+		},
 		"invalidFormat": {
 			input:     `limits a b`,
 			shouldErr: true,
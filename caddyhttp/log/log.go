@@ -17,12 +17,14 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/journeymidnight/yig-front-caddy"
 	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
-	"strings"
 )
 
 func init() {
@@ -50,9 +52,22 @@ func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			rep := httpserver.NewReplacer(r, responseRecorder, CommonLogEmptyValue)
 			responseRecorder.Replacer = rep
 
+			// Count the bytes of the request body
+			var body *countingReader
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingReader{ReadCloser: r.Body}
+				r.Body = body
+			}
+
 			// Bon voyage, request!
 			status, err := l.Next.ServeHTTP(responseRecorder, r)
 
+			var bytesIn int64
+			if body != nil {
+				bytesIn = atomic.LoadInt64(&body.n)
+			}
+			rep.Set("bytes_in", strconv.FormatInt(bytesIn, 10))
+
 			if status >= 400 {
 				// There was an error up the chain, but no response has been written yet.
 				// The error must be handled here so the log entry will record the response size.
@@ -82,7 +97,11 @@ func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 						rep.Set("remote", maskedIP)
 					}
 				}
-				e.Log.Println(rep.Replace(e.Format))
+				if e.Encoding != "" {
+					e.Log.Println(encode(e.Encoding, e.Fields, rep))
+				} else {
+					e.Log.Println(rep.Replace(e.Format))
+				}
 
 			}
 
@@ -96,6 +115,22 @@ func (l Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 type Entry struct {
 	Format string
 	Log    *httpserver.Logger
+	// Encoding is "json" or "logfmt" for structured records
+	// of Fields, which are logged instead of Format.
+	Encoding string
+	Fields   []Field
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64 // accessed atomically
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
 }
 
 // Rule configures the logging middleware.
@@ -116,24 +151,3 @@ const (
 	// DefaultLogFormat is the default log format.
 	DefaultLogFormat = CommonLogFormat
 )
-
-func getBucketAndObjectInfoFromRequest(s3Endpoint string, r *http.Request) (bucketName string, objectName string) {
-	splits := strings.SplitN(r.URL.Path[1:], "/", 2)
-	v := strings.Split(r.Host, ":")
-	hostWithOutPort := v[0]
-	if strings.HasSuffix(hostWithOutPort, "."+s3Endpoint) {
-		bucketName = strings.TrimSuffix(hostWithOutPort, "."+s3Endpoint)
-		if len(splits) == 1 {
-			objectName = splits[0]
-		}
-	} else {
-		if len(splits) == 1 {
-			bucketName = splits[0]
-		}
-		if len(splits) == 2 {
-			bucketName = splits[0]
-			objectName = splits[1]
-		}
-	}
-	return
-}
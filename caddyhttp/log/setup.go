@@ -55,6 +55,9 @@ func logParse(c *caddy.Controller) ([]*Rule, error) {
 		var logRoller *httpserver.LogRoller
 		logRoller = httpserver.DefaultLogRoller()
 
+		var encoding string
+		var fields []Field
+
 		for c.NextBlock() {
 			what := c.Val()
 			where := c.RemainingArgs()
@@ -97,6 +100,39 @@ func logParse(c *caddy.Controller) ([]*Rule, error) {
 					logExceptions = append(logExceptions, where[i])
 				}
 
+			} else if what == "format" {
+
+				if len(where) != 1 {
+					return nil, c.ArgErr()
+				}
+				if where[0] != EncodingJSON && where[0] != EncodingLogfmt {
+					return nil, c.Errf("unknown log format '%s', must be json or logfmt", where[0])
+				}
+				encoding = where[0]
+
+			} else if what == "fields" {
+
+				if len(where) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, name := range where {
+					field, ok := KnownFields[name]
+					if !ok {
+						return nil, c.Errf("unknown log field '%s'", name)
+					}
+					fields = append(fields, field)
+				}
+
+			} else if what == "field" {
+
+				if len(where) != 2 {
+					return nil, c.ArgErr()
+				}
+				if !validFieldName(where[0]) {
+					return nil, c.Errf("invalid log field name '%s'", where[0])
+				}
+				fields = append(fields, Field{Name: where[0], Placeholder: where[1]})
+
 			} else if httpserver.IsLogRollerSubdirective(what) {
 
 				if err := httpserver.ParseRoller(logRoller, what, where...); err != nil {
@@ -132,6 +168,18 @@ func logParse(c *caddy.Controller) ([]*Rule, error) {
 			return nil, c.ArgErr()
 		}
 
+		if encoding == "" && fields != nil {
+			return nil, c.Err("log fields require format json or logfmt")
+		}
+		if encoding != "" {
+			if len(args) > 2 {
+				return nil, c.Err("log format given twice")
+			}
+			if fields == nil {
+				fields = defaultFields()
+			}
+		}
+
 		rules = appendEntry(rules, path, &Entry{
 			Log: &httpserver.Logger{
 				Output:       output,
@@ -141,7 +189,9 @@ func logParse(c *caddy.Controller) ([]*Rule, error) {
 				IPMaskExists: ipMaskExists,
 				Exceptions:   logExceptions,
 			},
-			Format: format,
+			Format:   format,
+			Encoding: encoding,
+			Fields:   fields,
 		})
 	}
 
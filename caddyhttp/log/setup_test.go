@@ -336,6 +336,13 @@ func TestLogParse(t *testing.T) {
 		{`log access.log { rotate_size }`, true, nil},
 		{`log access.log { ipmask }`, true, nil},
 		{`log access.log { invalid_option 1 }`, true, nil},
+		{`log access.log { format xml }`, true, nil},
+		{`log access.log { fields status }`, true, nil},
+		{`log / access.log {common} { format json }`, true, nil},
+		{`log access.log { format json
+			fields status unknown }`, true, nil},
+		{`log access.log { format json
+			field "bad name" {status} }`, true, nil},
 		{`log / acccess.log "{remote} - [{when}] "{method} {port}" {scheme} {mitm} "`, true, nil},
 	}
 	for i, test := range tests {
@@ -0,0 +1,152 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// Encodings of structured log records.
+const (
+	EncodingJSON   = "json"
+	EncodingLogfmt = "logfmt"
+)
+
+// Field is a field of structured log records.
+type Field struct {
+	Name        string
+	Placeholder string
+	// Numeric fields are logged as numbers in JSON.
+	Numeric bool
+}
+
+// KnownFields are the fields that can be chosen by name with
+// the fields subdirective.
+var KnownFields = map[string]Field{
+	"time":                {"time", "{when_iso}", false},
+	"request_id":          {"request_id", "{request_id}", false},
+	"remote":              {"remote", "{remote}", false},
+	"user":                {"user", "{user}", false},
+	"method":              {"method", "{method}", false},
+	"host":                {"host", "{host}", false},
+	"uri":                 {"uri", "{uri}", false},
+	"proto":               {"proto", "{proto}", false},
+	"status":              {"status", "{status}", true},
+	"bytes_in":            {"bytes_in", "{bytes_in}", true},
+	"bytes_out":           {"bytes_out", "{size}", true},
+	"latency_ms":          {"latency_ms", "{latency_ms}", true},
+	"s3_bucket":           {"s3_bucket", "{s3_bucket}", false},
+	"s3_key":              {"s3_key", "{s3_key}", false},
+	"s3_operation":        {"s3_operation", "{s3_operation}", false},
+	"s3_access_key":       {"s3_access_key", "{s3_access_key}", false},
+	"upstream":            {"upstream", "{upstream}", false},
+	"upstream_latency_ms": {"upstream_latency_ms", "{upstream_latency_ms}", true},
+	"upstream_addr":       {"upstream_addr", "{upstream_addr}", false},
+	"upstream_status":     {"upstream_status", "{upstream_status}", true},
+	"upstream_connect_ms": {"upstream_connect_ms", "{upstream_connect_ms}", true},
+	"upstream_ttfb_ms":    {"upstream_ttfb_ms", "{upstream_ttfb_ms}", true},
+	"upstream_retries":    {"upstream_retries", "{upstream_retries}", true},
+	"tls_protocol":        {"tls_protocol", "{tls_protocol}", false},
+	"tls_cipher":          {"tls_cipher", "{tls_cipher}", false},
+	"referer":             {"referer", "{>Referer}", false},
+	"user_agent":          {"user_agent", "{>User-Agent}", false},
+}
+
+// DefaultFields are the fields of structured log
+// records unless configured otherwise.
+var DefaultFields = []string{
+	"time", "request_id", "remote", "method", "host", "uri", "proto",
+	"status", "bytes_in", "bytes_out", "latency_ms",
+	"s3_bucket", "s3_key", "s3_operation",
+	"upstream", "upstream_status", "upstream_latency_ms",
+	"tls_protocol", "tls_cipher", "user_agent",
+}
+
+// defaultFields returns the fields named by DefaultFields.
+func defaultFields() []Field {
+	fields := make([]Field, 0, len(DefaultFields))
+	for _, name := range DefaultFields {
+		fields = append(fields, KnownFields[name])
+	}
+	return fields
+}
+
+// encode returns the structured record of the fields, with
+// the values replaced by rep. Empty values are null in JSON
+// and left out in logfmt.
+func encode(encoding string, fields []Field, rep httpserver.Replacer) string {
+	var buf bytes.Buffer
+	if encoding == EncodingJSON {
+		buf.WriteByte('{')
+	}
+	for _, field := range fields {
+		value := rep.Replace(field.Placeholder)
+		if value == CommonLogEmptyValue {
+			value = ""
+		}
+		switch encoding {
+		case EncodingJSON:
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(&buf, field.Name)
+			buf.WriteByte(':')
+			switch {
+			case value == "":
+				buf.WriteString("null")
+			case field.Numeric && isNumber(value):
+				buf.WriteString(value)
+			default:
+				writeJSONString(&buf, value)
+			}
+		case EncodingLogfmt:
+			if value == "" {
+				continue
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(field.Name)
+			buf.WriteByte('=')
+			if needsQuotes(value) {
+				buf.WriteString(strconv.Quote(value))
+			} else {
+				buf.WriteString(value)
+			}
+		}
+	}
+	if encoding == EncodingJSON {
+		buf.WriteByte('}')
+	}
+	return buf.String()
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode terminates the value with a newline
+	buf.Truncate(buf.Len() - 1)
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil && strings.Trim(s, "-.0123456789") == ""
+}
+
+// needsQuotes reports whether a logfmt value must be quoted.
+func needsQuotes(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	}) >= 0
+}
+
+// validFieldName reports whether name can be used as a field
+// name in both encodings.
+func validFieldName(name string) bool {
+	return name != "" && !needsQuotes(name)
+}
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+type bodyReadingMiddleware struct{}
+
+func (bodyReadingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	var buf bytes.Buffer
+	buf.ReadFrom(r.Body)
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok {
+		rr.Replacer.Set("upstream", "10.0.0.1:8080")
+	}
+	w.Write([]byte("stored"))
+	return 0, nil
+}
+
+func TestStructuredLog(t *testing.T) {
+	fields := []Field{
+		KnownFields["method"],
+		KnownFields["status"],
+		KnownFields["bytes_in"],
+		KnownFields["bytes_out"],
+		KnownFields["s3_bucket"],
+		KnownFields["s3_key"],
+		KnownFields["upstream"],
+		KnownFields["tls_protocol"],
+		{Name: "agent", Placeholder: "{>User-Agent}"},
+	}
+	for _, test := range []struct {
+		encoding, expected string
+	}{
+		{EncodingJSON, `{"method":"PUT","status":200,"bytes_in":6,"bytes_out":6,"s3_bucket":"bucket","s3_key":"a key","upstream":"10.0.0.1:8080","tls_protocol":null,"agent":"say \"hi\" <3"}` + "\n"},
+		{EncodingLogfmt, `method=PUT status=200 bytes_in=6 bytes_out=6 s3_bucket=bucket s3_key="a key" upstream=10.0.0.1:8080 agent="say \"hi\" <3"` + "\n"},
+	} {
+		var f bytes.Buffer
+		logger := Logger{
+			Rules: []*Rule{{
+				PathScope: "/",
+				Entries: []*Entry{{
+					Log:      httpserver.NewTestLogger(&f),
+					Encoding: test.encoding,
+					Fields:   fields,
+				}},
+			}},
+			Next: bodyReadingMiddleware{},
+		}
+		r := httptest.NewRequest("PUT", "/bucket/a%20key", strings.NewReader("object"))
+		r.Header.Set("User-Agent", `say "hi" <3`)
+		if _, err := logger.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Fatal(err)
+		}
+		if f.String() != test.expected {
+			t.Errorf("Expected %s record\n%s\ngot\n%s", test.encoding, test.expected, f.String())
+		}
+		if test.encoding == EncodingJSON && !json.Valid(f.Bytes()) {
+			t.Errorf("Expected valid JSON, got %s", f.String())
+		}
+	}
+}
+
+func TestLogParseStructured(t *testing.T) {
+	c := caddy.NewTestController("http", `log / access.log {
+		format json
+	}
+	log /logs logs.log {
+		format logfmt
+		fields time status
+		field tenant {>X-Tenant}
+	}`)
+	rules, err := logParse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(rules))
+	}
+	entry := rules[0].Entries[0]
+	if entry.Encoding != EncodingJSON || len(entry.Fields) != len(DefaultFields) {
+		t.Errorf("Expected JSON with the default fields, got %s with %d fields", entry.Encoding, len(entry.Fields))
+	}
+	entry = rules[1].Entries[0]
+	expected := []Field{KnownFields["time"], KnownFields["status"], {Name: "tenant", Placeholder: "{>X-Tenant}"}}
+	if entry.Encoding != EncodingLogfmt || len(entry.Fields) != len(expected) {
+		t.Fatalf("Expected logfmt with 3 fields, got %s with %v", entry.Encoding, entry.Fields)
+	}
+	for i, field := range expected {
+		if entry.Fields[i] != field {
+			t.Errorf("Expected field %d to be %v, got %v", i, field, entry.Fields[i])
+		}
+	}
+}
@@ -68,7 +68,12 @@ func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 	// current is bucket_name, method, status
 	var labelValues []string
 	var isInternal = "n"
-	bucketName, _ := getBucketAndObjectInfoFromRequest(m.s3Endpoint, r)
+	s3req := httpserver.GetS3Request(r)
+	if s3req == nil {
+		// s3endpoint is not in use, fall back to our own s3_endpoint
+		s3req = httpserver.ParseS3Request(r, []string{m.s3Endpoint})
+	}
+	bucketName := s3req.Bucket
 
 	if strings.TrimSpace(bucketName) == "" {
 		bucketName = "-"
@@ -113,27 +118,6 @@ func isIPv6(addr string) bool {
 	return ip != nil && ip.To4() == nil
 }
 
-func getBucketAndObjectInfoFromRequest(s3Endpoint string, r *http.Request) (bucketName string, objectName string) {
-	splits := strings.SplitN(r.URL.Path[1:], "/", 2)
-	v := strings.Split(r.Host, ":")
-	hostWithOutPort := v[0]
-	if strings.HasSuffix(hostWithOutPort, "."+s3Endpoint) {
-		bucketName = strings.TrimSuffix(hostWithOutPort, "."+s3Endpoint)
-		if len(splits) == 1 {
-			objectName = splits[0]
-		}
-	} else {
-		if len(splits) == 1 {
-			bucketName = splits[0]
-		}
-		if len(splits) == 2 {
-			bucketName = splits[0]
-			objectName = splits[1]
-		}
-	}
-	return
-}
-
 // A timedResponseWriter tracks the time when the first response write
 // happened.
 type timedResponseWriter struct {
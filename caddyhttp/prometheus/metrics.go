@@ -1,6 +1,8 @@
 package prometheus
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -21,6 +23,130 @@ var (
 	responseSecondsHist *prometheus.HistogramVec
 )
 
+// Metrics reported by other directives. Unlike the ones above they
+// are created up front, so that they can be updated before (or
+// without) the prometheus directive starting up.
+var (
+	rateLimitRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "ratelimit_rejected_count_total",
+		Help:      "Counter of requests rejected by ratelimit.",
+	}, []string{"key", "class"})
+
+	upstreamHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_healthy",
+		Help:      "Whether the upstream host passes its health checks (1) or not (0).",
+	}, []string{"upstream"})
+
+	upstreamHealthCheckLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_health_check_latency_seconds",
+		Help:      "Latency of the last health check of the upstream host.",
+	}, []string{"upstream"})
+
+	upstreamEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_ejected",
+		Help:      "Whether outlier detection ejected the upstream host (1) or not (0).",
+	}, []string{"upstream"})
+
+	upstreamEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_ejections_total",
+		Help:      "Counter of ejections of the upstream host by outlier detection.",
+	}, []string{"upstream"})
+
+	upstreamBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_breaker_state",
+		Help:      "State of the circuit breaker of the upstream host: closed (0), half-open (1) or open (2).",
+	}, []string{"upstream"})
+
+	upstreamBreakerTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "upstream_breaker_trips_total",
+		Help:      "Counter of trips of the circuit breaker of the upstream host, by reason.",
+	}, []string{"upstream", "reason"})
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "retries_total",
+		Help:      "Counter of retried requests to the upstream of a proxy path, by status or error class.",
+	}, []string{"upstream", "reason"})
+
+	retryBudgetExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "retry_budget_exhausted_total",
+		Help:      "Counter of retries not made because the retry budget of the upstream was used up.",
+	}, []string{"upstream"})
+
+	upstreamHedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "hedges_total",
+		Help:      "Counter of requests to the upstream of a proxy path that were hedged with a second request.",
+	}, []string{"upstream"})
+
+	upstreamHedgeWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "hedge_wins_total",
+		Help:      "Counter of hedged requests that were answered first.",
+	}, []string{"upstream"})
+
+	mirrorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "mirror_requests_total",
+		Help:      "Counter of requests mirrored to the shadow host of a proxy path, by result.",
+	}, []string{"upstream", "result"})
+
+	mirrorLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "mirror_latency_seconds",
+		Help:      "Histogram of the time (in seconds) until the response to mirrored requests, by the upstream or shadow host answering.",
+	}, []string{"upstream", "role"})
+
+	coalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "coalesced_requests_total",
+		Help:      "Counter of coalescable requests to the upstream of a proxy path, by whether they led or joined the shared request, or fell behind it.",
+	}, []string{"upstream", "result"})
+
+	multipartUploads = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "limits",
+		Name:      "multipart_uploads",
+		Help:      "Number of multipart uploads in progress, by bucket.",
+	}, []string{"bucket"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Counter of requests handled by the cache, by result.",
+	}, []string{"result"})
+
+	cacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "size_bytes",
+		Help:      "Size of the cached responses, by tier.",
+	}, []string{"tier"})
+)
+
 func define(subsystem string) {
 	if subsystem == "" {
 		subsystem = "http"
@@ -103,3 +229,105 @@ func define(subsystem string) {
 		Help:      "Time needed by NGINX to handle requests",
 	}, labels)
 }
+
+// CountRateLimited counts a request rejected by the ratelimit rule
+// keyed by key for exceeding the limit of class.
+func CountRateLimited(key, class string) {
+	rateLimitRejected.WithLabelValues(key, class).Inc()
+}
+
+// SetUpstreamHealth records the outcome of the health checks of
+// the proxy upstream host upstream.
+func SetUpstreamHealth(upstream string, healthy bool, latency time.Duration) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	upstreamHealthy.WithLabelValues(upstream).Set(value)
+	upstreamHealthCheckLatency.WithLabelValues(upstream).Set(latency.Seconds())
+}
+
+// SetUpstreamEjected records that outlier detection ejected the
+// proxy upstream host upstream, or that its ejection ended.
+func SetUpstreamEjected(upstream string, ejected bool) {
+	if ejected {
+		upstreamEjected.WithLabelValues(upstream).Set(1)
+		upstreamEjections.WithLabelValues(upstream).Inc()
+	} else {
+		upstreamEjected.WithLabelValues(upstream).Set(0)
+	}
+}
+
+// SetUpstreamBreakerState records the state of the circuit breaker
+// of the proxy upstream host upstream: 0 closed, 1 half-open, 2 open.
+func SetUpstreamBreakerState(upstream string, state int) {
+	upstreamBreakerState.WithLabelValues(upstream).Set(float64(state))
+}
+
+// CountUpstreamBreakerTrip counts a trip of the circuit breaker
+// of the proxy upstream host upstream.
+func CountUpstreamBreakerTrip(upstream, reason string) {
+	upstreamBreakerTrips.WithLabelValues(upstream, reason).Inc()
+}
+
+// CountUpstreamRetry counts a retry of a request to the upstream
+// of the proxy path upstream.
+func CountUpstreamRetry(upstream, reason string) {
+	upstreamRetries.WithLabelValues(upstream, reason).Inc()
+}
+
+// CountRetryBudgetExhausted counts a retry to the upstream of the
+// proxy path upstream that was not made for lack of retry budget.
+func CountRetryBudgetExhausted(upstream string) {
+	retryBudgetExhausted.WithLabelValues(upstream).Inc()
+}
+
+// CountHedge counts a hedged request to the upstream
+// of the proxy path upstream.
+func CountHedge(upstream string) {
+	upstreamHedges.WithLabelValues(upstream).Inc()
+}
+
+// CountHedgeWin counts a hedged request to the upstream of the
+// proxy path upstream that was answered before the original one.
+func CountHedgeWin(upstream string) {
+	upstreamHedgeWins.WithLabelValues(upstream).Inc()
+}
+
+// CountMirror counts a request to the upstream of the proxy path
+// upstream that was mirrored to its shadow host, or dropped.
+func CountMirror(upstream, result string) {
+	mirrorRequests.WithLabelValues(upstream, result).Inc()
+}
+
+// ObserveMirrorLatency records the latencies of the upstream of
+// the proxy path upstream and its shadow host for a mirrored request.
+func ObserveMirrorLatency(upstream string, primary, shadow time.Duration) {
+	mirrorLatency.WithLabelValues(upstream, "primary").Observe(primary.Seconds())
+	mirrorLatency.WithLabelValues(upstream, "shadow").Observe(shadow.Seconds())
+}
+
+// CountCoalesced counts a request to the upstream of the proxy
+// path upstream that was coalesced with identical ones, with
+// result leader, follower or stalled.
+func CountCoalesced(upstream, result string) {
+	coalescedRequests.WithLabelValues(upstream, result).Inc()
+}
+
+// SetMultipartUploads reports the number of multipart
+// uploads in progress to bucket.
+func SetMultipartUploads(bucket string, uploads int) {
+	multipartUploads.WithLabelValues(bucket).Set(float64(uploads))
+}
+
+// CountCacheRequest counts a request handled by the cache with
+// result hit, miss, revalidated, collapsed or bypass.
+func CountCacheRequest(result string) {
+	cacheRequests.WithLabelValues(result).Inc()
+}
+
+// SetCacheSize reports the size of the responses in
+// tier, memory or disk, of the cache.
+func SetCacheSize(tier string, size int64) {
+	cacheSize.WithLabelValues(tier).Set(float64(size))
+}
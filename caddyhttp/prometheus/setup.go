@@ -58,6 +58,23 @@ func (m *Metrics) start() error {
 		prometheus.MustRegister(responseLatency)
 		prometheus.MustRegister(responseSize)
 		prometheus.MustRegister(responseStatus)
+		prometheus.MustRegister(rateLimitRejected)
+		prometheus.MustRegister(upstreamHealthy)
+		prometheus.MustRegister(upstreamHealthCheckLatency)
+		prometheus.MustRegister(upstreamEjected)
+		prometheus.MustRegister(upstreamEjections)
+		prometheus.MustRegister(upstreamBreakerState)
+		prometheus.MustRegister(upstreamBreakerTrips)
+		prometheus.MustRegister(upstreamRetries)
+		prometheus.MustRegister(retryBudgetExhausted)
+		prometheus.MustRegister(upstreamHedges)
+		prometheus.MustRegister(upstreamHedgeWins)
+		prometheus.MustRegister(mirrorRequests)
+		prometheus.MustRegister(mirrorLatency)
+		prometheus.MustRegister(coalescedRequests)
+		prometheus.MustRegister(multipartUploads)
+		prometheus.MustRegister(cacheRequests)
+		prometheus.MustRegister(cacheSize)
 
 		prometheus.MustRegister(countTotal)
 		prometheus.MustRegister(bytesTotal)
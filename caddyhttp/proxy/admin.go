@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy"
+)
+
+// Admin states of upstream hosts.
+const (
+	hostActive   int32 = iota
+	hostDraining       // no new requests
+	hostDisabled       // no new requests nor health checks
+)
+
+var hostStates = []string{"active", "draining", "disabled"}
+
+// healthCheckTimeout bounds how long an admin request
+// waits for the health checks it triggered.
+const healthCheckTimeout = time.Minute
+
+// registry holds the upstreams of all running
+// proxies, which the admin API works on.
+var registry = struct {
+	sync.Mutex
+	list []Upstream
+}{}
+
+// registerUpstreams adds list to the registry.
+func registerUpstreams(list []Upstream) {
+	registry.Lock()
+	registry.list = append(registry.list, list...)
+	registry.Unlock()
+}
+
+// unregisterUpstreams removes list from the registry.
+func unregisterUpstreams(list []Upstream) {
+	registry.Lock()
+	defer registry.Unlock()
+	remaining := registry.list[:0]
+	for _, u := range registry.list {
+		removed := false
+		for _, r := range list {
+			if u == r {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			remaining = append(remaining, u)
+		}
+	}
+	registry.list = remaining
+}
+
+// restoreUpstreams sets the registry back to list, the
+// upstreams that were registered before a failed restart.
+func restoreUpstreams(list []Upstream) {
+	registry.Lock()
+	registry.list = append([]Upstream(nil), list...)
+	registry.Unlock()
+}
+
+// registeredUpstreams returns the registered upstreams.
+func registeredUpstreams() []Upstream {
+	registry.Lock()
+	defer registry.Unlock()
+	return append([]Upstream(nil), registry.list...)
+}
+
+// poolOf returns the hosts of u, if it exposes them.
+func poolOf(u Upstream) HostPool {
+	if p, ok := u.(interface{ pool() HostPool }); ok {
+		return p.pool()
+	}
+	return nil
+}
+
+// checkHealthNow runs the health checks of u right away and reports
+// whether they ran; they do not if health checks are disabled.
+func (u *staticUpstream) checkHealthNow(timeout time.Duration) bool {
+	if u.checkNow == nil {
+		return false
+	}
+	done := make(chan struct{})
+	select {
+	case u.checkNow <- done:
+	case <-u.stop:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// adminHandler serves the admin API, which lists the hosts of
+// the upstreams and lets operators take hosts out, limit their
+// connections and run health checks.
+type adminHandler struct {
+	token atomic.Value // string
+}
+
+type adminUpstream struct {
+	From  string      `json:"from"`
+	Hosts []adminHost `json:"hosts"`
+}
+
+type adminHost struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Available   bool   `json:"available"`
+	Healthy     bool   `json:"healthy"`
+	HealthCheck string `json:"health_check,omitempty"`
+	Conns       int64  `json:"conns"`
+	MaxConns    int64  `json:"max_conns"`
+	Fails       int32  `json:"fails"`
+	Weight      int32  `json:"weight"`
+}
+
+func newAdminUpstream(u Upstream) adminUpstream {
+	au := adminUpstream{From: u.From(), Hosts: []adminHost{}}
+	for _, host := range poolOf(u) {
+		au.Hosts = append(au.Hosts, newAdminHost(host))
+	}
+	return au
+}
+
+func newAdminHost(host *UpstreamHost) adminHost {
+	result, _ := host.HealthCheckResult.Load().(string)
+	return adminHost{
+		Name:        host.Name,
+		State:       hostStates[atomic.LoadInt32(&host.adminState)],
+		Available:   host.Available(),
+		Healthy:     atomic.LoadInt32(&host.Unhealthy) == 0,
+		HealthCheck: result,
+		Conns:       atomic.LoadInt64(&host.Conns),
+		MaxConns:    atomic.LoadInt64(&host.MaxConns),
+		Fails:       atomic.LoadInt32(&host.Fails),
+		Weight:      atomic.LoadInt32(&host.Weight),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+//
+//   GET  /upstreams                          lists the upstreams
+//   POST /hosts?host=...&state=...&max_conns=... changes a host
+//        [&timeout=...]                      cuts off a draining host after timeout
+//   POST /health_check[?from=...]             runs health checks now
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _ := h.token.Load().(string)
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/upstreams" && r.Method == http.MethodGet:
+		h.serveUpstreams(w, r)
+	case r.URL.Path == "/hosts" && r.Method == http.MethodPost:
+		h.serveHosts(w, r)
+	case r.URL.Path == "/health_check" && r.Method == http.MethodPost:
+		h.serveHealthCheck(w, r)
+	case r.URL.Path == "/upstreams" || r.URL.Path == "/hosts" || r.URL.Path == "/health_check":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *adminHandler) serveUpstreams(w http.ResponseWriter, r *http.Request) {
+	list := []adminUpstream{}
+	from := r.FormValue("from")
+	for _, u := range registeredUpstreams() {
+		if from != "" && u.From() != from {
+			continue
+		}
+		list = append(list, newAdminUpstream(u))
+	}
+	writeJSON(w, list)
+}
+
+func (h *adminHandler) serveHosts(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("host")
+	if name == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+	name = hostName(name)
+
+	state := int32(-1)
+	if s := r.FormValue("state"); s != "" {
+		for i, hostState := range hostStates {
+			if s == hostState {
+				state = int32(i)
+			}
+		}
+		if state < 0 {
+			http.Error(w, "unknown state "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	maxConns := int64(-1)
+	if s := r.FormValue("max_conns"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "max_conns must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		maxConns = n
+	}
+	var timeout time.Duration
+	if s := r.FormValue("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || state != hostDraining {
+			http.Error(w, "timeout must be a positive duration for draining hosts", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	changed := []adminHost{}
+	for _, u := range registeredUpstreams() {
+		for _, host := range poolOf(u) {
+			if host.Name != name {
+				continue
+			}
+			if state >= 0 {
+				if old := host.setState(state); old != state {
+					log.Printf("[INFO] proxy: host %s of upstream %s is now %s (was %s)",
+						host.Name, u.From(), hostStates[state], hostStates[old])
+				}
+				if timeout > 0 {
+					host.drain(timeout)
+				}
+			}
+			if maxConns >= 0 {
+				atomic.StoreInt64(&host.MaxConns, maxConns)
+			}
+			changed = append(changed, newAdminHost(host))
+		}
+	}
+	if len(changed) == 0 {
+		http.Error(w, "unknown host "+name, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, changed)
+}
+
+func (h *adminHandler) serveHealthCheck(w http.ResponseWriter, r *http.Request) {
+	from := r.FormValue("from")
+	checked := []adminUpstream{}
+	for _, u := range registeredUpstreams() {
+		if from != "" && u.From() != from {
+			continue
+		}
+		checker, ok := u.(interface{ checkHealthNow(time.Duration) bool })
+		if !ok || !checker.checkHealthNow(healthCheckTimeout) {
+			continue
+		}
+		checked = append(checked, newAdminUpstream(u))
+	}
+	if len(checked) == 0 {
+		http.Error(w, "no upstreams with health checks", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, checked)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// admin is the admin API of the process, which
+// keeps running across restarts.
+var admin = struct {
+	once    sync.Once
+	addr    string
+	handler adminHandler
+}{}
+
+// setupAdmin configures the admin API:
+//
+//   proxy_admin <address> {
+//       token <token>
+//   }
+//
+// The address is a loopback address or unix:<path>.
+func setupAdmin(c *caddy.Controller) error {
+	addr, token, err := parseAdmin(c)
+	if err != nil {
+		return err
+	}
+	admin.handler.token.Store(token)
+
+	started := false
+	admin.once.Do(func() {
+		started = true
+		admin.addr = addr
+		c.OnStartup(func() error {
+			return startAdmin(addr)
+		})
+	})
+	if !started && addr != admin.addr {
+		log.Printf("[WARNING] proxy_admin: keeps listening on %s until the process is restarted", admin.addr)
+	}
+	return nil
+}
+
+func parseAdmin(c *caddy.Controller) (addr, token string, err error) {
+	for c.Next() {
+		if addr != "" {
+			return "", "", c.Err("proxy_admin: can only be configured once")
+		}
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return "", "", c.ArgErr()
+		}
+		addr = args[0]
+		for c.NextBlock() {
+			switch c.Val() {
+			case "token":
+				if !c.NextArg() {
+					return "", "", c.ArgErr()
+				}
+				token = c.Val()
+			default:
+				return "", "", c.Errf("proxy_admin: unknown property '%s'", c.Val())
+			}
+		}
+	}
+	if err := checkAdminAddress(addr); err != nil {
+		return "", "", c.Err(err.Error())
+	}
+	if token == "" {
+		return "", "", c.Err("proxy_admin: a token is required")
+	}
+	return addr, token, nil
+}
+
+// checkAdminAddress makes sure addr is a unix socket or a
+// loopback address, so that the admin API is local only.
+func checkAdminAddress(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("proxy_admin: address must be a loopback address or unix socket")
+	}
+	return nil
+}
+
+// startAdmin starts serving the admin API on addr.
+func startAdmin(addr string) error {
+	var ln net.Listener
+	var err error
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// remove the socket of an earlier process
+		os.Remove(path)
+		if ln, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+		if err = os.Chmod(path, 0600); err != nil {
+			ln.Close()
+			return err
+		}
+	} else if ln, err = net.Listen("tcp", addr); err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(ln, &admin.handler); err != nil {
+			log.Printf("[ERROR] proxy_admin: %v", err)
+		}
+	}()
+	return nil
+}
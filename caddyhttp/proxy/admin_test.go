@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func adminRequest(h *adminHandler, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// isolateRegistry empties the registry, which may hold the upstreams
+// of other tests, until the returned func is called.
+func isolateRegistry() func() {
+	registry.Lock()
+	saved := registry.list
+	registry.list = nil
+	registry.Unlock()
+	return func() {
+		registry.Lock()
+		registry.list = saved
+		registry.Unlock()
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	defer isolateRegistry()()
+
+	var checks int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+	}))
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + " localhost:8081 {\n health_check /health\n health_check_interval 1h\n}\nproxy /other localhost:8082"
+	list, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerUpstreams(list)
+	defer func() {
+		unregisterUpstreams(list)
+		for _, u := range list {
+			u.Stop()
+		}
+	}()
+	h := &adminHandler{}
+	h.token.Store("secret")
+
+	r := httptest.NewRequest("GET", "/upstreams", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for wrong token, got %d", w.Code)
+	}
+
+	w = adminRequest(h, "GET", "/upstreams")
+	var upstreams []adminUpstream
+	if err := json.Unmarshal(w.Body.Bytes(), &upstreams); err != nil {
+		t.Fatalf("Expected JSON list of upstreams, got %v: %s", err, w.Body.String())
+	}
+	if len(upstreams) != 2 || upstreams[0].From != "/" || len(upstreams[0].Hosts) != 2 || upstreams[1].From != "/other" {
+		t.Fatalf("Unexpected upstreams %+v", upstreams)
+	}
+	if host := upstreams[0].Hosts[0]; host.Name != backend.URL || host.State != "active" || !host.Available {
+		t.Errorf("Unexpected host %+v", host)
+	}
+
+	w = adminRequest(h, "POST", "/hosts?host=localhost:8081&state=draining&max_conns=10")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected host to be changed, got %d: %s", w.Code, w.Body.String())
+	}
+	host := list[0].(*staticUpstream).Hosts[1]
+	if !host.Down() || atomic.LoadInt64(&host.MaxConns) != 10 {
+		t.Error("Expected host to be draining with 10 connections at most")
+	}
+	adminRequest(h, "POST", "/hosts?host=localhost:8081&state=draining&timeout=1h")
+	if host.drainTimer == nil {
+		t.Error("Expected host to be cut off after the timeout")
+	}
+	adminRequest(h, "POST", "/hosts?host=localhost:8081&state=active")
+	if host.Down() || host.drainTimer != nil {
+		t.Error("Expected host to be active again")
+	}
+
+	for target, status := range map[string]int{
+		"/hosts?host=localhost:9999&state=draining": http.StatusNotFound,
+		"/hosts?host=localhost:8081&state=gone":     http.StatusBadRequest,
+		"/hosts?host=localhost:8081&max_conns=-1":   http.StatusBadRequest,
+		"/hosts?state=draining":                     http.StatusBadRequest,
+		"/hosts?host=localhost:8081&timeout=1m":     http.StatusBadRequest,
+		"/health_check?from=/other":                 http.StatusNotFound,
+	} {
+		if w := adminRequest(h, "POST", target); w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", target, status, w.Code)
+		}
+	}
+	if w := adminRequest(h, "DELETE", "/upstreams"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+
+	before := atomic.LoadInt32(&checks)
+	if w := adminRequest(h, "POST", "/health_check"); w.Code != http.StatusOK {
+		t.Fatalf("Expected health checks to run, got %d: %s", w.Code, w.Body.String())
+	}
+	if atomic.LoadInt32(&checks) == before {
+		t.Error("Expected the backend to be checked")
+	}
+
+	// disabled hosts are not health checked
+	adminRequest(h, "POST", "/hosts?host="+backend.URL+"&state=disabled")
+	before = atomic.LoadInt32(&checks)
+	adminRequest(h, "POST", "/health_check")
+	if atomic.LoadInt32(&checks) != before {
+		t.Error("Expected disabled host not to be checked")
+	}
+}
+
+func TestRegistryRestart(t *testing.T) {
+	defer isolateRegistry()()
+
+	if err := setup(caddy.NewTestController("http", "proxy / localhost:8080")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(registeredUpstreams()); n != 0 {
+		t.Errorf("Expected upstreams not to be registered before startup, got %d", n)
+	}
+
+	parse := func(config string) []Upstream {
+		list, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	running := parse("proxy / localhost:8081")
+	registerUpstreams(running)
+	before := registeredUpstreams()
+	registerUpstreams(parse("proxy / localhost:8082"))
+	restoreUpstreams(before)
+	if list := registeredUpstreams(); len(list) != 1 || list[0] != running[0] {
+		t.Errorf("Expected only the running upstream after a failed restart, got %v", list)
+	}
+}
+
+func TestSetupAdmin(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"proxy_admin localhost:2019 {\n token secret\n}", false},
+		{"proxy_admin 127.0.0.1:2019 {\n token secret\n}", false},
+		{"proxy_admin [::1]:2019 {\n token secret\n}", false},
+		{"proxy_admin unix:/run/caddy/admin.sock {\n token secret\n}", false},
+		{"proxy_admin localhost:2019", true},
+		{"proxy_admin 0.0.0.0:2019 {\n token secret\n}", true},
+		{"proxy_admin example.com:2019 {\n token secret\n}", true},
+		{"proxy_admin localhost {\n token secret\n}", true},
+		{"proxy_admin {\n token secret\n}", true},
+		{"proxy_admin localhost:2019 {\n password secret\n}", true},
+	} {
+		_, _, err := parseAdmin(caddy.NewTestController("http", test.input))
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.shouldErr, err)
+		}
+	}
+}
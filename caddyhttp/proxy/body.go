@@ -16,8 +16,19 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	stdhash "hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
 )
 
 type bufferedBody struct {
@@ -52,3 +63,102 @@ func newBufferedBody(src io.ReadCloser) (*bufferedBody, error) {
 		Reader: bytes.NewReader(b),
 	}, nil
 }
+
+var (
+	errBadDigest = httpserver.S3Error{
+		Code:       "BadDigest",
+		Message:    "The Content-MD5 or checksum you specified did not match what we received.",
+		HTTPStatus: http.StatusBadRequest,
+	}
+	errInvalidDigest = httpserver.S3Error{
+		Code:       "InvalidDigest",
+		Message:    "The Content-MD5 or checksum you specified is not valid.",
+		HTTPStatus: http.StatusBadRequest,
+	}
+)
+
+// checksumHeaders are the request headers with a base64
+// encoded digest of the body, and their hash functions.
+var checksumHeaders = []struct {
+	header string
+	hash   func() stdhash.Hash
+}{
+	{"Content-MD5", md5.New},
+	{"X-Amz-Checksum-Crc32", func() stdhash.Hash { return crc32.NewIEEE() }},
+	{"X-Amz-Checksum-Crc32c", func() stdhash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{"X-Amz-Checksum-Sha1", sha1.New},
+	{"X-Amz-Checksum-Sha256", sha256.New},
+}
+
+// checksumBody verifies the body of an upload against the digests
+// the client sent in the request headers while it is read. If one
+// does not match, the last read fails with errBadDigest instead of
+// returning the end of the body, so that the upstream request is
+// aborted before the backend has received all of it.
+type checksumBody struct {
+	io.ReadCloser
+	length   int64 // -1 if unknown
+	read     int64
+	checks   []checksum
+	verified bool
+	err      error
+}
+
+type checksum struct {
+	hash stdhash.Hash
+	want []byte
+}
+
+// newChecksumBody returns a *checksumBody to use in place of body,
+// the body of a request with header, or nil if header has no digests
+// to verify. It returns errInvalidDigest for malformed digests.
+func newChecksumBody(body io.ReadCloser, header http.Header, length int64) (*checksumBody, error) {
+	if body == nil || strings.HasPrefix(header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(header.Get("Content-Encoding"), "aws-chunked") {
+		// the digests are of the decoded body
+		return nil, nil
+	}
+
+	var checks []checksum
+	for _, c := range checksumHeaders {
+		value := header.Get(c.header)
+		if value == "" {
+			continue
+		}
+		h := c.hash()
+		want, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(want) != h.Size() {
+			return nil, errInvalidDigest
+		}
+		checks = append(checks, checksum{hash: h, want: want})
+	}
+	// also UNSIGNED-PAYLOAD, which is not verified
+	if want, err := hex.DecodeString(header.Get("X-Amz-Content-Sha256")); err == nil && len(want) == sha256.Size {
+		checks = append(checks, checksum{hash: sha256.New(), want: want})
+	}
+	if len(checks) == 0 {
+		return nil, nil
+	}
+	return &checksumBody{ReadCloser: body, length: length, checks: checks}, nil
+}
+
+func (b *checksumBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	for _, c := range b.checks {
+		c.hash.Write(p[:n])
+	}
+	b.read += int64(n)
+	if !b.verified && (err == io.EOF || (b.length >= 0 && b.read >= b.length)) {
+		b.verified = true
+		for _, c := range b.checks {
+			if !bytes.Equal(c.hash.Sum(nil), c.want) {
+				b.err = errBadDigest
+				return 0, b.err
+			}
+		}
+	}
+	return n, err
+}
@@ -16,11 +16,21 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
 )
 
 func TestBodyRetry(t *testing.T) {
@@ -81,3 +91,118 @@ func TestBodyRetry(t *testing.T) {
 		t.Fatalf("result = %s, want %s", result, testcase)
 	}
 }
+
+func TestChecksumBody(t *testing.T) {
+	object := "The quick brown fox jumps over the lazy dog"
+	md5sum := md5.Sum([]byte(object))
+	sha256sum := sha256.Sum256([]byte(object))
+	crc := make([]byte, 4)
+	sum := crc32.Checksum([]byte(object), crc32.MakeTable(crc32.Castagnoli))
+	crc[0], crc[1], crc[2], crc[3] = byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum)
+	b64 := base64.StdEncoding.EncodeToString
+
+	for i, test := range []struct {
+		header http.Header
+		err    error // of newChecksumBody
+		read   error // at the end of the body
+	}{
+		{header: http.Header{}},
+		{header: http.Header{"X-Amz-Content-Sha256": {"UNSIGNED-PAYLOAD"}}},
+		{header: http.Header{"Content-Md5": {b64(md5sum[:])}}},
+		{header: http.Header{"Content-Md5": {b64(sha256sum[:16])}}, read: errBadDigest},
+		{header: http.Header{"Content-Md5": {"not base64"}}, err: errInvalidDigest},
+		{header: http.Header{"Content-Md5": {b64(sha256sum[:])}}, err: errInvalidDigest},
+		{header: http.Header{"X-Amz-Content-Sha256": {hex.EncodeToString(sha256sum[:])}}},
+		{header: http.Header{"X-Amz-Content-Sha256": {hex.EncodeToString(make([]byte, 32))}}, read: errBadDigest},
+		{header: http.Header{"X-Amz-Checksum-Sha256": {b64(sha256sum[:])}}},
+		{header: http.Header{"X-Amz-Checksum-Crc32c": {b64(crc)}}},
+		{header: http.Header{"X-Amz-Checksum-Crc32": {b64(crc)}}, read: errBadDigest},
+		{header: http.Header{"X-Amz-Checksum-Sha1": {b64(crc)}}, err: errInvalidDigest},
+		{header: http.Header{"Content-Md5": {b64(md5sum[:])}, "X-Amz-Checksum-Sha256": {b64(md5sum[:])}}, err: errInvalidDigest},
+		// the digests of aws-chunked bodies are of the decoded body
+		{header: http.Header{"Content-Md5": {b64(sha256sum[:16])}, "X-Amz-Content-Sha256": {"STREAMING-AWS4-HMAC-SHA256-PAYLOAD"}}},
+	} {
+		for _, length := range []int64{int64(len(object)), -1} {
+			body, err := newChecksumBody(ioutil.NopCloser(strings.NewReader(object)), test.header, length)
+			if err != test.err {
+				t.Errorf("Test %d: expected error %v, got %v", i, test.err, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			var r io.Reader = strings.NewReader(object)
+			if body != nil {
+				r = body
+			}
+			read, err := ioutil.ReadAll(r)
+			if err != test.read {
+				t.Errorf("Test %d: expected read error %v, got %v", i, test.read, err)
+			}
+			if err == nil && string(read) != object {
+				t.Errorf("Test %d: expected the object, got %q", i, read)
+			}
+			// without a length, the end of the body is only known
+			// once it was read, and the final chunk is withheld
+			if err != nil && length >= 0 && len(read) >= len(object) {
+				t.Errorf("Test %d: expected the end of the body to be withheld, got %d bytes", i, len(read))
+			}
+		}
+	}
+}
+
+func TestChecksumVerification(t *testing.T) {
+	var received, incomplete, finished int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		defer atomic.AddInt32(&finished, 1)
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			atomic.AddInt32(&incomplete, 1)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	object := strings.Repeat("object", 10000)
+	md5sum := md5.Sum([]byte(object))
+	for _, block := range []string{"verify_checksums", "verify_checksums\ntry_duration 1s"} {
+		p := newRetryTestProxy(t, backend.URL+" "+backend.URL, block)
+		for i, test := range []struct {
+			md5    string
+			status int
+			code   string
+		}{
+			{md5: base64.StdEncoding.EncodeToString(md5sum[:]), status: http.StatusOK},
+			{md5: base64.StdEncoding.EncodeToString(make([]byte, 16)), status: http.StatusBadRequest, code: "BadDigest"},
+			{md5: "invalid", status: http.StatusBadRequest, code: "InvalidDigest"},
+		} {
+			atomic.StoreInt32(&received, 0)
+			atomic.StoreInt32(&incomplete, 0)
+			atomic.StoreInt32(&finished, 0)
+			r := httptest.NewRequest("PUT", "/bucket/key", strings.NewReader(object))
+			r.Header.Set("Content-MD5", test.md5)
+			w := httptest.NewRecorder()
+			code, err := p.ServeHTTP(w, r)
+			if code != 0 || err != nil {
+				t.Errorf("%q test %d: expected response to be written, got %d, %v", block, i, code, err)
+			}
+			if w.Code != test.status || !strings.Contains(w.Body.String(), test.code) {
+				t.Errorf("%q test %d: expected %d %s, got %d %q", block, i, test.status, test.code, w.Code, w.Body.String())
+			}
+			// the backend never gets a complete body that does not
+			// match, which it may notice only after we answered
+			for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&finished) < atomic.LoadInt32(&received) && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			if test.code != "" && atomic.LoadInt32(&received) != atomic.LoadInt32(&incomplete) {
+				t.Errorf("%q test %d: expected backend not to receive the complete body", block, i)
+			}
+		}
+	}
+
+	config := "proxy / localhost:8080 {\n verify_checksums on\n}"
+	if _, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+		t.Error("Expected error for verify_checksums with an argument")
+	}
+}
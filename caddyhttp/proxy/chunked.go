@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	stdhash "hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// awsChunkedBuffer is the size of the reads from the
+// body of an aws-chunked upload.
+const awsChunkedBuffer = 32 << 10
+
+var (
+	errDecodedLengthRequired = httpserver.S3Error{
+		Code:       "MissingContentLength",
+		Message:    "You must provide the x-amz-decoded-content-length HTTP header.",
+		HTTPStatus: http.StatusLengthRequired,
+	}
+	errIncompleteBody = httpserver.S3Error{
+		Code:       "IncompleteBody",
+		Message:    "You did not provide the number of bytes specified by the x-amz-decoded-content-length HTTP header.",
+		HTTPStatus: http.StatusBadRequest,
+	}
+	errMalformedChunk = httpserver.S3Error{
+		Code:       "InvalidRequest",
+		Message:    "The aws-chunked encoding of the request body is malformed.",
+		HTTPStatus: http.StatusBadRequest,
+	}
+	errChunkSignatureDoesNotMatch = httpserver.S3Error{
+		Code:       "SignatureDoesNotMatch",
+		Message:    "The request signature we calculated does not match the signature you provided. Check your key and signing method.",
+		HTTPStatus: http.StatusForbidden,
+	}
+)
+
+// awsChunkedBody parses the body of an aws-chunked upload signed
+// with STREAMING-AWS4-HMAC-SHA256-PAYLOAD, in which every chunk
+// is framed like
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n
+//
+// up to a final chunk of size 0. It makes sure the chunks add up to
+// the decoded length the client declared and, if there is a signer,
+// verifies their signatures. It reads either the body as it is or,
+// if decode is set, the data of the chunks only.
+//
+// The last byte of every chunk is held back until its signature is
+// verified; if it does not match, the read fails instead, so that
+// the upstream request is aborted before the backend has received
+// the whole chunk.
+type awsChunkedBody struct {
+	body   io.ReadCloser
+	src    *bufio.Reader
+	signer *httpserver.S3ChunkSigner // nil if signatures are not verified
+	decode bool
+	length int64 // the decoded length
+	read   int64 // bytes of chunk data so far
+	prev   string
+
+	// the chunk being read
+	remaining int64
+	signature string
+	hash      stdhash.Hash
+
+	buf  []byte
+	out  []byte // the part of buf not returned yet
+	done bool
+	err  error
+}
+
+// newAWSChunkedBody returns an *awsChunkedBody to use in place of
+// body, the body of a request with header, or nil if it is not an
+// aws-chunked upload with signed chunks.
+func newAWSChunkedBody(body io.ReadCloser, header http.Header, signer *httpserver.S3ChunkSigner, decode bool) (*awsChunkedBody, error) {
+	if body == nil || header.Get("X-Amz-Content-Sha256") != httpserver.S3StreamingPayload {
+		return nil, nil
+	}
+	length, err := strconv.ParseInt(header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, errDecodedLengthRequired
+	}
+	b := &awsChunkedBody{
+		body:   body,
+		src:    bufio.NewReader(body),
+		signer: signer,
+		decode: decode,
+		length: length,
+		hash:   sha256.New(),
+		buf:    make([]byte, awsChunkedBuffer),
+	}
+	if signer != nil {
+		b.prev = signer.Seed
+	}
+	return b, nil
+}
+
+// decodeRequest changes req, whose body b is, into a request with
+// the decoded body. The backend cannot verify the signature of the
+// request anymore, as the headers it covers change.
+func (b *awsChunkedBody) decodeRequest(req *http.Request) {
+	header := make(http.Header, len(req.Header))
+	copyHeader(header, req.Header)
+	var encodings []string
+	for _, encoding := range strings.Split(header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) > 0 {
+		header.Set("Content-Encoding", strings.Join(encodings, ","))
+	} else {
+		header.Del("Content-Encoding")
+	}
+	header.Del("X-Amz-Decoded-Content-Length")
+	header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	req.Header = header
+	req.ContentLength = b.length
+}
+
+func (b *awsChunkedBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.done {
+			return 0, io.EOF
+		}
+		b.out = b.buf[:0]
+		if b.err = b.next(); b.err != nil {
+			b.out = nil
+		}
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+func (b *awsChunkedBody) Close() error {
+	return b.body.Close()
+}
+
+// next reads the next part of the body into b.out.
+func (b *awsChunkedBody) next() error {
+	if b.remaining == 0 {
+		return b.startChunk()
+	}
+	n := b.remaining - 1
+	if n == 0 {
+		return b.endChunk()
+	}
+	if n > int64(len(b.buf)) {
+		n = int64(len(b.buf))
+	}
+	read, err := b.src.Read(b.buf[:n])
+	b.hash.Write(b.buf[:read])
+	b.remaining -= int64(read)
+	b.read += int64(read)
+	b.out = b.buf[:read]
+	if err == io.EOF {
+		return errIncompleteBody
+	}
+	return err
+}
+
+// startChunk reads the header of the next chunk; the
+// final chunk, which has no data, is read completely.
+func (b *awsChunkedBody) startChunk() error {
+	line, err := b.src.ReadSlice('\n')
+	if err == io.EOF {
+		return errIncompleteBody
+	}
+	if err == bufio.ErrBufferFull {
+		return errMalformedChunk
+	}
+	if err != nil {
+		return err
+	}
+	size, signature, ok := parseAWSChunkHeader(line)
+	if !ok {
+		return errMalformedChunk
+	}
+	if size > b.length-b.read {
+		return errIncompleteBody
+	}
+	if !b.decode {
+		b.out = append(b.out, line...)
+	}
+	b.remaining = size
+	b.signature = signature
+	b.hash.Reset()
+	if size == 0 {
+		return b.endChunk()
+	}
+	return nil
+}
+
+// endChunk reads the last byte of the chunk, if it has any, and
+// what follows it, and verifies the chunk.
+func (b *awsChunkedBody) endChunk() error {
+	final := b.remaining == 0
+	if !final {
+		c, err := b.src.ReadByte()
+		if err == io.EOF {
+			return errIncompleteBody
+		}
+		if err != nil {
+			return err
+		}
+		b.hash.Write([]byte{c})
+		b.remaining--
+		b.read++
+		b.out = append(b.out, c)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(b.src, crlf[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errIncompleteBody
+	} else if err != nil {
+		return err
+	}
+	if string(crlf[:]) != "\r\n" {
+		return errMalformedChunk
+	}
+
+	if b.signer != nil {
+		expected := b.signer.Sign(b.prev, b.hash.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(b.signature)) {
+			return errChunkSignatureDoesNotMatch
+		}
+		b.prev = expected
+	}
+	if final {
+		if b.read != b.length {
+			return errIncompleteBody
+		}
+		b.done = true
+	}
+	if !b.decode {
+		b.out = append(b.out, crlf[:]...)
+	}
+	return nil
+}
+
+// parseAWSChunkHeader parses the header line of a chunk, like
+// 10000;chunk-signature=ad80c730a21e5b8d0458...\r\n
+func parseAWSChunkHeader(line []byte) (size int64, signature string, ok bool) {
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(s, "\r\n"), ";", 2)
+	if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 16 ||
+		!strings.HasPrefix(parts[1], "chunk-signature=") {
+		return 0, "", false
+	}
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 {
+		return 0, "", false
+	}
+	signature = strings.TrimPrefix(parts[1], "chunk-signature=")
+	if _, err := hex.DecodeString(signature); err != nil || len(signature) != 2*sha256.Size {
+		return 0, "", false
+	}
+	return size, signature, true
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+var testChunkSigner = &httpserver.S3ChunkSigner{
+	Key:   []byte("signing key"),
+	Date:  "20130524T000000Z",
+	Scope: "20130524/us-east-1/s3/aws4_request",
+	Seed:  strings.Repeat("4f", 32),
+}
+
+// encodeAWSChunked frames data in chunks of size, signed with
+// signer, or with made up signatures if signer is nil.
+func encodeAWSChunked(signer *httpserver.S3ChunkSigner, data string, size int) string {
+	var body strings.Builder
+	var prev string
+	if signer != nil {
+		prev = signer.Seed
+	}
+	for {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		chunk := data[:n]
+		data = data[n:]
+		signature := strings.Repeat("0", 64)
+		if signer != nil {
+			hash := sha256.Sum256([]byte(chunk))
+			signature = signer.Sign(prev, hash[:])
+			prev = signature
+		}
+		fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", n, signature, chunk)
+		if n == 0 {
+			return body.String()
+		}
+	}
+}
+
+func TestAWSChunkedBody(t *testing.T) {
+	object := strings.Repeat("0123456789", 10000)
+	encoded := encodeAWSChunked(testChunkSigner, object, 65536)
+	forged := strings.Replace(encoded, "0123456789\r\n", "012345678X\r\n", 1)
+	header := func(decodedLength int) http.Header {
+		return http.Header{
+			"Content-Encoding":             {"aws-chunked"},
+			"X-Amz-Content-Sha256":         {httpserver.S3StreamingPayload},
+			"X-Amz-Decoded-Content-Length": {strconv.Itoa(decodedLength)},
+		}
+	}
+
+	for i, test := range []struct {
+		body    string
+		decoded string // if not the object
+		header  http.Header
+		signer  *httpserver.S3ChunkSigner
+		err     error // of newAWSChunkedBody
+		read    error // at the end of the body
+	}{
+		{body: encoded, header: header(len(object)), signer: testChunkSigner},
+		{body: encodeAWSChunked(testChunkSigner, "", 65536), decoded: "-", header: header(0), signer: testChunkSigner},
+		{body: encodeAWSChunked(nil, object, 8192), header: header(len(object))},
+		{body: forged, decoded: strings.TrimSuffix(object, "9") + "X", header: header(len(object))},
+		{body: forged, header: header(len(object)), signer: testChunkSigner, read: errChunkSignatureDoesNotMatch},
+		{body: encodeAWSChunked(nil, object, 8192), header: header(len(object)), signer: testChunkSigner, read: errChunkSignatureDoesNotMatch},
+		{body: encoded, header: header(len(object) + 1), signer: testChunkSigner, read: errIncompleteBody},
+		{body: encoded, header: header(len(object) - 1), signer: testChunkSigner, read: errIncompleteBody},
+		{body: encoded[:len(encoded)-2], header: header(len(object)), signer: testChunkSigner, read: errIncompleteBody},
+		{body: encoded[:70000], header: header(len(object)), signer: testChunkSigner, read: errIncompleteBody},
+		{body: strings.Replace(encoded, ";chunk-signature=", ";signature=", 1), header: header(len(object)), read: errMalformedChunk},
+		{body: strings.Replace(encoded, "\r\n", "\n", 1), header: header(len(object)), read: errMalformedChunk},
+		{body: "zz" + encoded, header: header(len(object)), read: errMalformedChunk},
+		{body: encoded, header: http.Header{"X-Amz-Content-Sha256": {httpserver.S3StreamingPayload}}, err: errDecodedLengthRequired},
+	} {
+		for _, decode := range []bool{false, true} {
+			body, err := newAWSChunkedBody(ioutil.NopCloser(strings.NewReader(test.body)), test.header, test.signer, decode)
+			if err != test.err {
+				t.Errorf("Test %d: expected error %v, got %v", i, test.err, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			read, err := ioutil.ReadAll(body)
+			if err != test.read {
+				t.Errorf("Test %d: expected read error %v, got %v", i, test.read, err)
+				continue
+			}
+			expected := test.body
+			if decode {
+				switch test.decoded {
+				case "":
+					expected = object
+				case "-":
+					expected = ""
+				default:
+					expected = test.decoded
+				}
+			}
+			if err == nil && string(read) != expected {
+				t.Errorf("Test %d: expected the body, got %d bytes", i, len(read))
+			}
+			// the backend never gets a complete forged chunk
+			if err == errChunkSignatureDoesNotMatch && strings.Contains(string(read), "012345678X") {
+				t.Errorf("Test %d: expected the forged chunk to be withheld", i)
+			}
+		}
+	}
+
+	// other uploads are left alone
+	body, err := newAWSChunkedBody(ioutil.NopCloser(strings.NewReader(object)), http.Header{}, testChunkSigner, true)
+	if body != nil || err != nil {
+		t.Errorf("Expected plain body not to be decoded, got %v, %v", body, err)
+	}
+}
+
+func TestAWSChunkedVerification(t *testing.T) {
+	var received, incomplete, finished int32
+	var header http.Header
+	var length int64
+	var content string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		defer atomic.AddInt32(&finished, 1)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			atomic.AddInt32(&incomplete, 1)
+			return
+		}
+		header, length, content = r.Header, r.ContentLength, string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	object := strings.Repeat("object", 20000)
+	encoded := encodeAWSChunked(testChunkSigner, object, 65536)
+	request := func(body string) *http.Request {
+		r := httptest.NewRequest("PUT", "/bucket/key", strings.NewReader(body))
+		r.Header.Set("Content-Encoding", "aws-chunked,gzip")
+		r.Header.Set("X-Amz-Content-Sha256", httpserver.S3StreamingPayload)
+		r.Header.Set("X-Amz-Decoded-Content-Length", strconv.Itoa(len(object)))
+		return r.WithContext(context.WithValue(r.Context(), httpserver.S3ChunkSignerCtxKey, testChunkSigner))
+	}
+
+	for _, block := range []string{"aws_chunked", "aws_chunked decode", "aws_chunked decode\ntry_duration 1s"} {
+		p := newRetryTestProxy(t, backend.URL, block)
+		decode := strings.Contains(block, "decode")
+
+		w := httptest.NewRecorder()
+		if code, err := p.ServeHTTP(w, request(encoded)); code != 0 || err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%q: expected upload to succeed, got %d, %v, %d", block, code, err, w.Code)
+		}
+		if decode {
+			if content != object || length != int64(len(object)) || header.Get("Content-Encoding") != "gzip" ||
+				header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" || header.Get("X-Amz-Decoded-Content-Length") != "" {
+				t.Errorf("%q: expected decoded upload, got %d bytes, %v", block, len(content), header)
+			}
+		} else if content != encoded || header.Get("X-Amz-Content-Sha256") != httpserver.S3StreamingPayload {
+			t.Errorf("%q: expected upload as it is, got %d bytes, %v", block, len(content), header)
+		}
+
+		atomic.StoreInt32(&received, 0)
+		atomic.StoreInt32(&incomplete, 0)
+		atomic.StoreInt32(&finished, 0)
+		w = httptest.NewRecorder()
+		forged := strings.Replace(encoded, "object\r\n", "objecT\r\n", 1)
+		if code, err := p.ServeHTTP(w, request(forged)); code != 0 || err != nil {
+			t.Errorf("%q: expected response to be written, got %d, %v", block, code, err)
+		}
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "SignatureDoesNotMatch") {
+			t.Errorf("%q: expected 403 SignatureDoesNotMatch, got %d %q", block, w.Code, w.Body.String())
+		}
+		// the backend may notice the aborted body after we answered
+		for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&finished) < atomic.LoadInt32(&received) && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if atomic.LoadInt32(&received) != atomic.LoadInt32(&incomplete) {
+			t.Errorf("%q: expected backend not to receive the complete body", block)
+		}
+	}
+
+	for _, config := range []string{"aws_chunked on", "aws_chunked decode now"} {
+		config = "proxy / localhost:8080 {\n" + config + "\n}"
+		if _, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+			t.Errorf("Expected error for %q", config)
+		}
+	}
+}
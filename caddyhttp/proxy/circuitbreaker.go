@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+// breakerState is the state of a circuitBreaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// circuitBreakerConfig configures the circuit breakers of the hosts
+// of an upstream. A breaker trips when, within Window, at least
+// MinRequests were made and ErrorRatio of them failed, or when
+// ConsecutiveFailures requests failed in a row. Responses slower
+// than Latency count as failures. After OpenTime the breaker lets
+// HalfOpenRequests trial requests through; if they all succeed it
+// closes again, otherwise it opens for another OpenTime.
+type circuitBreakerConfig struct {
+	Window              time.Duration
+	MinRequests         int
+	ErrorRatio          float64 // 0 disables
+	ConsecutiveFailures int     // 0 disables
+	Latency             time.Duration
+	OpenTime            time.Duration
+	HalfOpenRequests    int
+}
+
+func newCircuitBreakerConfig() *circuitBreakerConfig {
+	return &circuitBreakerConfig{
+		Window:           10 * time.Second,
+		MinRequests:      20,
+		OpenTime:         30 * time.Second,
+		HalfOpenRequests: 1,
+	}
+}
+
+// circuitBreaker keeps requests away from a failing upstream host.
+type circuitBreaker struct {
+	config *circuitBreakerConfig
+	name   string // of the host, for logs and metrics
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	openedAt    time.Time
+	trials      int // trial requests let through while half-open
+	successes   int // successful trial requests
+}
+
+func newCircuitBreaker(config *circuitBreakerConfig, name string) *circuitBreaker {
+	return &circuitBreaker{config: config, name: name}
+}
+
+// currentState returns the state of b, moving from open to
+// half-open if the breaker has been open long enough.
+// b.mu must be held.
+func (b *circuitBreaker) currentState(t time.Time) breakerState {
+	if b.state == breakerOpen && t.Sub(b.openedAt) >= b.config.OpenTime {
+		b.setState(breakerHalfOpen, "open time elapsed")
+		b.trials, b.successes = 0, 0
+	}
+	return b.state
+}
+
+// State returns the current state of b.
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState(now())
+}
+
+// available reports whether b would allow a request.
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState(now()) {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		return b.trials < b.config.HalfOpenRequests
+	}
+	return false
+}
+
+// allow reports whether a request may be made, counting
+// it as a trial request if b is half-open.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState(now()) {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.trials < b.config.HalfOpenRequests {
+			b.trials++
+			return true
+		}
+	}
+	return false
+}
+
+// cancel gives back a request allowed by b that did not
+// finish, so that it does not count as a trial request.
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// record records the outcome of a request allowed by b
+// and reports whether that closed b.
+func (b *circuitBreaker) record(failed bool, latency time.Duration) bool {
+	if b.config.Latency > 0 && latency > b.config.Latency {
+		failed = true
+	}
+	t := now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState(t) {
+	case breakerHalfOpen:
+		if failed {
+			b.open(t, "trial request failed")
+			return false
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.setState(breakerClosed, "trial requests succeeded")
+			b.windowStart, b.requests, b.failures, b.consecutive = t, 0, 0, 0
+			return true
+		}
+	case breakerClosed:
+		if t.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart, b.requests, b.failures = t, 0, 0
+		}
+		b.requests++
+		if !failed {
+			b.consecutive = 0
+			return false
+		}
+		b.failures++
+		b.consecutive++
+
+		if b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures {
+			b.open(t, "consecutive failures")
+		} else if b.config.ErrorRatio > 0 && b.requests >= b.config.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.config.ErrorRatio {
+			b.open(t, "error ratio")
+		}
+	}
+	return false
+}
+
+// open trips b. b.mu must be held.
+func (b *circuitBreaker) open(t time.Time, reason string) {
+	b.openedAt = t
+	b.setState(breakerOpen, reason)
+	prometheus.CountUpstreamBreakerTrip(b.name, reason)
+}
+
+// setState changes the state of b. b.mu must be held.
+func (b *circuitBreaker) setState(state breakerState, reason string) {
+	if state == b.state {
+		return
+	}
+	log.Printf("[INFO] proxy: circuit breaker of %s is %s (was %s): %s", b.name, state, b.state, reason)
+	b.state = state
+	prometheus.SetUpstreamBreakerState(b.name, int(state))
+}
+
+// allowRequest reports whether a request may be made to uh; it
+// must be followed by recordResponse or cancelRequest if so.
+func (uh *UpstreamHost) allowRequest() bool {
+	return uh.breaker == nil || uh.breaker.allow()
+}
+
+// cancelRequest gives back a request allowed by allowRequest
+// that did not get a response.
+func (uh *UpstreamHost) cancelRequest() {
+	if uh.breaker != nil {
+		uh.breaker.cancel()
+	}
+}
+
+// recordResponse records a response of uh for outlier detection
+// and the circuit breaker, where enabled. failed responses are
+// errors or have a 5xx status; latency is the time until the
+// response header arrived.
+func (uh *UpstreamHost) recordResponse(failed bool, latency time.Duration) {
+	if uh.outlierStats != nil {
+		uh.outlierStats.detector.record(uh, failed, latency)
+	}
+	if uh.breaker != nil && uh.breaker.record(failed, latency) {
+		// the host starts slowly once the breaker closes
+		atomic.StoreInt64(&uh.healthySince, now().UnixNano())
+	}
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func newBreakerTestHost(config *circuitBreakerConfig) *UpstreamHost {
+	u := &staticUpstream{MaxFails: 1, Breaker: config}
+	uh, _ := u.NewHost("localhost")
+	return uh
+}
+
+// request makes a request to host at t, if its breaker allows it,
+// and records the outcome.
+func request(host *UpstreamHost, t time.Time, failed bool, latency time.Duration) bool {
+	defer setNow(t)()
+	if !host.allowRequest() {
+		return false
+	}
+	host.recordResponse(failed, latency)
+	return true
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	config := newCircuitBreakerConfig()
+	config.ConsecutiveFailures = 3
+	config.OpenTime = 10 * time.Second
+	config.HalfOpenRequests = 2
+	host := newBreakerTestHost(config)
+	start := time.Now()
+
+	request(host, start, true, time.Millisecond)
+	request(host, start, true, time.Millisecond)
+	request(host, start, false, time.Millisecond)
+	request(host, start, true, time.Millisecond)
+	request(host, start, true, time.Millisecond)
+	if state := host.breaker.State(); state != breakerClosed {
+		t.Fatalf("Expected breaker to stay closed after interrupted failures, got %s", state)
+	}
+
+	request(host, start, true, time.Millisecond)
+	defer setNow(start)()
+	if state := host.breaker.State(); state != breakerOpen {
+		t.Fatalf("Expected breaker to open after 3 consecutive failures, got %s", state)
+	}
+	if !host.Down() {
+		t.Error("Expected host with open breaker to be down")
+	}
+	if request(host, start.Add(5*time.Second), false, time.Millisecond) {
+		t.Error("Expected open breaker to refuse requests")
+	}
+
+	// after the open time, a limited number of trial requests
+	// is let through; a failing one opens the breaker again
+	half := start.Add(11 * time.Second)
+	defer setNow(half)()
+	if host.Down() {
+		t.Error("Expected half-open host to be available")
+	}
+	if !host.allowRequest() || !host.allowRequest() {
+		t.Fatal("Expected half-open breaker to allow 2 trial requests")
+	}
+	if host.allowRequest() {
+		t.Error("Expected half-open breaker to refuse a third trial request")
+	}
+	if !host.Down() {
+		t.Error("Expected host to be down while its trial requests are in flight")
+	}
+	host.recordResponse(false, time.Millisecond)
+	host.recordResponse(true, time.Millisecond)
+	if state := host.breaker.State(); state != breakerOpen {
+		t.Fatalf("Expected failed trial request to open the breaker, got %s", state)
+	}
+
+	// successful trial requests close it
+	half = half.Add(11 * time.Second)
+	request(host, half, false, time.Millisecond)
+	defer setNow(half)()
+	if state := host.breaker.State(); state != breakerHalfOpen {
+		t.Fatalf("Expected breaker to wait for the second trial request, got %s", state)
+	}
+	request(host, half, false, time.Millisecond)
+	if state := host.breaker.State(); state != breakerClosed {
+		t.Fatalf("Expected successful trial requests to close the breaker, got %s", state)
+	}
+	if since := atomic.LoadInt64(&host.healthySince); since != half.UnixNano() {
+		t.Error("Expected host to start slowly once its breaker closed")
+	}
+}
+
+func TestCircuitBreakerErrorRatio(t *testing.T) {
+	config := newCircuitBreakerConfig()
+	config.ErrorRatio = 0.5
+	config.MinRequests = 10
+	config.Window = 10 * time.Second
+	host := newBreakerTestHost(config)
+	start := time.Now()
+
+	// failures spread over several windows never reach the ratio
+	tm := start
+	for i := 0; i < 30; i++ {
+		request(host, tm, i%2 == 0, time.Millisecond)
+		if i%2 == 0 {
+			request(host, tm, false, time.Millisecond)
+			request(host, tm, false, time.Millisecond)
+		}
+		tm = tm.Add(time.Second)
+	}
+	defer setNow(tm)()
+	if state := host.breaker.State(); state != breakerClosed {
+		t.Fatalf("Expected breaker to stay closed below the error ratio, got %s", state)
+	}
+
+	tm = tm.Add(10 * time.Second)
+	for i := 0; i < 9; i++ {
+		request(host, tm, i%3 != 0, time.Millisecond)
+	}
+	defer setNow(tm)()
+	if state := host.breaker.State(); state != breakerClosed {
+		t.Fatalf("Expected breaker to stay closed below the minimum requests, got %s", state)
+	}
+	request(host, tm, true, time.Millisecond)
+	if state := host.breaker.State(); state != breakerOpen {
+		t.Fatalf("Expected breaker to open above the error ratio, got %s", state)
+	}
+}
+
+func TestCircuitBreakerLatency(t *testing.T) {
+	config := newCircuitBreakerConfig()
+	config.ConsecutiveFailures = 2
+	config.Latency = 100 * time.Millisecond
+	host := newBreakerTestHost(config)
+	start := time.Now()
+
+	request(host, start, false, 50*time.Millisecond)
+	request(host, start, false, 200*time.Millisecond)
+	request(host, start, false, 300*time.Millisecond)
+	defer setNow(start)()
+	if state := host.breaker.State(); state != breakerOpen {
+		t.Fatalf("Expected slow responses to open the breaker, got %s", state)
+	}
+}
+
+func TestCircuitBreakerCancel(t *testing.T) {
+	config := newCircuitBreakerConfig()
+	config.ConsecutiveFailures = 1
+	config.OpenTime = time.Second
+	host := newBreakerTestHost(config)
+	start := time.Now()
+
+	request(host, start, true, time.Millisecond)
+	defer setNow(start.Add(2 * time.Second))()
+	if !host.allowRequest() {
+		t.Fatal("Expected half-open breaker to allow a trial request")
+	}
+	host.cancelRequest()
+	if !host.allowRequest() {
+		t.Error("Expected canceled trial request to be given back")
+	}
+}
+
+func TestCircuitBreakerProxy(t *testing.T) {
+	var failing int32 = 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + ` {
+		breaker_consecutive_failures 2
+		breaker_open_time 50ms
+	}`
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{Upstreams: upstreams}
+	host := upstreams[0].(*staticUpstream).Hosts[0]
+
+	for i := 0; i < 2; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if state := host.breaker.State(); state != breakerOpen {
+		t.Fatalf("Expected breaker to open, got %s", state)
+	}
+	code, _ := p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if code != http.StatusBadGateway {
+		t.Errorf("Expected %d while the breaker is open, got %d", http.StatusBadGateway, code)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	rec := httpserver.NewResponseRecorder(testResponseRecorder{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+	})
+	rec.Replacer = httpserver.NewReplacer(r, rec, "-")
+	if code, err := p.ServeHTTP(rec, r); code != 0 || err != nil {
+		t.Fatalf("Expected trial request to succeed, got %d, %v", code, err)
+	}
+	if got := rec.Replacer.Replace("{upstream_breaker}"); got != "half-open" {
+		t.Errorf("Expected {upstream_breaker} to be half-open, got %q", got)
+	}
+	if state := host.breaker.State(); state != breakerClosed {
+		t.Errorf("Expected successful trial request to close the breaker, got %s", state)
+	}
+}
+
+func TestParseBlockCircuitBreaker(t *testing.T) {
+	config := `breaker_error_ratio 0.3 50
+	breaker_consecutive_failures 5
+	breaker_latency 2s
+	breaker_window 1m
+	breaker_open_time 20s
+	breaker_half_open_requests 3`
+
+	u := staticUpstream{}
+	c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+	for c.Next() {
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	b := u.Breaker
+	if b == nil {
+		t.Fatal("Expected circuit breaker to be enabled")
+	}
+	if b.ErrorRatio != 0.3 || b.MinRequests != 50 || b.ConsecutiveFailures != 5 ||
+		b.Latency != 2*time.Second || b.Window != time.Minute ||
+		b.OpenTime != 20*time.Second || b.HalfOpenRequests != 3 {
+		t.Errorf("Unexpected circuit breaker config %+v", b)
+	}
+
+	for i, config := range []string{
+		"breaker_error_ratio 0",
+		"breaker_error_ratio 0.5 0",
+		"breaker_consecutive_failures 0",
+		"breaker_latency -1s",
+		"breaker_window 0s",
+		"breaker_open_time 0s",
+		"breaker_half_open_requests 0",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+
+	_, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile",
+		strings.NewReader("proxy / localhost:8080 {\n breaker_open_time 1m\n}")), "")
+	if err == nil {
+		t.Error("Expected error for circuit breaker without thresholds")
+	}
+}
@@ -0,0 +1,419 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+// coalesceChunk is the size of the reads from the body of
+// a shared response.
+const coalesceChunk = 32 << 10
+
+// errCoalesceStalled is the error of a reader cut off from a
+// shared response for holding up the others.
+var errCoalesceStalled = errors.New("reader of coalesced response fell behind")
+
+// coalesceHeaders are the request headers, besides the X-Amz-*
+// ones, that may change the response to a request. Requests are
+// only coalesced if they agree on all of them.
+var coalesceHeaders = []string{
+	"Authorization",
+	"Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+	"Accept-Encoding",
+}
+
+// coalescePolicy configures the coalescing of identical GET and
+// HEAD requests for objects of an upstream: while such a request
+// is in flight, identical ones are not sent upstream but share its
+// response, which is streamed to all of them. Anonymous requests
+// for public objects are coalesced, signed ones only if they go to
+// Buckets marked as cacheable.
+type coalescePolicy struct {
+	Buckets      map[string]bool
+	MaxBuffer    int64         // bytes the slowest reader may fall behind
+	StallTimeout time.Duration // readers holding up the others longer are cut off
+
+	from    string
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescePolicy() *coalescePolicy {
+	return &coalescePolicy{
+		Buckets:      make(map[string]bool),
+		MaxBuffer:    1 << 20,
+		StallTimeout: 5 * time.Second,
+		flights:      make(map[string]*flight),
+	}
+}
+
+// key returns the key identical requests to r share, or
+// an empty string if r is not to be coalesced.
+func (p *coalescePolicy) key(r *http.Request) string {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.ContentLength != 0 || requestIsWebsocket(r) {
+		return ""
+	}
+	if strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-store") {
+		return ""
+	}
+	s3req := httpserver.GetS3Request(r)
+	if s3req == nil {
+		s3req = httpserver.ParseS3Request(r, nil)
+	}
+	if s3req.Key == "" {
+		return ""
+	}
+	public := s3req.SignatureVersion == "" && r.Header.Get("Authorization") == ""
+	if !public && !p.Buckets[s3req.Bucket] {
+		return ""
+	}
+
+	var amz []string
+	for name := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-") {
+			amz = append(amz, name)
+		}
+	}
+	sort.Strings(amz)
+
+	var key strings.Builder
+	key.WriteString(r.Method + " " + s3req.Bucket + "/" + s3req.Key + "?" + r.URL.RawQuery)
+	for _, name := range append(coalesceHeaders, amz...) {
+		if values, ok := r.Header[name]; ok {
+			key.WriteString("\n" + name + ": " + strings.Join(values, ","))
+		}
+	}
+	return key.String()
+}
+
+// join adds a reader to the flight of key, starting a new
+// flight if there is none that can be joined. It reports
+// whether the caller leads the flight, and has to run it.
+func (p *coalescePolicy) join(key string) (*flight, *flightReader, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f := p.flights[key]; f != nil {
+		if r := f.add(); r != nil {
+			return f, r, false
+		}
+	}
+	f := newFlight(p, key)
+	p.flights[key] = f
+	return f, f.add(), true
+}
+
+// leave forgets f once it can no longer be joined.
+func (p *coalescePolicy) leave(f *flight) {
+	p.mu.Lock()
+	if p.flights[f.key] == f {
+		delete(p.flights, f.key)
+	}
+	p.mu.Unlock()
+}
+
+// flight is a request in flight whose response is shared by
+// its readers. It can be joined until it is complete or the
+// start of the response body was discarded.
+type flight struct {
+	policy *coalescePolicy
+	key    string
+	ctx    context.Context
+	cancel context.CancelFunc // once all readers left
+
+	// set before ready is closed
+	ready chan struct{}
+	res   *http.Response
+	err   error
+
+	// the part of the body not read by all readers yet
+	mu      sync.Mutex
+	changed *sync.Cond
+	buf     []byte
+	base    int64 // offset of buf in the body
+	done    bool  // the body was read, up to bodyErr if not nil
+	bodyErr error
+	readers map[*flightReader]bool
+	left    bool // all readers left
+}
+
+func newFlight(p *coalescePolicy, key string) *flight {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &flight{
+		policy:  p,
+		key:     key,
+		ctx:     ctx,
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+		readers: make(map[*flightReader]bool),
+	}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// add returns a new reader of f, or nil if f can
+// no longer be joined.
+func (f *flight) add() *flightReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.base > 0 || f.done || f.left {
+		return nil
+	}
+	r := &flightReader{flight: f, closed: make(chan struct{})}
+	f.readers[r] = true
+	return r
+}
+
+// drop removes r from the readers of f, which fail with err
+// from now on; f.mu must be held.
+func (f *flight) drop(r *flightReader, err error) {
+	if !f.readers[r] {
+		return
+	}
+	delete(f.readers, r)
+	r.err = err
+	if len(f.readers) == 0 {
+		f.left = true
+		f.cancel()
+	}
+	f.changed.Broadcast()
+}
+
+// run sends req with base, detached from the request of the
+// downstream client that may leave before the other readers,
+// and passes the response on to the readers.
+func (f *flight) run(base http.RoundTripper, req *http.Request) {
+	ctx := f.ctx
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil {
+		ctx = httptrace.WithClientTrace(ctx, trace)
+	}
+	f.res, f.err = base.RoundTrip(req.WithContext(ctx))
+	close(f.ready)
+	if f.err != nil {
+		f.mu.Lock()
+		f.done = true
+		f.mu.Unlock()
+		f.cancel()
+		f.policy.leave(f)
+		return
+	}
+	f.pump()
+}
+
+// pump reads the response body into the buffer, as fast as
+// the slowest reader allows.
+func (f *flight) pump() {
+	body := f.res.Body
+	defer body.Close()
+	chunk := make([]byte, coalesceChunk)
+	for {
+		n, err := body.Read(chunk)
+		f.mu.Lock()
+		f.buf = append(f.buf, chunk[:n]...)
+		if err != nil {
+			f.done = true
+			if err != io.EOF {
+				f.bodyErr = err
+			}
+			f.changed.Broadcast()
+			f.mu.Unlock()
+			f.cancel()
+			f.policy.leave(f)
+			return
+		}
+		f.changed.Broadcast()
+		ok := f.makeRoom()
+		f.mu.Unlock()
+		if !ok {
+			f.policy.leave(f)
+			return
+		}
+	}
+}
+
+// makeRoom discards the part of the buffer all readers have
+// read, and waits while the slowest ones keep it full. If they
+// hold up the others for longer than the stall timeout, they
+// are cut off. It returns false once all readers left; f.mu
+// must be held.
+func (f *flight) makeRoom() bool {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	var deadline time.Time
+	for {
+		if len(f.readers) == 0 {
+			return false
+		}
+		slowest := f.trim()
+		if int64(len(f.buf)) < f.policy.MaxBuffer {
+			return true
+		}
+		if deadline.IsZero() {
+			deadline = time.Now().Add(f.policy.StallTimeout)
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(f.policy.StallTimeout, func() {
+				f.mu.Lock()
+				f.changed.Broadcast()
+				f.mu.Unlock()
+			})
+		} else if !time.Now().Before(deadline) {
+			for r := range f.readers {
+				if r.offset == slowest {
+					prometheus.CountCoalesced(f.policy.from, "stalled")
+					f.drop(r, errCoalesceStalled)
+				}
+			}
+			deadline = time.Time{}
+			continue
+		}
+		f.changed.Wait()
+	}
+}
+
+// trim discards the part of the buffer all readers have read,
+// and returns the offset of the slowest one; f.mu must be held.
+func (f *flight) trim() int64 {
+	slowest := f.base + int64(len(f.buf))
+	for r := range f.readers {
+		if r.offset < slowest {
+			slowest = r.offset
+		}
+	}
+	if slowest > f.base {
+		f.buf = append(f.buf[:0], f.buf[slowest-f.base:]...)
+		f.base = slowest
+	}
+	return slowest
+}
+
+// flightReader reads the body of the response of a flight.
+type flightReader struct {
+	flight *flight
+	offset int64
+	err    error // once dropped
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.flight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.offset < f.base+int64(len(f.buf)) {
+			n := copy(p, f.buf[r.offset-f.base:])
+			r.offset += int64(n)
+			f.changed.Broadcast()
+			return n, nil
+		}
+		if f.done {
+			if f.bodyErr != nil {
+				return 0, f.bodyErr
+			}
+			return 0, io.EOF
+		}
+		f.changed.Wait()
+	}
+}
+
+func (r *flightReader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.leave(http.ErrBodyReadAfterClose)
+	})
+	return nil
+}
+
+// watch drops r once ctx is done.
+func (r *flightReader) watch(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.leave(ctx.Err())
+		case <-r.closed:
+		}
+	}()
+}
+
+// leave drops r with err.
+func (r *flightReader) leave(err error) {
+	f := r.flight
+	f.mu.Lock()
+	f.drop(r, err)
+	left := f.left
+	f.mu.Unlock()
+	if left {
+		f.policy.leave(f)
+	}
+}
+
+// coalesceTransport is the transport of a single coalescable
+// request, which shares the response of an identical request in
+// flight, or sends it and shares its own response.
+type coalesceTransport struct {
+	policy *coalescePolicy
+	key    string
+	base   http.RoundTripper
+
+	// set by RoundTrip if the response of another request was used
+	follower bool
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *coalesceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, r, leader := t.policy.join(t.key)
+	ctx := req.Context()
+	r.watch(ctx)
+	if leader {
+		prometheus.CountCoalesced(t.policy.from, "leader")
+		go f.run(t.base, req)
+	} else {
+		prometheus.CountCoalesced(t.policy.from, "follower")
+		t.follower = true
+	}
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		r.Close()
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		r.Close()
+		return nil, f.err
+	}
+
+	// the header is changed downstream, and the
+	// trailer set while the shared body is read
+	res := new(http.Response)
+	*res = *f.res
+	res.Header = make(http.Header, len(f.res.Header))
+	copyHeader(res.Header, f.res.Header)
+	res.Trailer = nil
+	res.Request = req
+	res.Body = r
+	return res, nil
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+// readers returns the number of readers of the flight of key.
+func (p *coalescePolicy) readers(key string) int {
+	p.mu.Lock()
+	f := p.flights[key]
+	p.mu.Unlock()
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.readers)
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+	release := make(chan struct{})
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(object)
+	}))
+	defer backend.Close()
+
+	p := newRetryTestProxy(t, backend.URL, "coalesce\ncoalesce_max_buffer 65536")
+	policy := p.Upstreams[0].(*staticUpstream).Coalesce
+	key := policy.key(httptest.NewRequest("GET", "/bucket/key", nil))
+
+	const clients = 5
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, clients)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			p.ServeHTTP(w, httptest.NewRequest("GET", "/bucket/key", nil))
+		}(responses[i])
+	}
+	for deadline := time.Now().Add(time.Second); policy.readers(key) < clients; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d readers, got %d", clients, policy.readers(key))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 request upstream, got %d", n)
+	}
+	for i, w := range responses {
+		if !bytes.Equal(w.Body.Bytes(), object) || w.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Client %d: expected the object, got %d bytes, %v", i, w.Body.Len(), w.Header())
+		}
+	}
+	if n := len(policy.flights); n != 0 {
+		t.Errorf("Expected no flights left, got %d", n)
+	}
+
+	// signed requests go upstream on their own
+	atomic.StoreInt32(&requests, 0)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/bucket/key", nil)
+		req.Header.Set("Authorization", "AWS AKIDEXAMPLE:signature")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 signed requests upstream, got %d", n)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	p := newCoalescePolicy()
+	p.Buckets["cacheable"] = true
+	request := func(method, target string, header ...string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+	object := p.key(request("GET", "/bucket/key"))
+	if object == "" {
+		t.Fatal("Expected anonymous GET to be coalesced")
+	}
+
+	for i, r := range []*http.Request{
+		request("PUT", "/bucket/key"),
+		request("DELETE", "/bucket/key"),
+		request("GET", "/bucket"),
+		request("GET", "/bucket/key", "Authorization", "AWS AKIDEXAMPLE:signature"),
+		request("GET", "/bucket/key?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIDEXAMPLE%2F20180101%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Signature=abc"),
+		request("GET", "/bucket/key", "Cache-Control", "no-store"),
+	} {
+		if key := p.key(r); key != "" {
+			t.Errorf("Test %d: expected %s %s not to be coalesced, got key %q", i, r.Method, r.URL, key)
+		}
+	}
+
+	for i, r := range []*http.Request{
+		request("HEAD", "/bucket/key"),
+		request("GET", "/bucket/other"),
+		request("GET", "/other/key"),
+		request("GET", "/bucket/key?versionId=1"),
+		request("GET", "/bucket/key", "Range", "bytes=0-99"),
+		request("GET", "/bucket/key", "If-None-Match", `"v1"`),
+		request("GET", "/bucket/key", "X-Amz-Server-Side-Encryption-Customer-Key", "c2VjcmV0"),
+	} {
+		if key := p.key(r); key == object || key == "" {
+			t.Errorf("Test %d: expected %s %s to have a key of its own, got %q", i, r.Method, r.URL, key)
+		}
+	}
+	if p.key(request("GET", "/bucket/key", "User-Agent", "aws-cli")) != object {
+		t.Error("Expected irrelevant headers to be ignored")
+	}
+
+	// signed requests to cacheable buckets are coalesced
+	// with identical ones only
+	signed := p.key(request("GET", "/cacheable/key", "Authorization", "AWS AKIDEXAMPLE:signature"))
+	if signed == "" || signed == p.key(request("GET", "/cacheable/key")) ||
+		signed == p.key(request("GET", "/cacheable/key", "Authorization", "AWS AKIDOTHER:signature")) {
+		t.Errorf("Expected signed requests to share a key only with identical ones, got %q", signed)
+	}
+}
+
+// stubTransport answers every request with status 200 and body.
+type stubTransport struct {
+	requests int32
+	body     []byte
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(t.body)),
+		ContentLength: int64(len(t.body)),
+		Request:       req,
+	}, nil
+}
+
+func TestCoalesceBackpressure(t *testing.T) {
+	p := newCoalescePolicy()
+	p.MaxBuffer = 64 << 10
+	p.StallTimeout = 200 * time.Millisecond
+	base := &stubTransport{body: bytes.Repeat([]byte("x"), 1<<20)}
+
+	roundTrip := func(ctx context.Context) *http.Response {
+		transport := &coalesceTransport{policy: p, key: "GET bucket/key", base: base}
+		res, err := transport.RoundTrip(httptest.NewRequest("GET", "/bucket/key", nil).WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// the client that started the request leaves
+	// without affecting the others
+	leaderCtx, leave := context.WithCancel(context.Background())
+	leader := roundTrip(leaderCtx)
+	fast := roundTrip(context.Background())
+	stalled := roundTrip(context.Background())
+	if n := atomic.LoadInt32(&base.requests); n != 1 {
+		t.Fatalf("Expected 1 request, got %d", n)
+	}
+	leave()
+	if _, err := ioutil.ReadAll(leader.Body); err != context.Canceled {
+		t.Errorf("Expected reader of the leaving client to fail, got %v", err)
+	}
+
+	// the fast reader is held up by the stalled one
+	// only until the stall timeout
+	start := time.Now()
+	body, err := ioutil.ReadAll(fast.Body)
+	if err != nil || len(body) != len(base.body) {
+		t.Errorf("Expected the complete body, got %d bytes, %v", len(body), err)
+	}
+	if elapsed := time.Since(start); elapsed < p.StallTimeout {
+		t.Errorf("Expected the fast reader to be held up, took %v", elapsed)
+	}
+	fast.Body.Close()
+	if _, err := ioutil.ReadAll(stalled.Body); err != errCoalesceStalled {
+		t.Errorf("Expected stalled reader to be cut off, got %v", err)
+	}
+	stalled.Body.Close()
+
+	// later requests are not coalesced with
+	// one whose response was already sent
+	roundTrip(context.Background()).Body.Close()
+	if n := atomic.LoadInt32(&base.requests); n != 2 {
+		t.Errorf("Expected a request of its own, got %d requests", n)
+	}
+}
+
+func TestCoalesceAllReadersLeave(t *testing.T) {
+	p := newCoalescePolicy()
+	canceled := make(chan struct{})
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		close(canceled)
+		return nil, req.Context().Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		transport := &coalesceTransport{policy: p, key: "GET bucket/key", base: base}
+		_, err := transport.RoundTrip(httptest.NewRequest("GET", "/bucket/key", nil).WithContext(ctx))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected request to be canceled, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected shared request to be canceled once all clients left")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestParseBlockCoalesce(t *testing.T) {
+	config := `coalesce
+	coalesce_buckets public assets
+	coalesce_max_buffer 4096
+	coalesce_stall_timeout 2s`
+
+	u := staticUpstream{}
+	c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+	for c.Next() {
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	p := u.Coalesce
+	if p == nil {
+		t.Fatal("Expected coalescing to be enabled")
+	}
+	if len(p.Buckets) != 2 || !p.Buckets["assets"] || p.MaxBuffer != 4096 || p.StallTimeout != 2*time.Second {
+		t.Errorf("Unexpected coalesce policy %+v", p)
+	}
+
+	for i, config := range []string{
+		"coalesce on",
+		"coalesce_buckets",
+		"coalesce_max_buffer 0",
+		"coalesce_max_buffer 1MB",
+		"coalesce_stall_timeout 0s",
+		"coalesce_stall_timeout soon",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// errHostCutOff is returned for requests that a host being
+// removed did not finish before its drain deadline.
+var errHostCutOff = errors.New("upstream host was drained before the request finished")
+
+// cutoff returns a channel that is closed when the
+// requests still running on uh are to be cut off.
+func (uh *UpstreamHost) cutoff() <-chan struct{} {
+	uh.drainMu.Lock()
+	defer uh.drainMu.Unlock()
+	if uh.cut == nil {
+		uh.cut = make(chan struct{})
+	}
+	return uh.cut
+}
+
+// cutOff reports whether the requests to uh were cut off.
+func (uh *UpstreamHost) cutOff() bool {
+	select {
+	case <-uh.cutoff():
+		return true
+	default:
+		return false
+	}
+}
+
+// drain stops new requests to uh, unless it is disabled already.
+// If timeout is positive, the requests still running after timeout
+// are cut off; otherwise they may take as long as they need.
+func (uh *UpstreamHost) drain(timeout time.Duration) {
+	atomic.CompareAndSwapInt32(&uh.adminState, hostActive, hostDraining)
+	if timeout <= 0 {
+		return
+	}
+	uh.drainMu.Lock()
+	defer uh.drainMu.Unlock()
+	if uh.drainTimer != nil {
+		uh.drainTimer.Stop()
+	}
+	uh.drainTimer = time.AfterFunc(timeout, uh.expireDrain)
+}
+
+// expireDrain cuts off the requests still running on uh,
+// unless it was made active again in the meantime.
+func (uh *UpstreamHost) expireDrain() {
+	uh.drainMu.Lock()
+	defer uh.drainMu.Unlock()
+	if atomic.LoadInt32(&uh.adminState) == hostActive {
+		return
+	}
+	if uh.cut == nil {
+		uh.cut = make(chan struct{})
+	}
+	select {
+	case <-uh.cut:
+		return
+	default:
+	}
+	if n := atomic.LoadInt64(&uh.Conns); n > 0 {
+		log.Printf("[WARNING] proxy: cutting off %d requests to drained host %s", n, uh.Name)
+	}
+	close(uh.cut)
+}
+
+// setState changes the admin state of uh and returns the
+// previous one. Active hosts are no longer cut off.
+func (uh *UpstreamHost) setState(state int32) int32 {
+	if state != hostActive {
+		return atomic.SwapInt32(&uh.adminState, state)
+	}
+	uh.drainMu.Lock()
+	defer uh.drainMu.Unlock()
+	if uh.drainTimer != nil {
+		uh.drainTimer.Stop()
+		uh.drainTimer = nil
+	}
+	if uh.cut != nil {
+		select {
+		case <-uh.cut:
+			uh.cut = nil
+		default:
+		}
+	}
+	return atomic.SwapInt32(&uh.adminState, state)
+}
+
+// drainRemovedHosts drains the hosts of list, the upstreams of a
+// stopping instance, that no running upstream has. On a reload,
+// these are the hosts removed from the configuration.
+func drainRemovedHosts(list []Upstream) {
+	kept := make(map[string]bool)
+	for _, u := range registeredUpstreams() {
+		for _, host := range poolOf(u) {
+			kept[host.Name] = true
+		}
+	}
+	for _, u := range list {
+		var timeout time.Duration
+		if t, ok := u.(interface{ drainTimeout() time.Duration }); ok {
+			timeout = t.drainTimeout()
+		}
+		for _, host := range poolOf(u) {
+			if kept[host.Name] {
+				continue
+			}
+			if n := atomic.LoadInt64(&host.Conns); n > 0 {
+				log.Printf("[INFO] proxy: draining host %s of upstream %s with %d requests", host.Name, u.From(), n)
+			}
+			host.drain(timeout)
+		}
+	}
+}
+
+// drainTimeout returns how long removed hosts may take to
+// finish their requests, or 0 if there is no limit.
+func (u *staticUpstream) drainTimeout() time.Duration {
+	return u.DrainTimeout
+}
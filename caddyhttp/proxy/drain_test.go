@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func TestDrainCutsOffRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	p := newRetryTestProxy(t, backend.URL, "drain_timeout 50ms")
+	host := p.Upstreams[0].(*staticUpstream).Hosts[0]
+
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		code, err := p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/bucket/key", strings.NewReader("object")))
+		done <- result{code, err}
+	}()
+	<-started
+
+	host.drain(50 * time.Millisecond)
+	if !host.Down() {
+		t.Error("Expected draining host to take no new requests")
+	}
+	select {
+	case res := <-done:
+		if res.code != http.StatusBadGateway || res.err != errHostCutOff {
+			t.Errorf("Expected request to be cut off, got %d, %v", res.code, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected request to be cut off at the drain deadline")
+	}
+}
+
+func TestDrainReactivate(t *testing.T) {
+	host := &UpstreamHost{Name: "localhost:8080"}
+	host.drain(0)
+	if !host.Down() {
+		t.Fatal("Expected host to be draining")
+	}
+	host.expireDrain()
+	if !host.cutOff() {
+		t.Fatal("Expected requests to be cut off")
+	}
+
+	if old := host.setState(hostActive); old != hostDraining {
+		t.Errorf("Expected host to have been draining, was %s", hostStates[old])
+	}
+	if host.Down() || host.cutOff() {
+		t.Error("Expected active host to take requests again")
+	}
+
+	// a host made active before its deadline is not cut off
+	host.drain(time.Hour)
+	host.setState(hostActive)
+	host.expireDrain()
+	if host.cutOff() {
+		t.Error("Expected active host not to be cut off")
+	}
+
+	// disabled hosts stay disabled
+	host.setState(hostDisabled)
+	host.drain(0)
+	if host.adminState != hostDisabled {
+		t.Errorf("Expected host to stay disabled, is %s", hostStates[host.adminState])
+	}
+}
+
+func TestDrainRemovedHosts(t *testing.T) {
+	defer isolateRegistry()()
+
+	parse := func(config string) []Upstream {
+		list, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	running := parse("proxy / localhost:8081 localhost:8082")
+	stopping := parse("proxy / localhost:8081 localhost:8083 {\n drain_timeout 1m\n}")
+	registerUpstreams(running)
+	defer unregisterUpstreams(running)
+
+	drainRemovedHosts(stopping)
+	hosts := stopping[0].(*staticUpstream).Hosts
+	if hosts[0].Down() {
+		t.Error("Expected host still in use not to be drained")
+	}
+	if !hosts[1].Down() || hosts[1].drainTimer == nil {
+		t.Error("Expected removed host to be drained with a deadline")
+	}
+	hosts[1].setState(hostActive)
+
+	for _, config := range []string{
+		"proxy / localhost:8080 {\n drain_timeout\n}",
+		"proxy / localhost:8080 {\n drain_timeout -1s\n}",
+		"proxy / localhost:8080 {\n drain_timeout soon\n}",
+	} {
+		if _, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+			t.Errorf("Expected error for %q", config)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultSourceInterval is how often a host source is checked
+// for changes unless upstream_source_interval says otherwise.
+const defaultSourceInterval = 5 * time.Second
+
+// maxHostListSize bounds the size of a host list document.
+const maxHostListSize = 1 << 20
+
+// HostSource provides the hosts of an upstream that
+// change while the server is running.
+type HostSource interface {
+	// Hosts returns the current hosts, in the same
+	// form as they are given to the proxy directive.
+	Hosts() ([]string, error)
+}
+
+var supportedSources = make(map[string]func(args []string) (HostSource, error))
+
+func init() {
+	RegisterHostSource("file", newFileHostSource)
+	RegisterHostSource("http", newHTTPHostSource)
+}
+
+// RegisterHostSource adds a custom host source to the proxy.
+// newSource is called with the arguments that follow the name
+// in the upstream_source subdirective.
+func RegisterHostSource(name string, newSource func(args []string) (HostSource, error)) {
+	supportedSources[name] = newSource
+}
+
+// dynamicUpstream is a staticUpstream whose hosts are
+// updated in place from a HostSource. Hosts that stay keep
+// their connection counts and health state; hosts that go
+// away finish the requests they are serving, up to the
+// drain timeout.
+type dynamicUpstream struct {
+	*staticUpstream
+	Source   HostSource
+	Interval time.Duration
+
+	// removed hosts that still serve requests;
+	// only touched by the watch goroutine
+	draining []*UpstreamHost
+}
+
+// watch refreshes the hosts of u every u.Interval until stop is closed.
+func (u *dynamicUpstream) watch(stop chan struct{}) {
+	ticker := time.NewTicker(u.Interval)
+	for {
+		select {
+		case <-ticker.C:
+			u.refresh()
+		case <-stop:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// refresh fetches the hosts from the source and updates u.
+// On errors, the current hosts are kept.
+func (u *dynamicUpstream) refresh() {
+	names, err := u.Source.Hosts()
+	if err == nil {
+		err = u.update(names)
+	}
+	if err != nil {
+		log.Printf("[ERROR] proxy: updating hosts of upstream %s: %v", u.from, err)
+	}
+	u.drain()
+}
+
+// update replaces the hosts of u by names, keeping the
+// UpstreamHosts of names that are already part of the pool.
+func (u *dynamicUpstream) update(names []string) error {
+	expanded, weights, err := expandHosts(names)
+	if err != nil {
+		return err
+	}
+	if len(expanded) == 0 {
+		return errors.New("refusing to remove all hosts")
+	}
+
+	current := make(map[string]*UpstreamHost)
+	for _, host := range u.pool() {
+		current[host.Name] = host
+	}
+
+	var pool HostPool
+	seen := make(map[string]bool)
+	changed := false
+	for _, name := range expanded {
+		name = hostName(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if host, ok := current[name]; ok {
+			atomic.StoreInt32(&host.Weight, weights[name])
+			pool = append(pool, host)
+			continue
+		}
+		host, err := u.NewHost(name)
+		if err != nil {
+			return err
+		}
+		host.Weight = weights[name]
+		host.healthySince = now().UnixNano()
+		log.Printf("[INFO] proxy: adding host %s to upstream %s", name, u.from)
+		pool = append(pool, host)
+		changed = true
+	}
+	for name, host := range current {
+		if !seen[name] {
+			log.Printf("[INFO] proxy: draining host %s of upstream %s", name, u.from)
+			host.drain(u.DrainTimeout)
+			u.draining = append(u.draining, host)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	u.hostsMu.Lock()
+	u.Hosts = pool
+	u.hostsMu.Unlock()
+	return nil
+}
+
+// drain releases the connections of removed
+// hosts once they no longer serve requests.
+func (u *dynamicUpstream) drain() {
+	remaining := u.draining[:0]
+	for _, host := range u.draining {
+		if atomic.LoadInt64(&host.Conns) > 0 {
+			remaining = append(remaining, host)
+			continue
+		}
+		if host.ReverseProxy != nil {
+			if t, ok := host.ReverseProxy.Transport.(interface{ CloseIdleConnections() }); ok {
+				t.CloseIdleConnections()
+			}
+		}
+	}
+	u.draining = remaining
+}
+
+// expandHosts expands the port ranges in names, which may be
+// followed by host options like in the upstream subdirective.
+// The weights are keyed by host name.
+func expandHosts(names []string) ([]string, map[string]int32, error) {
+	var hosts []string
+	weights := make(map[string]int32)
+	for _, name := range names {
+		fields := strings.Fields(name)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "srv://") || strings.HasPrefix(fields[0], "srv+https://") {
+			return nil, nil, fmt.Errorf("service locator %s is not supported by host sources", fields[0])
+		}
+		parsed, err := parseUpstream(fields[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		weight, err := parseWeight(fields[1:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", fields[0], err)
+		}
+		for _, host := range parsed {
+			weights[hostName(host)] = weight
+		}
+		hosts = append(hosts, parsed...)
+	}
+	return hosts, weights, nil
+}
+
+// parseHostList parses a JSON or YAML document that is either
+// a list of hosts or an object with such a list as "hosts".
+func parseHostList(data []byte, isYAML bool) ([]string, error) {
+	unmarshal := json.Unmarshal
+	if isYAML {
+		unmarshal = yaml.Unmarshal
+	}
+	var hosts []string
+	if err := unmarshal(data, &hosts); err == nil {
+		return hosts, nil
+	}
+	var doc struct {
+		Hosts []string `json:"hosts" yaml:"hosts"`
+	}
+	if err := unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Hosts, nil
+}
+
+// fileHostSource reads the hosts from a JSON or YAML file,
+// which is only parsed again once it was modified.
+type fileHostSource struct {
+	path    string
+	modTime time.Time
+	size    int64
+	hosts   []string
+}
+
+// upstream_source file <path>
+func newFileHostSource(args []string) (HostSource, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected a host list file")
+	}
+	return &fileHostSource{path: args[0]}, nil
+}
+
+// Hosts implements HostSource.
+func (s *fileHostSource) Hosts() ([]string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.hosts != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.hosts, nil
+	}
+	if info.Size() > maxHostListSize {
+		return nil, fmt.Errorf("%s: host list too large", s.path)
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(s.path))
+	hosts, err := parseHostList(data, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.hosts, s.modTime, s.size = hosts, info.ModTime(), info.Size()
+	return hosts, nil
+}
+
+// httpHostSource fetches the hosts from an HTTP endpoint that
+// answers with a JSON document, or YAML if its content type
+// says so.
+type httpHostSource struct {
+	url    string
+	client *http.Client
+}
+
+// upstream_source http <url> [timeout]
+func newHTTPHostSource(args []string) (HostSource, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("expected a host list URL and an optional timeout")
+	}
+	timeout := 5 * time.Second
+	if len(args) == 2 {
+		dur, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		timeout = dur
+	}
+	return &httpHostSource{url: args[0], client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Hosts implements HostSource.
+func (s *httpHostSource) Hosts() ([]string, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHostListSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseHostList(data, strings.Contains(resp.Header.Get("Content-Type"), "yaml"))
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func hostNames(pool HostPool) []string {
+	var names []string
+	for _, host := range pool {
+		names = append(names, host.Name)
+	}
+	return names
+}
+
+func TestDynamicUpstreamUpdate(t *testing.T) {
+	u := &dynamicUpstream{staticUpstream: &staticUpstream{MaxFails: 1}}
+	if err := u.update([]string{"10.0.0.1:8080", "10.0.0.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	first := u.pool()[0]
+	atomic.StoreInt64(&first.Conns, 3)
+	atomic.StoreInt32(&first.Unhealthy, 1)
+	removed := u.pool()[1]
+	atomic.StoreInt64(&removed.Conns, 1)
+
+	if err := u.update([]string{"10.0.0.1:8080 weight=4", "10.0.0.3:8081-8082", "http://10.0.0.1:8080 weight=4"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://10.0.0.1:8080", "http://10.0.0.3:8081", "http://10.0.0.3:8082"}
+	if got := hostNames(u.pool()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected hosts %v, got %v", want, got)
+	}
+	if u.pool()[0] != first {
+		t.Error("Expected remaining host to be kept")
+	}
+	if atomic.LoadInt64(&first.Conns) != 3 || atomic.LoadInt32(&first.Unhealthy) != 1 {
+		t.Error("Expected remaining host to keep its connections and health state")
+	}
+	if atomic.LoadInt32(&first.Weight) != 4 {
+		t.Errorf("Expected weight of remaining host to be updated, got %d", first.Weight)
+	}
+	if added := u.pool()[1]; added.Weight != 1 || added.healthySince == 0 {
+		t.Error("Expected added host to have the default weight and start slowly")
+	}
+
+	// removed hosts are kept until their requests are done
+	u.drain()
+	if len(u.draining) != 1 || u.draining[0] != removed {
+		t.Fatalf("Expected removed host to be draining, got %v", hostNames(u.draining))
+	}
+	atomic.StoreInt64(&removed.Conns, 0)
+	u.drain()
+	if len(u.draining) != 0 {
+		t.Errorf("Expected drained host to be released, got %v", hostNames(u.draining))
+	}
+
+	if err := u.update(nil); err == nil {
+		t.Error("Expected error for empty host list")
+	}
+	if err := u.update([]string{"srv://yig.service"}); err == nil {
+		t.Error("Expected error for service locator")
+	}
+	if err := u.update([]string{"10.0.0.1:8080 weight=-1"}); err == nil {
+		t.Error("Expected error for invalid weight")
+	}
+	if err := u.update([]string{"10.0.0.1:8080 weight=1001"}); err == nil {
+		t.Error("Expected error for weight above the maximum")
+	}
+	if len(u.pool()) != 3 {
+		t.Errorf("Expected hosts to be kept after errors, got %v", hostNames(u.pool()))
+	}
+}
+
+func TestParseHostList(t *testing.T) {
+	tests := []struct {
+		data   string
+		isYAML bool
+		hosts  []string
+		err    bool
+	}{
+		{`["a:80", "b:80"]`, false, []string{"a:80", "b:80"}, false},
+		{`{"hosts": ["a:80"]}`, false, []string{"a:80"}, false},
+		{"- a:80\n- b:80\n", true, []string{"a:80", "b:80"}, false},
+		{"hosts:\n  - a:80\n", true, []string{"a:80"}, false},
+		{`{"hosts": "a:80"}`, false, nil, true},
+		{`not json`, false, nil, true},
+	}
+	for i, test := range tests {
+		hosts, err := parseHostList([]byte(test.data), test.isYAML)
+		if test.err != (err != nil) {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(hosts, test.hosts) {
+			t.Errorf("Test %d: expected %v, got %v", i, test.hosts, hosts)
+		}
+	}
+}
+
+func TestHTTPHostSource(t *testing.T) {
+	var body atomic.Value
+	body.Store(`{"hosts": ["a:80"]}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	source, err := newHTTPHostSource([]string{server.URL, "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := source.Hosts()
+	if err != nil || !reflect.DeepEqual(hosts, []string{"a:80"}) {
+		t.Errorf("Expected [a:80], got %v, %v", hosts, err)
+	}
+
+	if _, err := newHTTPHostSource(nil); err == nil {
+		t.Error("Expected error without URL")
+	}
+	if _, err := newHTTPHostSource([]string{server.URL, "soon"}); err == nil {
+		t.Error("Expected error for invalid timeout")
+	}
+}
+
+func TestDynamicUpstreamFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_proxy_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.yaml")
+	if err := ioutil.WriteFile(path, []byte("- 10.0.0.1:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := "proxy / {\n upstream_source file " + path + "\n upstream_source_interval 10ms\n}"
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreams[0].Stop()
+	u, ok := upstreams[0].(*dynamicUpstream)
+	if !ok {
+		t.Fatalf("Expected dynamic upstream, got %T", upstreams[0])
+	}
+	if u.GetHostCount() != 1 {
+		t.Fatalf("Expected 1 host, got %v", hostNames(u.pool()))
+	}
+	first := u.pool()[0]
+
+	// make sure the modification time changes
+	later := time.Now().Add(time.Second)
+	if err := ioutil.WriteFile(path, []byte("hosts:\n  - 10.0.0.1:8080\n  - 10.0.0.2:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for u.GetHostCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected hosts to be updated, got %v", hostNames(u.pool()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if u.pool()[0] != first {
+		t.Error("Expected remaining host to be kept")
+	}
+	if host := u.Select(httptest.NewRequest("GET", "/", nil)); host == nil {
+		t.Error("Expected a host to be selected")
+	}
+}
+
+func TestNewStaticUpstreamsSourceErrors(t *testing.T) {
+	for i, config := range []string{
+		"proxy / localhost:8080 {\n upstream_source file /nonexistent\n}",
+		"proxy / {\n upstream_source file /nonexistent/hosts.json\n}",
+		"proxy / {\n upstream_source consul\n}",
+		"proxy / {\n upstream_source http\n}",
+		"proxy / {\n upstream_source_interval 0s\n}",
+	} {
+		_, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
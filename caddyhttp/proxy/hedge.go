@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+const (
+	// hedgeSamples is the number of recent response header
+	// latencies a percentile hedge delay is computed from.
+	hedgeSamples = 1000
+
+	// hedgeMinSamples is the number of latencies needed
+	// before requests are hedged with a percentile delay.
+	hedgeMinSamples = 100
+)
+
+// hedgePolicy configures the hedging of GET and HEAD requests
+// to an upstream: if a request has no response headers after
+// the delay, the same request is sent to another host, and the
+// response that arrives first is used. The delay is either
+// fixed, or the Percentile of recent latencies but at least
+// Delay.
+type hedgePolicy struct {
+	Delay      time.Duration
+	Percentile float64 // 0 for a fixed delay
+
+	mu        sync.Mutex
+	latencies [hedgeSamples]time.Duration
+	next      int
+	count     int
+	current   time.Duration
+	computed  time.Time
+}
+
+// delay returns how long to wait before hedging a request,
+// or a negative duration if requests are not to be hedged.
+func (h *hedgePolicy) delay() time.Duration {
+	if h.Percentile == 0 {
+		return h.Delay
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count < hedgeMinSamples {
+		return -1
+	}
+	if t := now(); t.Sub(h.computed) >= time.Second {
+		sorted := make([]time.Duration, h.count)
+		copy(sorted, h.latencies[:h.count])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		h.current = sorted[int(h.Percentile*float64(len(sorted)-1))]
+		h.computed = t
+	}
+	if h.current < h.Delay {
+		return h.Delay
+	}
+	return h.current
+}
+
+// observe adds a response header latency.
+func (h *hedgePolicy) observe(latency time.Duration) {
+	if h.Percentile == 0 {
+		return
+	}
+	h.mu.Lock()
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgeSamples
+	if h.count < hedgeSamples {
+		h.count++
+	}
+	h.mu.Unlock()
+}
+
+// hedgeTransport is the transport of a single request to the
+// primary host, which hedges it with a request to another host.
+type hedgeTransport struct {
+	policy   *hedgePolicy
+	upstream Upstream
+	request  *http.Request // the downstream request, to select a host for
+	primary  *UpstreamHost
+	base     http.RoundTripper // of the primary host
+	url      url.URL           // of the request before it was directed
+
+	// set by RoundTrip if a hedged request was sent,
+	// and if it answered first
+	hedged bool
+	winner *UpstreamHost
+}
+
+type hedgeResult struct {
+	res     *http.Response
+	err     error
+	host    *UpstreamHost // nil for the primary
+	latency time.Duration
+	cancel  context.CancelFunc
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	results := make(chan hedgeResult, 2)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	go func() {
+		res, err := t.base.RoundTrip(req.WithContext(ctx))
+		results <- hedgeResult{res: res, err: err, latency: time.Since(start), cancel: cancel}
+	}()
+	pending := 1
+
+	var timeout <-chan time.Time
+	if delay := t.policy.delay(); delay >= 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var primaryErr error
+	for {
+		select {
+		case <-timeout:
+			timeout = nil
+			if host := t.selectHost(); host != nil {
+				t.hedge(req, host, results)
+				t.hedged = true
+				pending++
+			}
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				result.cancel()
+				if result.host == nil {
+					primaryErr = result.err
+				}
+				if pending > 0 {
+					// the other request may still succeed
+					continue
+				}
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, result.err
+			}
+
+			t.policy.observe(result.latency)
+			if pending > 0 {
+				// cancel the slower request
+				go func() {
+					loser := <-results
+					loser.cancel()
+					if loser.res != nil {
+						loser.res.Body.Close()
+					}
+				}()
+			}
+			if result.host != nil {
+				t.winner = result.host
+				prometheus.CountHedgeWin(t.upstream.From())
+			}
+			result.res.Body = &hedgeBody{ReadCloser: result.res.Body, done: result.cancel}
+			return result.res, nil
+		}
+	}
+}
+
+// hedge sends a copy of req to host in the background, and
+// delivers the outcome to results.
+func (t *hedgeTransport) hedge(req *http.Request, host *UpstreamHost, results chan<- hedgeResult) {
+	prometheus.CountHedge(t.upstream.From())
+
+	ctx, cancel := context.WithCancel(req.Context())
+	hedged := req.WithContext(ctx)
+	// the primary request may still be reading its headers
+	hedged.Header = req.Header.Clone()
+	u := t.url
+	hedged.URL = &u
+	host.ReverseProxy.Director(hedged)
+	if hedged.URL.Scheme == "quic" {
+		hedged.URL.Scheme = "https"
+	}
+	if primaryURL, err := url.Parse(t.primary.Name); err == nil && req.Host == primaryURL.Host {
+		if hostURL, err := url.Parse(host.Name); err == nil {
+			hedged.Host = hostURL.Host
+		}
+	}
+
+	atomic.AddInt64(&host.Conns, 1)
+	start := time.Now()
+	go func() {
+		res, err := host.ReverseProxy.Transport.RoundTrip(hedged)
+		latency := time.Since(start)
+		done := func() {
+			cancel()
+			atomic.AddInt64(&host.Conns, -1)
+		}
+		// done is called by whoever receives the result
+		switch {
+		case err == context.Canceled:
+			host.cancelRequest()
+		case err != nil:
+			host.recordResponse(true, latency)
+		default:
+			host.recordResponse(res.StatusCode >= 500, latency)
+		}
+		results <- hedgeResult{res: res, err: err, host: host, latency: latency, cancel: done}
+	}()
+}
+
+// selectHost returns a host other than the primary
+// to hedge with, or nil if there is none available.
+func (t *hedgeTransport) selectHost() *UpstreamHost {
+	candidate := func(host *UpstreamHost) bool {
+		return host != nil && host != t.primary && host.ReverseProxy != nil && host.Available()
+	}
+	for i := 0; i < 3; i++ {
+		if host := t.upstream.Select(t.request); candidate(host) {
+			if host.allowRequest() {
+				return host
+			}
+		}
+	}
+
+	// hash based policies keep selecting the same host
+	u, ok := t.upstream.(interface{ pool() HostPool })
+	if !ok {
+		return nil
+	}
+	pool := u.pool()
+	if len(pool) == 0 {
+		return nil
+	}
+	offset := rand.Intn(len(pool))
+	for i := range pool {
+		host := pool[(offset+i)%len(pool)]
+		if candidate(host) && host.allowRequest() {
+			return host
+		}
+	}
+	return nil
+}
+
+// hedgeBody is the body of the winning response, which
+// releases its request once it is closed.
+type hedgeBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *hedgeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
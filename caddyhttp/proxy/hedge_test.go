@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func TestHedgeRequest(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	var fastRequests int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fastRequests, 1)
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	// first always selects the slow host first
+	p := newRetryTestProxy(t, slow.URL+" "+fast.URL, "policy first\nhedge 20ms")
+	w := httptest.NewRecorder()
+	code, err := p.ServeHTTP(w, httptest.NewRequest("GET", "/bucket/key", nil))
+	if code != 0 || err != nil {
+		t.Fatalf("Expected hedged request to succeed, got %d, %v", code, err)
+	}
+	if w.Body.String() != "fast" {
+		t.Errorf("Expected response of the hedged request, got %q", w.Body.String())
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected slower request to be canceled")
+	}
+	for _, host := range p.Upstreams[0].(*staticUpstream).pool() {
+		if n := atomic.LoadInt64(&host.Conns); n != 0 {
+			t.Errorf("Expected no connections to %s, got %d", host.Name, n)
+		}
+	}
+
+	// requests with a body are not hedged
+	atomic.StoreInt32(&fastRequests, 0)
+	p = newRetryTestProxy(t, fast.URL+" "+slow.URL, "policy first\nhedge 0s")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("PUT", "/bucket/key", strings.NewReader("object")))
+	if n := atomic.LoadInt32(&fastRequests); n != 1 || w.Body.String() != "fast" {
+		t.Errorf("Expected a single request, got %d, %q", n, w.Body.String())
+	}
+}
+
+func TestHedgeFailedRequest(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	// nothing listens on the address of a closed server
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	p := newRetryTestProxy(t, slow.URL+" "+dead.URL, "policy first\nhedge 10ms")
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		code, err := p.ServeHTTP(w, httptest.NewRequest("GET", "/bucket/key", nil))
+		if code != 0 || err != nil || w.Body.String() != "slow" {
+			t.Fatalf("Expected response of the primary, got %d, %v, %q", code, err, w.Body.String())
+		}
+	}
+	for _, host := range p.Upstreams[0].(*staticUpstream).pool() {
+		if n := atomic.LoadInt64(&host.Conns); n != 0 {
+			t.Errorf("Expected no connections to %s, got %d", host.Name, n)
+		}
+	}
+}
+
+func TestHedgePercentileDelay(t *testing.T) {
+	defer setNow(time.Unix(1500000000, 0))()
+	h := &hedgePolicy{Delay: 5 * time.Millisecond, Percentile: 0.9}
+
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.delay(); d >= 0 {
+		t.Errorf("Expected no hedging before %d samples, got %v", hedgeMinSamples, d)
+	}
+	h.observe(hedgeMinSamples * time.Millisecond)
+	if d := h.delay(); d != 90*time.Millisecond {
+		t.Errorf("Expected delay of 90ms, got %v", d)
+	}
+
+	// the delay is recomputed at most once a second,
+	// and never drops below the minimum
+	for i := 0; i < hedgeSamples; i++ {
+		h.observe(time.Millisecond)
+	}
+	if d := h.delay(); d != 90*time.Millisecond {
+		t.Errorf("Expected delay to be kept, got %v", d)
+	}
+	defer setNow(time.Unix(1500000001, 0))()
+	if d := h.delay(); d != 5*time.Millisecond {
+		t.Errorf("Expected minimum delay, got %v", d)
+	}
+}
+
+func TestParseBlockHedge(t *testing.T) {
+	tests := []struct {
+		config     string
+		delay      time.Duration
+		percentile float64
+	}{
+		{"hedge 50ms", 50 * time.Millisecond, 0},
+		{"hedge p95", 10 * time.Millisecond, 0.95},
+		{"hedge p99 20ms", 20 * time.Millisecond, 0.99},
+	}
+	for i, test := range tests {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(test.config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+		if u.Hedge == nil {
+			t.Fatalf("Test %d: expected hedging to be enabled", i)
+		}
+		if u.Hedge.Delay != test.delay || u.Hedge.Percentile != test.percentile {
+			t.Errorf("Test %d: expected delay %v and percentile %v, got %v and %v",
+				i, test.delay, test.percentile, u.Hedge.Delay, u.Hedge.Percentile)
+		}
+	}
+
+	for i, config := range []string{
+		"hedge",
+		"hedge soon",
+		"hedge 50ms 10ms",
+		"hedge p100",
+		"hedge p95 -1s",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
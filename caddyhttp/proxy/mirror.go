@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+const (
+	// maxMirrorRequests bounds the number of mirrored requests
+	// in flight per upstream; requests beyond are not mirrored.
+	maxMirrorRequests = 100
+
+	// mirrorTimeout bounds the duration of a mirrored request.
+	mirrorTimeout = 30 * time.Second
+)
+
+// mirrorPolicy copies some of the requests to an upstream to a
+// shadow host, once their own response is served. The responses
+// of the shadow host are discarded, but their status and latency
+// are compared with those of the upstream.
+type mirrorPolicy struct {
+	URL              *url.URL
+	Percent          float64 // of the matching requests
+	Methods          map[string]bool
+	Paths            []string        // path prefixes; all paths if empty
+	Buckets          map[string]bool // all buckets if empty
+	MaxBody          int64
+	LatencyThreshold time.Duration // differences above are logged; 0 for none
+
+	from    string
+	proxy   *ReverseProxy
+	pending chan struct{}
+}
+
+func newMirrorPolicy() *mirrorPolicy {
+	return &mirrorPolicy{
+		Percent:          100,
+		Methods:          map[string]bool{"GET": true, "HEAD": true},
+		MaxBody:          1 << 20,
+		LatencyThreshold: time.Second,
+	}
+}
+
+// selects reports whether r is to be mirrored.
+func (m *mirrorPolicy) selects(r *http.Request) bool {
+	if !m.Methods[r.Method] || r.ContentLength < 0 || r.ContentLength > m.MaxBody {
+		return false
+	}
+	if len(m.Paths) > 0 {
+		matches := false
+		for _, prefix := range m.Paths {
+			if httpserver.Path(r.URL.Path).Matches(prefix) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return false
+		}
+	}
+	if len(m.Buckets) > 0 {
+		s3req := httpserver.GetS3Request(r)
+		if s3req == nil {
+			s3req = httpserver.ParseS3Request(r, nil)
+		}
+		if !m.Buckets[s3req.Bucket] {
+			return false
+		}
+	}
+	return m.Percent >= 100 || rand.Float64()*100 < m.Percent
+}
+
+// capture copies outreq, which is about to be sent to primary.
+func (m *mirrorPolicy) capture(outreq *http.Request, primary *UpstreamHost) *mirroredRequest {
+	mr := &mirroredRequest{
+		policy: m,
+		method: outreq.Method,
+		url:    *outreq.URL,
+		header: make(http.Header, len(outreq.Header)),
+		host:   outreq.Host,
+	}
+	for key, values := range outreq.Header {
+		mr.header[key] = append([]string(nil), values...)
+	}
+	if primaryURL, err := url.Parse(primary.Name); err == nil && outreq.Host == primaryURL.Host {
+		mr.host = m.URL.Host
+	}
+	if bb, ok := outreq.Body.(*bufferedBody); ok {
+		bb.rewind()
+		mr.body, _ = ioutil.ReadAll(bb)
+	}
+	return mr
+}
+
+// mirroredRequest is a request to be sent to the shadow host.
+type mirroredRequest struct {
+	policy *mirrorPolicy
+	method string
+	url    url.URL
+	header http.Header
+	host   string
+	body   []byte
+}
+
+// send sends mr to the shadow host in the background, and compares
+// the response with the status and latency of the upstream's one.
+func (mr *mirroredRequest) send(status int, latency time.Duration) {
+	m := mr.policy
+	select {
+	case m.pending <- struct{}{}:
+	default:
+		prometheus.CountMirror(m.from, "dropped")
+		return
+	}
+	go func() {
+		defer func() { <-m.pending }()
+		shadowStatus, shadowLatency, err := mr.roundTrip()
+		m.compare(mr, status, latency, shadowStatus, shadowLatency, err)
+	}()
+}
+
+// roundTrip sends mr to the shadow host and returns the
+// status of the response and how long it took to arrive.
+func (mr *mirroredRequest) roundTrip() (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+
+	u := mr.url
+	req := (&http.Request{
+		Method:     mr.method,
+		URL:        &u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     mr.header,
+		Host:       mr.host,
+	}).WithContext(ctx)
+	if len(mr.body) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(mr.body))
+		req.ContentLength = int64(len(mr.body))
+	}
+	mr.policy.proxy.Director(req)
+	if req.URL.Scheme == "quic" {
+		req.URL.Scheme = "https"
+	}
+
+	start := time.Now()
+	res, err := mr.policy.proxy.Transport.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		return 0, latency, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, latency, nil
+}
+
+// compare logs and counts the differences between the response
+// of the upstream and that of the shadow host.
+func (m *mirrorPolicy) compare(mr *mirroredRequest, status int, latency time.Duration, shadowStatus int, shadowLatency time.Duration, err error) {
+	switch {
+	case err != nil:
+		prometheus.CountMirror(m.from, "error")
+		log.Printf("[WARNING] proxy: mirroring %s %s to %s: %v", mr.method, mr.url.Path, m.URL.Host, err)
+		return
+	case shadowStatus != status:
+		prometheus.CountMirror(m.from, "status_mismatch")
+		log.Printf("[WARNING] proxy: mirror %s answered %s %s with %d instead of %d",
+			m.URL.Host, mr.method, mr.url.Path, shadowStatus, status)
+	default:
+		prometheus.CountMirror(m.from, "match")
+	}
+	prometheus.ObserveMirrorLatency(m.from, latency, shadowLatency)
+
+	diff := shadowLatency - latency
+	if diff < 0 {
+		diff = -diff
+	}
+	if m.LatencyThreshold > 0 && diff > m.LatencyThreshold {
+		log.Printf("[INFO] proxy: mirror %s answered %s %s in %v instead of %v",
+			m.URL.Host, mr.method, mr.url.Path, shadowLatency, latency)
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+type shadowRequest struct {
+	method, path, body string
+}
+
+func TestMirrorRequests(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	mirrored := make(chan shadowRequest, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- shadowRequest{r.Method, r.URL.Path, string(body)}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	p := newRetryTestProxy(t, primary.URL, "mirror "+shadow.URL+"\nmirror_methods GET PUT\nmirror_paths /bucket\nmirror_max_body 16")
+	for _, test := range []struct {
+		method, path, body string
+		mirrored           bool
+	}{
+		{"GET", "/bucket/key", "", true},
+		{"PUT", "/bucket/key", "object", true},
+		{"PUT", "/bucket/key", "an object too large to mirror", false},
+		{"DELETE", "/bucket/key", "", false},
+		{"GET", "/other/key", "", false},
+	} {
+		w := httptest.NewRecorder()
+		var body io.Reader
+		if test.body != "" {
+			body = strings.NewReader(test.body)
+		}
+		code, err := p.ServeHTTP(w, httptest.NewRequest(test.method, test.path, body))
+		if code != 0 || err != nil || w.Body.String() != "primary" {
+			t.Fatalf("%s %s: expected response of the primary, got %d, %v, %q", test.method, test.path, code, err, w.Body.String())
+		}
+
+		select {
+		case got := <-mirrored:
+			if !test.mirrored {
+				t.Errorf("%s %s: expected request not to be mirrored", test.method, test.path)
+			} else if got != (shadowRequest{test.method, test.path, test.body}) {
+				t.Errorf("%s %s: unexpected mirrored request %+v", test.method, test.path, got)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if test.mirrored {
+				t.Errorf("%s %s: expected request to be mirrored", test.method, test.path)
+			}
+		}
+	}
+}
+
+func TestMirrorUnavailable(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	shadow.Close()
+
+	p := newRetryTestProxy(t, primary.URL, "mirror "+shadow.URL)
+	w := httptest.NewRecorder()
+	code, err := p.ServeHTTP(w, httptest.NewRequest("GET", "/bucket/key", nil))
+	if code != 0 || err != nil || w.Body.String() != "primary" {
+		t.Errorf("Expected mirror failures not to affect the response, got %d, %v, %q", code, err, w.Body.String())
+	}
+}
+
+func TestMirrorSelects(t *testing.T) {
+	m := newMirrorPolicy()
+	m.Buckets = map[string]bool{"logs": true}
+	if !m.selects(httptest.NewRequest("GET", "/logs/2018/01", nil)) {
+		t.Error("Expected request to bucket logs to be mirrored")
+	}
+	if m.selects(httptest.NewRequest("GET", "/images/cat.png", nil)) {
+		t.Error("Expected request to other bucket not to be mirrored")
+	}
+
+	chunked := httptest.NewRequest("GET", "/logs/2018/01", strings.NewReader("data"))
+	chunked.ContentLength = -1
+	if m.selects(chunked) {
+		t.Error("Expected request of unknown length not to be mirrored")
+	}
+
+	m = newMirrorPolicy()
+	m.Percent = 10
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		if m.selects(httptest.NewRequest("GET", "/", nil)) {
+			selected++
+		}
+	}
+	if selected < 50 || selected > 150 {
+		t.Errorf("Expected about 10%% of requests to be mirrored, got %d of 1000", selected)
+	}
+}
+
+func TestParseBlockMirror(t *testing.T) {
+	config := `mirror 10.0.0.9:8080
+	mirror_percent 5%
+	mirror_methods get head
+	mirror_paths /a /b
+	mirror_buckets logs
+	mirror_max_body 0
+	mirror_latency_threshold 500ms`
+
+	u := staticUpstream{}
+	c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+	for c.Next() {
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	m := u.Mirror
+	if m == nil {
+		t.Fatal("Expected mirroring to be enabled")
+	}
+	if m.URL.String() != "http://10.0.0.9:8080" || m.Percent != 5 || len(m.Methods) != 2 || !m.Methods["HEAD"] ||
+		len(m.Paths) != 2 || !m.Buckets["logs"] || m.MaxBody != 0 || m.LatencyThreshold != 500*time.Millisecond {
+		t.Errorf("Unexpected mirror policy %+v", m)
+	}
+
+	for i, config := range []string{
+		"mirror",
+		"mirror srv://yig.service",
+		"mirror_percent 0",
+		"mirror_percent 120%",
+		"mirror_methods",
+		"mirror_max_body 1MB",
+		"mirror_latency_threshold -1s",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+
+	config = "proxy / localhost:8080 {\n mirror_percent 10\n}"
+	if _, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), ""); err == nil {
+		t.Error("Expected error for mirror settings without mirror host")
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+const (
+	// outlierBuckets is the number of parts the sliding window is
+	// split into; hosts are evaluated once per part.
+	outlierBuckets = 10
+
+	// maxLatencySamples caps the latencies kept per part.
+	maxLatencySamples = 512
+)
+
+// outlierDetector passively ejects hosts from the pool of an upstream
+// for a while if the responses they serve to proxied requests have
+// too high an error ratio or too high latency over a sliding window.
+type outlierDetector struct {
+	Window            time.Duration // length of the sliding window
+	MinRequests       int           // requests in the window before a host is judged
+	ErrorRatio        float64       // ratio of 5xx responses and errors that ejects; 0 disables
+	Percentile        float64       // latency percentile that is compared to MaxLatency
+	MaxLatency        time.Duration // latency that ejects; 0 disables
+	BaseEjectionTime  time.Duration // first ejection; every further one lasts longer
+	MaxEjectionTime   time.Duration
+	MaxEjectedPercent int // how much of the pool may be ejected at once
+
+	upstream *staticUpstream
+	mu       sync.Mutex // serializes ejections
+}
+
+func newOutlierDetector(u *staticUpstream) *outlierDetector {
+	return &outlierDetector{
+		Window:            30 * time.Second,
+		MinRequests:       20,
+		Percentile:        0.99,
+		BaseEjectionTime:  30 * time.Second,
+		MaxEjectionTime:   5 * time.Minute,
+		MaxEjectedPercent: 50,
+		upstream:          u,
+	}
+}
+
+// hostStats are the responses of a host over the sliding window.
+type hostStats struct {
+	detector *outlierDetector
+
+	mu        sync.Mutex
+	buckets   [outlierBuckets]statsBucket
+	current   int
+	ejections int       // consecutive ejections
+	lastEnd   time.Time // end of the last ejection
+}
+
+type statsBucket struct {
+	start     time.Time
+	requests  int
+	errors    int
+	latencies []time.Duration
+}
+
+// record adds a response of host to its stats and ejects the
+// host if the stats of the window cross one of the thresholds.
+func (d *outlierDetector) record(host *UpstreamHost, failed bool, latency time.Duration) {
+	stats := host.outlierStats
+	t := now()
+	bucketLength := d.Window / outlierBuckets
+
+	stats.mu.Lock()
+	b := &stats.buckets[stats.current]
+	rotated := false
+	if t.Sub(b.start) >= bucketLength {
+		stats.current = (stats.current + 1) % outlierBuckets
+		b = &stats.buckets[stats.current]
+		*b = statsBucket{start: t, latencies: b.latencies[:0]}
+		rotated = true
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	if len(b.latencies) < maxLatencySamples {
+		b.latencies = append(b.latencies, latency)
+	} else {
+		b.latencies[b.requests%maxLatencySamples] = latency
+	}
+
+	eject := false
+	if rotated {
+		eject = d.outlying(stats, t)
+	}
+	stats.mu.Unlock()
+
+	if eject {
+		d.eject(host, t)
+	}
+}
+
+// outlying reports whether the stats of the window cross one
+// of the thresholds. stats.mu must be held.
+func (d *outlierDetector) outlying(stats *hostStats, t time.Time) bool {
+	var requests, errors int
+	var latencies []time.Duration
+	for i := range stats.buckets {
+		b := &stats.buckets[i]
+		if t.Sub(b.start) > d.Window {
+			continue
+		}
+		requests += b.requests
+		errors += b.errors
+		latencies = append(latencies, b.latencies...)
+	}
+	if requests == 0 || requests < d.MinRequests {
+		return false
+	}
+
+	if d.ErrorRatio > 0 && float64(errors)/float64(requests) >= d.ErrorRatio {
+		return true
+	}
+	if d.MaxLatency > 0 && len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		i := int(d.Percentile*float64(len(latencies))+0.5) - 1
+		if i < 0 {
+			i = 0
+		} else if i >= len(latencies) {
+			i = len(latencies) - 1
+		}
+		if latencies[i] > d.MaxLatency {
+			return true
+		}
+	}
+	return false
+}
+
+// eject ejects host, unless that would eject more than
+// MaxEjectedPercent of the pool.
+func (d *outlierDetector) eject(host *UpstreamHost, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if host.ejected() {
+		return
+	}
+	ejected := 1
+	pool := d.upstream.pool()
+	for _, other := range pool {
+		if other != host && other.ejected() {
+			ejected++
+		}
+	}
+	if ejected*100 > d.MaxEjectedPercent*len(pool) {
+		return
+	}
+
+	stats := host.outlierStats
+	stats.mu.Lock()
+	// a host that behaved for a while starts over
+	if t.Sub(stats.lastEnd) > d.MaxEjectionTime {
+		stats.ejections = 0
+	}
+	stats.ejections++
+	duration := d.BaseEjectionTime * time.Duration(stats.ejections)
+	if duration > d.MaxEjectionTime {
+		duration = d.MaxEjectionTime
+	}
+	stats.lastEnd = t.Add(duration)
+	// judge the host afresh once it is back
+	for i := range stats.buckets {
+		stats.buckets[i] = statsBucket{}
+	}
+	stats.mu.Unlock()
+
+	atomic.StoreInt64(&host.ejectedUntil, t.Add(duration).UnixNano())
+	// the host starts slowly once it is back
+	atomic.StoreInt64(&host.healthySince, t.Add(duration).UnixNano())
+	prometheus.SetUpstreamEjected(host.Name, true)
+	time.AfterFunc(duration, func() {
+		prometheus.SetUpstreamEjected(host.Name, false)
+	})
+}
+
+// ejected reports whether the outlier detection ejected uh.
+func (uh *UpstreamHost) ejected() bool {
+	until := atomic.LoadInt64(&uh.ejectedUntil)
+	return until != 0 && now().UnixNano() < until
+}
+
+// now is time.Now; it is a variable so tests can change the clock.
+var now = time.Now
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func setNow(t time.Time) func() {
+	old := now
+	now = func() time.Time { return t }
+	return func() { now = old }
+}
+
+func newOutlierTestUpstream(hosts int) *staticUpstream {
+	u := &staticUpstream{MaxFails: 1}
+	d := u.outlier()
+	d.Window = 10 * time.Second
+	d.MinRequests = 10
+	d.ErrorRatio = 0.5
+	d.BaseEjectionTime = 30 * time.Second
+	d.MaxEjectionTime = 50 * time.Second
+	for i := 0; i < hosts; i++ {
+		uh, _ := u.NewHost("localhost")
+		u.Hosts = append(u.Hosts, uh)
+	}
+	return u
+}
+
+// feed records n responses of host, one every 100ms from start,
+// and returns the time after the last one.
+func feed(host *UpstreamHost, start time.Time, n int, failed bool, latency time.Duration) time.Time {
+	t := start
+	for i := 0; i < n; i++ {
+		restore := setNow(t)
+		host.recordResponse(failed, latency)
+		restore()
+		t = t.Add(100 * time.Millisecond)
+	}
+	return t
+}
+
+func TestOutlierErrorRatio(t *testing.T) {
+	u := newOutlierTestUpstream(2)
+	host := u.Hosts[0]
+	start := time.Now()
+
+	// too few requests to judge
+	tm := feed(host, start, 5, true, time.Millisecond)
+	defer setNow(tm)()
+	if host.Down() {
+		t.Fatal("Expected host with too few requests not to be ejected")
+	}
+
+	// mostly successful
+	tm = feed(host, tm, 30, false, time.Millisecond)
+	if host.ejected() {
+		t.Fatal("Expected healthy host not to be ejected")
+	}
+
+	tm = feed(host, tm, 40, true, time.Millisecond)
+	defer setNow(tm)()
+	if !host.Down() {
+		t.Fatal("Expected host serving errors to be ejected")
+	}
+	if u.Hosts[1].Down() {
+		t.Error("Expected other host not to be ejected")
+	}
+	if atomic.LoadInt64(&host.healthySince) != atomic.LoadInt64(&host.ejectedUntil) {
+		t.Error("Expected host to start slowly once its ejection ends")
+	}
+
+	// ejection ends after the base ejection time
+	defer setNow(tm.Add(31 * time.Second))()
+	if host.Down() {
+		t.Error("Expected ejection to have ended")
+	}
+
+	// the next ejection lasts longer, up to the maximum
+	tm = feed(host, tm.Add(31*time.Second), 40, true, time.Millisecond)
+	defer setNow(tm.Add(45 * time.Second))()
+	if !host.Down() {
+		t.Error("Expected second ejection to last longer")
+	}
+	defer setNow(tm.Add(51 * time.Second))()
+	if host.Down() {
+		t.Error("Expected ejection time to be capped")
+	}
+}
+
+func TestOutlierLatency(t *testing.T) {
+	u := newOutlierTestUpstream(2)
+	u.Outlier.ErrorRatio = 0
+	u.Outlier.Percentile = 0.9
+	u.Outlier.MaxLatency = 100 * time.Millisecond
+	host := u.Hosts[0]
+	start := time.Now()
+
+	tm := feed(host, start, 18, false, 10*time.Millisecond)
+	tm = feed(host, tm, 1, false, time.Second)
+	defer setNow(tm)()
+	if host.ejected() {
+		t.Fatal("Expected host with few slow responses not to be ejected")
+	}
+
+	tm = feed(host, tm, 20, false, time.Second)
+	defer setNow(tm)()
+	if !host.ejected() {
+		t.Fatal("Expected slow host to be ejected")
+	}
+}
+
+func TestOutlierMaxEjectedPercent(t *testing.T) {
+	u := newOutlierTestUpstream(4)
+	start := time.Now()
+
+	for _, host := range u.Hosts {
+		feed(host, start, 40, true, time.Millisecond)
+	}
+	defer setNow(start.Add(4 * time.Second))()
+
+	ejected := 0
+	for _, host := range u.Hosts {
+		if host.ejected() {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("Expected half of the pool to be ejected, got %d of %d", ejected, len(u.Hosts))
+	}
+}
+
+func TestOutlierProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	config := "proxy / " + backend.URL + ` {
+		outlier_window 100ms
+		outlier_min_requests 5
+		outlier_error_ratio 0.5
+		outlier_max_ejected 100%
+	}`
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{Upstreams: upstreams}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !upstreams[0].(*staticUpstream).Hosts[0].ejected() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected backend answering 503 to be ejected")
+		}
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	code, _ := p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if code != http.StatusBadGateway {
+		t.Errorf("Expected %d while the only host is ejected, got %d", http.StatusBadGateway, code)
+	}
+}
+
+func TestParseBlockOutlier(t *testing.T) {
+	config := `outlier_window 1m
+	outlier_min_requests 50
+	outlier_error_ratio 0.2
+	outlier_latency p99 2s
+	outlier_ejection_time 10s 2m
+	outlier_max_ejected 30%`
+
+	u := staticUpstream{}
+	c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+	for c.Next() {
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	d := u.Outlier
+	if d == nil {
+		t.Fatal("Expected outlier detection to be enabled")
+	}
+	if d.Window != time.Minute || d.MinRequests != 50 || d.ErrorRatio != 0.2 ||
+		d.Percentile != 0.99 || d.MaxLatency != 2*time.Second ||
+		d.BaseEjectionTime != 10*time.Second || d.MaxEjectionTime != 2*time.Minute ||
+		d.MaxEjectedPercent != 30 {
+		t.Errorf("Unexpected outlier detector %+v", d)
+	}
+
+	for i, config := range []string{
+		"outlier_window 1ms",
+		"outlier_min_requests 0",
+		"outlier_error_ratio 2",
+		"outlier_latency 99",
+		"outlier_latency p0 1s",
+		"outlier_ejection_time 1m 10s",
+		"outlier_max_ejected 150%",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+
+	_, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile",
+		strings.NewReader("proxy / localhost:8080 {\n outlier_window 1m\n}")), "")
+	if err == nil {
+		t.Error("Expected error for outlier detection without thresholds")
+	}
+}
@@ -20,7 +20,14 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
 )
 
 // HostPool is a collection of UpstreamHosts.
@@ -39,6 +46,9 @@ func init() {
 	RegisterPolicy("first", func(arg string) Policy { return &First{} })
 	RegisterPolicy("uri_hash", func(arg string) Policy { return &URIHash{} })
 	RegisterPolicy("header", func(arg string) Policy { return &Header{arg} })
+	RegisterPolicy("weighted_round_robin", func(arg string) Policy { return &WeightedRoundRobin{} })
+	RegisterPolicy("weighted_least_conn", func(arg string) Policy { return &WeightedLeastConn{} })
+	RegisterPolicy("consistent_hash", func(arg string) Policy { return NewConsistentHash(arg) })
 }
 
 // Random is a policy that selects up hosts from a pool at random.
@@ -197,3 +207,314 @@ func (r *Header) Select(pool HostPool, request *http.Request) *UpstreamHost {
 	}
 	return hostByHashing(pool, val)
 }
+
+// slowStartMinFactor is the share of its weight a host
+// gets right after it became healthy with slow start.
+const slowStartMinFactor = 0.1
+
+// effectiveWeight returns the weight of uh, reduced while
+// it ramps up after becoming healthy if slow start is enabled.
+func (uh *UpstreamHost) effectiveWeight() float64 {
+	weight := float64(atomic.LoadInt32(&uh.Weight))
+	if weight < 1 {
+		weight = 1
+	}
+	since := atomic.LoadInt64(&uh.healthySince)
+	if uh.SlowStart <= 0 || since == 0 {
+		return weight
+	}
+	elapsed := now().Sub(time.Unix(0, since))
+	if elapsed >= uh.SlowStart {
+		return weight
+	}
+	factor := float64(elapsed) / float64(uh.SlowStart)
+	if factor < slowStartMinFactor {
+		factor = slowStartMinFactor
+	}
+	return weight * factor
+}
+
+// isWeighted reports whether policy takes the weights of hosts into account.
+func isWeighted(policy Policy) bool {
+	switch policy.(type) {
+	case *WeightedRoundRobin, *WeightedLeastConn:
+		return true
+	}
+	return false
+}
+
+// WeightedRoundRobin is a policy that selects hosts in turn, each in
+// proportion to its weight. It uses the smooth weighted round-robin
+// algorithm of nginx, which spreads the turns of a host evenly.
+type WeightedRoundRobin struct {
+	mutex   sync.Mutex
+	current map[*UpstreamHost]float64
+}
+
+// Select selects an up host from the pool using a weighted round-robin
+// ordering scheme.
+func (r *WeightedRoundRobin) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current == nil || len(r.current) > len(pool) {
+		// start over when hosts went away
+		r.current = make(map[*UpstreamHost]float64, len(pool))
+	}
+
+	var best *UpstreamHost
+	total := 0.0
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		weight := host.effectiveWeight()
+		r.current[host] += weight
+		total += weight
+		if best == nil || r.current[host] > r.current[best] {
+			best = host
+		}
+	}
+	if best != nil {
+		r.current[best] -= total
+	}
+	return best
+}
+
+// WeightedLeastConn is a policy that selects the host with the least
+// connections relative to its weight.
+type WeightedLeastConn struct{}
+
+// Select selects the up host with the lowest number of connections per
+// weight, counting the request to be made. If more than one host has
+// the same lowest ratio, one of the hosts is chosen at random.
+func (r *WeightedLeastConn) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	var bestHost *UpstreamHost
+	count := 0
+	leastLoad := math.Inf(1)
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+
+		load := float64(atomic.LoadInt64(&host.Conns)+1) / host.effectiveWeight()
+		if load < leastLoad {
+			leastLoad = load
+			count = 0
+		}
+
+		// Among hosts with same least load, perform a reservoir
+		// sample: https://en.wikipedia.org/wiki/Reservoir_sampling
+		if load == leastLoad {
+			count++
+			if (rand.Int() % count) == 0 {
+				bestHost = host
+			}
+		}
+	}
+	return bestHost
+}
+
+const (
+	// ringReplicas is the number of points a host
+	// of weight 1 gets on a consistent hash ring.
+	ringReplicas = 100
+
+	// defaultHashLoadFactor is how far above the average
+	// load a host may go before consistent hashing moves
+	// requests on to the next host.
+	defaultHashLoadFactor = 1.25
+)
+
+// ConsistentHash is a policy that maps requests to hosts with a
+// consistent hash ring, so that changes to the pool only move the
+// keys of the hosts that were added or removed. With bounded load,
+// a host takes no more than LoadFactor times the average number of
+// connections; further requests for its keys spill over to the next
+// hosts on the ring.
+type ConsistentHash struct {
+	// Key is what requests are hashed by: bucket, bucket_key,
+	// uri, ip or header:<name>.
+	Key string
+	// LoadFactor bounds the load of a host relative to the
+	// average; 0 disables bounded load.
+	LoadFactor float64
+
+	mutex sync.Mutex
+	ring  *hashRing
+}
+
+// NewConsistentHash returns a ConsistentHash policy for key, which
+// defaults to the bucket.
+func NewConsistentHash(key string) *ConsistentHash {
+	if key == "" {
+		key = "bucket"
+	}
+	return &ConsistentHash{Key: key, LoadFactor: defaultHashLoadFactor}
+}
+
+// validHashKey reports whether key is a valid ConsistentHash key.
+func validHashKey(key string) bool {
+	switch key {
+	case "bucket", "bucket_key", "uri", "ip":
+		return true
+	}
+	return strings.HasPrefix(key, "header:") && len(key) > len("header:")
+}
+
+// hashKey returns the value request is hashed by.
+func (r *ConsistentHash) hashKey(request *http.Request) string {
+	switch r.Key {
+	case "bucket", "bucket_key":
+		s3req := httpserver.GetS3Request(request)
+		if s3req == nil {
+			// without s3endpoint, all requests are path style
+			s3req = httpserver.ParseS3Request(request, nil)
+		}
+		if r.Key == "bucket_key" && s3req.Key != "" {
+			return s3req.Bucket + "/" + s3req.Key
+		}
+		return s3req.Bucket
+	case "uri":
+		return request.RequestURI
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			clientIP = request.RemoteAddr
+		}
+		return clientIP
+	}
+	return request.Header.Get(strings.TrimPrefix(r.Key, "header:"))
+}
+
+// Select selects the first host on the ring at or after the hash of
+// the request key that is available and not loaded above the bound.
+func (r *ConsistentHash) Select(pool HostPool, request *http.Request) *UpstreamHost {
+	ring := r.ringFor(pool)
+
+	available := 0
+	var total int64
+	for _, host := range pool {
+		if host.Available() {
+			available++
+			total += atomic.LoadInt64(&host.Conns)
+		}
+	}
+	if available == 0 {
+		return nil
+	}
+	capacity := int64(math.MaxInt64)
+	if r.LoadFactor > 0 {
+		capacity = int64(math.Ceil(r.LoadFactor * float64(total+1) / float64(available)))
+	}
+
+	var fallback *UpstreamHost
+	checked := make(map[*UpstreamHost]bool, available)
+	start := ring.search(hash64(r.hashKey(request)))
+	for i := 0; i < len(ring.points) && len(checked) < len(pool); i++ {
+		host := ring.points[(start+i)%len(ring.points)].host
+		if checked[host] {
+			continue
+		}
+		checked[host] = true
+		if !host.Available() {
+			continue
+		}
+		if atomic.LoadInt64(&host.Conns)+1 <= capacity {
+			return host
+		}
+		if fallback == nil {
+			fallback = host
+		}
+	}
+	return fallback
+}
+
+// ringFor returns the hash ring of pool, building
+// it again if the hosts or their weights changed.
+func (r *ConsistentHash) ringFor(pool HostPool) *hashRing {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ring == nil || !r.ring.matches(pool) {
+		r.ring = newHashRing(pool)
+	}
+	return r.ring
+}
+
+// hashRing is an immutable consistent hash ring of hosts.
+type hashRing struct {
+	hosts   HostPool
+	weights []int32
+	points  []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash uint64
+	host *UpstreamHost
+}
+
+func newHashRing(pool HostPool) *hashRing {
+	ring := &hashRing{
+		hosts:   append(HostPool(nil), pool...),
+		weights: make([]int32, len(pool)),
+	}
+	for i, host := range pool {
+		weight := atomic.LoadInt32(&host.Weight)
+		if weight < 1 {
+			weight = 1
+		}
+		ring.weights[i] = weight
+		for j := 0; j < ringReplicas*int(weight); j++ {
+			ring.points = append(ring.points, ringPoint{
+				hash: hash64(host.Name + "#" + strconv.Itoa(j)),
+				host: host,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// matches reports whether ring was built for pool as it is now.
+func (ring *hashRing) matches(pool HostPool) bool {
+	if len(pool) != len(ring.hosts) {
+		return false
+	}
+	for i, host := range pool {
+		weight := atomic.LoadInt32(&host.Weight)
+		if weight < 1 {
+			weight = 1
+		}
+		if host != ring.hosts[i] || weight != ring.weights[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// search returns the index of the first point at or after h.
+func (ring *hashRing) search(h uint64) int {
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= h
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	return i
+}
+
+// hash64 calculates a 64-bit hash of s. FNV alone spreads similar
+// strings like the points of a host poorly over the ring, so its
+// result is mixed with the finalizer of MurmurHash3.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
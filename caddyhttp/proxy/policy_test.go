@@ -18,7 +18,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 var workableServer *httptest.Server
@@ -359,3 +361,176 @@ func TestHeaderPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestWeightedRoundRobinPolicy(t *testing.T) {
+	pool := testPool()
+	pool[0].Weight = 5
+	pool[1].Weight = 1
+	pool[2].Weight = 2
+	rrPolicy := &WeightedRoundRobin{}
+	request, _ := http.NewRequest("GET", "/", nil)
+
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < 80; i++ {
+		counts[rrPolicy.Select(pool, request)]++
+	}
+	if counts[pool[0]] != 50 || counts[pool[1]] != 10 || counts[pool[2]] != 20 {
+		t.Errorf("Expected hosts to be selected 50, 10 and 20 times, got %d, %d and %d",
+			counts[pool[0]], counts[pool[1]], counts[pool[2]])
+	}
+
+	// turns are spread instead of handed out in a row
+	pool[0].Weight = 1
+	pool[2].Weight = 1
+	rrPolicy = &WeightedRoundRobin{}
+	first := rrPolicy.Select(pool, request)
+	if second := rrPolicy.Select(pool, request); second == first {
+		t.Error("Expected equally weighted hosts to take turns")
+	}
+
+	pool[1].Unhealthy = 1
+	pool[2].Unhealthy = 1
+	for i := 0; i < 3; i++ {
+		if h := rrPolicy.Select(pool, request); h != pool[0] {
+			t.Error("Expected only healthy host to be selected")
+		}
+	}
+}
+
+func TestWeightedLeastConnPolicy(t *testing.T) {
+	pool := testPool()
+	pool[0].Weight = 4
+	pool[1].Weight = 1
+	pool[2].Weight = 1
+	lcPolicy := &WeightedLeastConn{}
+	request, _ := http.NewRequest("GET", "/", nil)
+
+	pool[0].Conns = 6
+	pool[1].Conns = 2
+	pool[2].Conns = 2
+	if h := lcPolicy.Select(pool, request); h != pool[0] {
+		t.Error("Expected heavier host with more connections to be selected.")
+	}
+	pool[0].Conns = 12
+	h := lcPolicy.Select(pool, request)
+	if h != pool[1] && h != pool[2] {
+		t.Error("Expected second or third host to be selected.")
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	start := time.Now()
+	defer setNow(start)()
+	host := &UpstreamHost{Weight: 10, SlowStart: 10 * time.Second}
+	if w := host.effectiveWeight(); w != 10 {
+		t.Errorf("Expected full weight for host that was never down, got %v", w)
+	}
+
+	host.healthySince = start.UnixNano()
+	if w := host.effectiveWeight(); w != 1 {
+		t.Errorf("Expected minimum weight right after recovery, got %v", w)
+	}
+	defer setNow(start.Add(5 * time.Second))()
+	if w := host.effectiveWeight(); w != 5 {
+		t.Errorf("Expected half the weight half way, got %v", w)
+	}
+	defer setNow(start.Add(time.Minute))()
+	if w := host.effectiveWeight(); w != 10 {
+		t.Errorf("Expected full weight after slow start, got %v", w)
+	}
+}
+
+func newHashTestPool(n int) HostPool {
+	var pool HostPool
+	for i := 0; i < n; i++ {
+		pool = append(pool, &UpstreamHost{Name: "http://10.0.0." + strconv.Itoa(i+1) + ":8080", Weight: 1})
+	}
+	return pool
+}
+
+func TestConsistentHashPolicy(t *testing.T) {
+	pool := newHashTestPool(4)
+	chPolicy := NewConsistentHash("")
+	chPolicy.LoadFactor = 0
+
+	// objects of a bucket stay together
+	request := httptest.NewRequest("GET", "/photos/2018/a.jpg", nil)
+	h := chPolicy.Select(pool, request)
+	for _, path := range []string{"/photos/2018/b.jpg", "/photos/", "/photos?uploads"} {
+		if got := chPolicy.Select(pool, httptest.NewRequest("GET", path, nil)); got != h {
+			t.Errorf("Expected %s to go to %s, got %s", path, h.Name, got.Name)
+		}
+	}
+
+	// adding a host moves only the keys it takes over
+	before := make(map[string]*UpstreamHost)
+	for i := 0; i < 1000; i++ {
+		bucket := "/bucket" + strconv.Itoa(i)
+		before[bucket] = chPolicy.Select(pool, httptest.NewRequest("GET", bucket, nil))
+	}
+	pool = append(pool, newHashTestPool(5)[4])
+	moved := 0
+	for bucket, host := range before {
+		got := chPolicy.Select(pool, httptest.NewRequest("GET", bucket, nil))
+		if got != host {
+			moved++
+			if got != pool[4] {
+				t.Errorf("Expected %s to move to the new host only, got %s", bucket, got.Name)
+			}
+		}
+	}
+	if moved == 0 || moved > 350 {
+		t.Errorf("Expected about a fifth of the keys to move, got %d of 1000", moved)
+	}
+
+	// unavailable hosts pass their keys on
+	h = chPolicy.Select(pool, request)
+	h.Unhealthy = 1
+	if got := chPolicy.Select(pool, request); got == nil || got == h {
+		t.Error("Expected request to go to another host")
+	}
+	h.Unhealthy = 0
+}
+
+func TestConsistentHashBoundedLoad(t *testing.T) {
+	pool := newHashTestPool(4)
+	chPolicy := NewConsistentHash("header:X-Tenant")
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Tenant", "hot")
+
+	h := chPolicy.Select(pool, request)
+	h.Conns = 10
+	pool[0].Conns++
+	for _, host := range pool {
+		if host != h {
+			host.Conns = 1
+		}
+	}
+	// 13 connections on 4 hosts allow ceil(1.25*14/4) = 5 per host
+	spill := chPolicy.Select(pool, request)
+	if spill == h || spill == nil {
+		t.Fatal("Expected hot key to spill over to another host")
+	}
+
+	chPolicy.LoadFactor = 0
+	if got := chPolicy.Select(pool, request); got != h {
+		t.Error("Expected hot key to stay on its host without bounded load")
+	}
+}
+
+func TestConsistentHashKeys(t *testing.T) {
+	request := httptest.NewRequest("GET", "/bucket/dir/key?versionId=1", nil)
+	request.RemoteAddr = "10.1.1.1:1234"
+	request.Header.Set("X-Tenant", "t1")
+	for key, want := range map[string]string{
+		"bucket":          "bucket",
+		"bucket_key":      "bucket/dir/key",
+		"uri":             "/bucket/dir/key?versionId=1",
+		"ip":              "10.1.1.1",
+		"header:X-Tenant": "t1",
+	} {
+		if got := NewConsistentHash(key).hashKey(request); got != want {
+			t.Errorf("Expected key %s to be %q, got %q", key, want, got)
+		}
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -80,6 +82,8 @@ type UpstreamHost struct {
 	// This field is read & written to concurrently, so all access must use
 	// atomic operations.
 	Conns             int64 // must be first field to be 64-bit aligned on 32-bit systems
+	ejectedUntil      int64 // unix nanoseconds; 64-bit aligned as it follows Conns
+	healthySince      int64 // unix nanoseconds of the last recovery, 0 if never down
 	MaxConns          int64
 	Name              string // hostname of this upstream host
 	UpstreamHeaders   http.Header
@@ -94,12 +98,51 @@ type UpstreamHost struct {
 	// is healthy and any non-zero value indicates unhealthy.
 	Unhealthy         int32
 	HealthCheckResult atomic.Value
+	// Weight is the share of requests of this host relative to the
+	// other hosts for weighted policies. It is at least 1 and may be
+	// changed by host sources, so all access must be atomic.
+	Weight int32
+	// SlowStart is how long the weight of a host that just became
+	// healthy takes to ramp up to the full weight.
+	SlowStart time.Duration
+
+	// set by operators through the admin API; one of
+	// hostActive, hostDraining or hostDisabled
+	adminState int32
+
+	// closed when the requests still running on a draining
+	// host are cut off; guarded by drainMu
+	drainMu    sync.Mutex
+	cut        chan struct{}
+	drainTimer *time.Timer
+
+	// consecutive health check outcomes; accessed atomically
+	// as checks may also be run outside the worker
+	healthCheckPasses int32
+	healthCheckFails  int32
+
+	// responses for outlier detection, nil if disabled
+	outlierStats *hostStats
+
+	// circuit breaker, nil if disabled
+	breaker *circuitBreaker
 }
 
 // Down checks whether the upstream host is down or not.
-// Down will try to use uh.CheckDown first, and will fall
-// back to some default criteria if necessary.
+// Hosts taken out by an operator, ejected by outlier detection
+// or kept away by their circuit breaker are always down;
+// otherwise Down will try to use uh.CheckDown first, and
+// will fall back to some default criteria if necessary.
 func (uh *UpstreamHost) Down() bool {
+	if atomic.LoadInt32(&uh.adminState) != hostActive {
+		return true
+	}
+	if uh.ejected() {
+		return true
+	}
+	if uh.breaker != nil && !uh.breaker.available() {
+		return true
+	}
 	if uh.CheckDown == nil {
 		// Default settings
 		return atomic.LoadInt32(&uh.Unhealthy) != 0 || atomic.LoadInt32(&uh.Fails) > 0
@@ -109,7 +152,8 @@ func (uh *UpstreamHost) Down() bool {
 
 // Full checks whether the upstream host has reached its maximum connections
 func (uh *UpstreamHost) Full() bool {
-	return uh.MaxConns > 0 && atomic.LoadInt64(&uh.Conns) >= uh.MaxConns
+	maxConns := atomic.LoadInt64(&uh.MaxConns)
+	return maxConns > 0 && atomic.LoadInt64(&uh.Conns) >= maxConns
 }
 
 // Available checks whether the upstream host is available for proxying to
@@ -118,7 +162,7 @@ func (uh *UpstreamHost) Available() bool {
 }
 
 // ServeHTTP satisfies the httpserver.Handler interface.
-func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	// start by selecting most specific matching upstream config
 	upstream := p.match(r)
 	if upstream == nil {
@@ -128,6 +172,9 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	// this replacer is used to fill in header field values
 	replacer := httpserver.NewReplacer(r, nil, "")
 
+	// the upstream placeholders are set on this one
+	repl := upstreamReplacer(w, r)
+
 	// outreq is the request that makes a roundtrip to the backend
 	outreq, cancel := createUpstreamRequest(w, r)
 	defer cancel()
@@ -144,8 +191,92 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	// HTTP streaming applications like gRPC for instance.
 	requiresBuffering := upstream.GetHostCount() > 1 && upstream.GetTryDuration() != 0
 
+	// With a retry policy, only requests it considers safe to
+	// replay are retried, and their bodies only buffered if small.
+	var retry *retrier
+	if u, ok := upstream.(interface{ retries() *retryPolicy }); ok && u.retries() != nil {
+		policy := u.retries()
+		if policy.Budget != nil {
+			policy.Budget.request()
+		}
+		retry = &retrier{
+			policy:     policy,
+			upstream:   upstream,
+			ctx:        outreq.Context(),
+			start:      time.Now(),
+			idempotent: policy.Methods[r.Method],
+		}
+		requiresBuffering = policy.buffers(r)
+	}
+
+	// a copy of the request may be sent to the shadow host
+	// of the upstream once the response is served
+	var mirror *mirrorPolicy
+	var mirrored *mirroredRequest
+	var mirrorStatus int
+	var mirrorLatency time.Duration
+	if u, ok := upstream.(interface{ mirrors() *mirrorPolicy }); ok && u.mirrors() != nil && u.mirrors().selects(r) {
+		mirror = u.mirrors()
+		if r.ContentLength > 0 {
+			requiresBuffering = true
+		}
+		defer func() {
+			if mirrored == nil || err == context.Canceled {
+				return
+			}
+			if status != 0 {
+				mirrorStatus = status
+			}
+			mirrored.send(mirrorStatus, mirrorLatency)
+		}()
+	}
+
+	// identical requests in flight at the same time
+	// may share the response of one of them
+	var coalesce *coalescePolicy
+	var coalesceKey string
+	if u, ok := upstream.(interface{ coalescing() *coalescePolicy }); ok && u.coalescing() != nil {
+		coalesce = u.coalescing()
+		coalesceKey = coalesce.key(r)
+	}
+
+	// the framing and chunk signatures of aws-chunked
+	// uploads are verified while they are sent upstream
+	if u, ok := upstream.(interface{ awsChunked() (bool, bool) }); ok {
+		if verify, decode := u.awsChunked(); verify {
+			body, err := newAWSChunkedBody(outreq.Body, outreq.Header, httpserver.GetS3ChunkSigner(r), decode)
+			if s3err, ok := err.(httpserver.S3Error); ok {
+				httpserver.WriteS3Error(w, r, s3err)
+				return 0, nil
+			}
+			if body != nil {
+				outreq.Body = body
+				if decode {
+					body.decodeRequest(outreq)
+				}
+			}
+		}
+	}
+
+	// the body is checked against the digests the client
+	// sent for it while it is sent upstream
+	if u, ok := upstream.(interface{ verifiesChecksums() bool }); ok && u.verifiesChecksums() {
+		body, err := newChecksumBody(outreq.Body, outreq.Header, outreq.ContentLength)
+		if s3err, ok := err.(httpserver.S3Error); ok {
+			httpserver.WriteS3Error(w, r, s3err)
+			return 0, nil
+		}
+		if body != nil {
+			outreq.Body = body
+		}
+	}
+
 	if requiresBuffering {
 		body, err := newBufferedBody(outreq.Body)
+		if s3err, ok := err.(httpserver.S3Error); ok {
+			httpserver.WriteS3Error(w, r, s3err)
+			return 0, nil
+		}
 		if err != nil {
 			return http.StatusBadRequest, errors.New("failed to read downstream request body")
 		}
@@ -153,12 +284,19 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			outreq.Body = body
 		}
 	}
+	if retry != nil {
+		_, buffered := outreq.Body.(*bufferedBody)
+		retry.replayable = outreq.Body == nil || buffered
+	}
 
 	// The keepRetrying function will return true if we should
 	// loop and try to select another host, or false if we
 	// should break and stop retrying.
 	start := time.Now()
 	keepRetrying := func(backendErr error) bool {
+		if retry != nil {
+			return retry.next(backendErr)
+		}
 		// if downstream has canceled the request, break
 		if backendErr == context.Canceled {
 			return false
@@ -172,22 +310,42 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		return true
 	}
 
+	// each try traces its own request
+	traceCtx := outreq.Context()
+	tries := 0
+
 	var backendErr error
+	// discarded is the status of the response of the
+	// last try if it was discarded to retry the request
+	var discarded retryStatusError
 	for {
 		// since Select() should give us "up" hosts, keep retrying
 		// hosts until timeout (or until we get a nil host).
 		host := upstream.Select(r)
 		if host == nil {
 			if backendErr == nil {
-				backendErr = errors.New("no hosts available upstream")
+				backendErr = unsentError("no hosts available upstream")
 			}
 			if !keepRetrying(backendErr) {
 				break
 			}
 			continue
 		}
-		if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil {
-			rr.Replacer.Set("upstream", host.Name)
+		if !host.allowRequest() {
+			// the circuit breaker let another
+			// request through in the meantime
+			backendErr = unsentError("circuit breaker of upstream '" + host.Name + "' is open")
+			if !keepRetrying(backendErr) {
+				break
+			}
+			continue
+		}
+		tries++
+		if repl != nil {
+			repl.Set("upstream", host.Name)
+			if host.breaker != nil {
+				repl.Set("upstream_breaker", host.breaker.State().String())
+			}
 		}
 
 		proxy := host.ReverseProxy
@@ -214,6 +372,7 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			outreq.Host = host.Name
 		}
 		if proxy == nil {
+			host.cancelRequest()
 			return http.StatusInternalServerError, errors.New("proxy for host '" + host.Name + "' is nil")
 		}
 
@@ -226,6 +385,10 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			}
 		}
 
+		if mirror != nil && mirrored == nil {
+			mirrored = mirror.capture(outreq, host)
+		}
+
 		// prepare a function that will update response
 		// headers coming back downstream
 		var downHeaderUpdateFn respUpdateFn
@@ -233,10 +396,33 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 			downHeaderUpdateFn = createRespHeaderUpdateFn(host.DownstreamHeaders, replacer)
 		}
 
+		// observe the response for outlier detection, the circuit
+		// breaker, the mirror and the upstream placeholders, which
+		// the downstream headers may use
+		var backendStatus int
+		var backendLatency time.Duration
+		trace := &upstreamTrace{}
+		outreq = outreq.WithContext(trace.withTrace(traceCtx))
+		tryStart := time.Now()
+		if host.outlierStats != nil || host.breaker != nil || mirrored != nil || repl != nil {
+			updateFn := downHeaderUpdateFn
+			downHeaderUpdateFn = func(resp *http.Response) {
+				backendStatus = resp.StatusCode
+				backendLatency = time.Since(tryStart)
+				if repl != nil {
+					trace.setUpstreamPlaceholders(repl, host, resp.StatusCode)
+				}
+				if updateFn != nil {
+					updateFn(resp)
+				}
+			}
+		}
+
 		// Before we retry the request we have to make sure
 		// that the body is rewound to it's beginning.
 		if bb, ok := outreq.Body.(*bufferedBody); ok {
 			if err := bb.rewind(); err != nil {
+				host.cancelRequest()
 				return http.StatusInternalServerError, errors.New("unable to rewind downstream request body")
 			}
 		}
@@ -247,11 +433,101 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		//   The call to proxy.ServeHTTP can theoretically panic.
 		//   To prevent host.Conns from getting out-of-sync we thus have to
 		//   make sure that it's _always_ correctly decremented afterwards.
+		var retryStatus func(int) bool
+		if retry != nil {
+			retryStatus = retry.allowStatus
+		}
+		// a slow response to a request without body may be
+		// overtaken by the same request to another host
+		var hedge *hedgeTransport
+		if u, ok := upstream.(interface{ hedging() *hedgePolicy }); ok && u.hedging() != nil &&
+			(outreq.Method == "GET" || outreq.Method == "HEAD") && outreq.Body == nil &&
+			!requestIsWebsocket(outreq) && upstream.GetHostCount() > 1 {
+			hedge = &hedgeTransport{
+				policy:   u.hedging(),
+				upstream: upstream,
+				request:  r,
+				primary:  host,
+				base:     proxy.Transport,
+				url:      *outreq.URL,
+			}
+			hedged := *proxy
+			hedged.Transport = hedge
+			proxy = &hedged
+		}
+		var coalesced *coalesceTransport
+		if coalesceKey != "" {
+			coalesced = &coalesceTransport{
+				policy: coalesce,
+				key:    coalesceKey,
+				base:   proxy.Transport,
+			}
+			shared := *proxy
+			shared.Transport = coalesced
+			proxy = &shared
+		}
 		func() {
 			atomic.AddInt64(&host.Conns, 1)
 			defer atomic.AddInt64(&host.Conns, -1)
-			backendErr = proxy.ServeHTTP(w, outreq, downHeaderUpdateFn)
+			backendErr = proxy.serveHTTP(w, outreq, downHeaderUpdateFn, retryStatus)
 		}()
+		if backendErr != nil && host.cutOff() {
+			// the host was removed and did not finish in time
+			host.cancelRequest()
+			return http.StatusBadGateway, errHostCutOff
+		}
+		var s3err httpserver.S3Error
+		if errors.As(backendErr, &s3err) {
+			// the body did not match its digests or signatures,
+			// which is up to the client rather than the backend
+			host.cancelRequest()
+			httpserver.WriteS3Error(w, r, s3err)
+			return 0, nil
+		}
+		retried, retriedStatus := backendErr.(retryStatusError)
+		discarded = retried
+		if retriedStatus {
+			// the discarded response was not observed above
+			backendStatus, backendLatency = int(retried), time.Since(tryStart)
+		}
+
+		if backendErr == context.Canceled || backendErr == httpserver.ErrMaxBytesExceeded {
+			// neither says anything about the backend
+			host.cancelRequest()
+		} else if coalesced != nil && coalesced.follower {
+			// the response is that of another request, which
+			// may not even have been sent to this host
+			host.cancelRequest()
+		} else if hedge != nil && hedge.winner != nil {
+			// all we know is that this host was slower than the
+			// other one, whose response was recorded by the hedge
+			host.cancelRequest()
+			if repl != nil {
+				repl.Set("upstream", hedge.winner.Name)
+				repl.Set("upstream_addr", hedge.winner.Name)
+			}
+		} else {
+			if backendStatus == 0 {
+				backendLatency = time.Since(tryStart)
+			}
+			host.recordResponse(backendStatus >= 500 || (backendErr != nil && !retriedStatus), backendLatency)
+		}
+
+		if repl != nil {
+			if backendStatus == 0 {
+				trace.setUpstreamPlaceholders(repl, host, 0)
+			}
+			repl.Set("upstream_latency_ms", formatMilliseconds(time.Since(tryStart)))
+			repl.Set("upstream_retries", strconv.Itoa(tries-1))
+			repl.Set("upstream_hedged", strconv.FormatBool(hedge != nil && hedge.hedged))
+			repl.Set("upstream_mirrored", strconv.FormatBool(mirrored != nil))
+			repl.Set("upstream_coalesced", strconv.FormatBool(coalesced != nil && coalesced.follower))
+		}
+
+		mirrorStatus, mirrorLatency = backendStatus, backendLatency
+		if backendStatus == 0 {
+			mirrorLatency = time.Since(tryStart)
+		}
 
 		// if no errors, we're done here
 		if backendErr == nil {
@@ -269,11 +545,16 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		// failover; remember this failure for some time if
 		// request failure counting is enabled
 		timeout := host.FailTimeout
-		if timeout > 0 {
+		if timeout > 0 && !retriedStatus {
 			atomic.AddInt32(&host.Fails, 1)
 			go func(host *UpstreamHost, timeout time.Duration) {
 				time.Sleep(timeout)
+				down := host.CheckDown != nil && host.CheckDown(host)
 				atomic.AddInt32(&host.Fails, -1)
+				if down && !host.CheckDown(host) {
+					// the host starts slowly once its fails expire
+					atomic.StoreInt64(&host.healthySince, now().UnixNano())
+				}
 			}(host, timeout)
 		}
 
@@ -283,13 +564,21 @@ func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		}
 	}
 
+	if discarded != 0 {
+		// no host was left to retry on; the client gets
+		// the status the backend responded with after all
+		return int(discarded), backendErr
+	}
 	return http.StatusBadGateway, backendErr
 }
 
 // match finds the best match for a proxy config based on r.
+// If several upstreams share the best matching path, the
+// traffic is split between them.
 func (p Proxy) match(r *http.Request) Upstream {
 	var u Upstream
 	var longestMatch int
+	var candidates []Upstream
 	for _, upstream := range p.Upstreams {
 		basePath := upstream.From()
 		if !httpserver.Path(r.URL.Path).Matches(basePath) || !upstream.AllowedPath(r.URL.Path) {
@@ -298,8 +587,17 @@ func (p Proxy) match(r *http.Request) Upstream {
 		if len(basePath) > longestMatch {
 			longestMatch = len(basePath)
 			u = upstream
+			candidates = candidates[:0]
+		} else if u != nil && len(basePath) == longestMatch {
+			if len(candidates) == 0 {
+				candidates = append(candidates, u)
+			}
+			candidates = append(candidates, upstream)
 		}
 	}
+	if len(candidates) > 1 {
+		return split(candidates, r)
+	}
 	return u
 }
 
@@ -1270,6 +1270,22 @@ func TestReverseProxyRetry(t *testing.T) {
 	}
 }
 
+func TestFailTimeoutSlowStart(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	p := newRetryTestProxy(t, "localhost:65535", "fail_timeout 10ms\nmax_fails 1")
+	host := p.Upstreams[0].(*staticUpstream).Hosts[0]
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !host.Down() {
+		t.Fatal("Expected failed host to be down")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if host.Down() || atomic.LoadInt64(&host.healthySince) == 0 {
+		t.Error("Expected host to start slowly once its fails expired")
+	}
+}
+
 func TestReverseProxyLargeBody(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stderr)
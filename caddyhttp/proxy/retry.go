@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+// Error classes of failed requests to upstream hosts.
+const (
+	errorClassConnect = "connect" // the request was not sent
+	errorClassTimeout = "timeout"
+	errorClassReset   = "reset" // the connection broke before the response
+	errorClassOther   = "other"
+)
+
+// retryPolicy decides which failed requests to an upstream are
+// tried again, and how often. Requests that never left for lack
+// of an available host or a connection are retried regardless of
+// their method; other failures only for idempotent requests. In
+// both cases the request body must be replayable, that is absent
+// or buffered, which it is up to MaxBody bytes.
+type retryPolicy struct {
+	Statuses    map[int]bool
+	Errors      map[string]bool // error classes
+	Methods     map[string]bool // idempotent methods
+	MaxRetries  int
+	MaxBody     int64
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	Budget      *retryBudget // nil if retries are not limited
+}
+
+func newRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		Statuses:    make(map[int]bool),
+		Errors:      map[string]bool{errorClassConnect: true},
+		Methods:     map[string]bool{"GET": true, "HEAD": true, "PUT": true},
+		MaxRetries:  2,
+		MaxBody:     1 << 20,
+		BackoffBase: 25 * time.Millisecond,
+		BackoffMax:  time.Second,
+		Budget:      newRetryBudget(20, 3),
+	}
+}
+
+// buffers reports whether the body of r should be buffered
+// so that r can be retried.
+func (p *retryPolicy) buffers(r *http.Request) bool {
+	if r.ContentLength <= 0 || r.ContentLength > p.MaxBody {
+		return false
+	}
+	return p.Methods[r.Method] || p.Errors[errorClassConnect]
+}
+
+// backoff returns how long to wait before the retry after attempt
+// (counting from 0): a random duration up to BackoffBase doubled
+// for every attempt, but at most BackoffMax.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	limit := p.BackoffBase
+	for i := 0; i < attempt && limit < p.BackoffMax; i++ {
+		limit *= 2
+	}
+	if limit > p.BackoffMax {
+		limit = p.BackoffMax
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// errorClass returns the class of err, an error of a request to
+// an upstream host.
+func errorClass(err error) string {
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return errorClassConnect
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return errorClassTimeout
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF ||
+		strings.Contains(err.Error(), "connection reset") ||
+		strings.Contains(err.Error(), "broken pipe") ||
+		strings.Contains(err.Error(), "server closed") {
+		return errorClassReset
+	}
+	return errorClassOther
+}
+
+// retrier keeps track of the retries of a single request.
+type retrier struct {
+	policy     *retryPolicy
+	upstream   Upstream
+	ctx        context.Context
+	start      time.Time
+	idempotent bool
+	replayable bool
+	retries    int
+	reserved   bool // a retry was granted by allowStatus
+}
+
+// allowStatus reports whether a response with status is to be
+// discarded and retried; if so, the retry is granted right away.
+func (rt *retrier) allowStatus(status int) bool {
+	if !rt.policy.Statuses[status] || !rt.idempotent || !rt.replayable {
+		return false
+	}
+	if !rt.grant() {
+		return false
+	}
+	rt.reserved = true
+	prometheus.CountUpstreamRetry(rt.upstream.From(), strconv.Itoa(status))
+	return true
+}
+
+// next reports whether to try again after backendErr, waiting
+// for the backoff if so.
+func (rt *retrier) next(backendErr error) bool {
+	if backendErr == context.Canceled {
+		return false
+	}
+	if rt.reserved {
+		rt.reserved = false
+	} else {
+		reason, ok := rt.retryable(backendErr)
+		if !ok || !rt.grant() {
+			return false
+		}
+		prometheus.CountUpstreamRetry(rt.upstream.From(), reason)
+	}
+
+	timer := time.NewTimer(rt.policy.backoff(rt.retries - 1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-rt.ctx.Done():
+		return false
+	}
+}
+
+// retryable returns the reason to retry after backendErr,
+// if it is one the policy retries.
+func (rt *retrier) retryable(backendErr error) (string, bool) {
+	if _, ok := backendErr.(unsentError); ok {
+		return "unavailable", true
+	}
+	class := errorClass(backendErr)
+	if !rt.policy.Errors[class] || !rt.replayable {
+		return "", false
+	}
+	if class != errorClassConnect && !rt.idempotent {
+		return "", false
+	}
+	return class, true
+}
+
+// grant takes a retry from the limits of the policy, if any is left.
+func (rt *retrier) grant() bool {
+	if rt.retries >= rt.policy.MaxRetries {
+		return false
+	}
+	if d := rt.upstream.GetTryDuration(); d > 0 && time.Since(rt.start) >= d {
+		return false
+	}
+	if rt.policy.Budget != nil && !rt.policy.Budget.withdraw() {
+		prometheus.CountRetryBudgetExhausted(rt.upstream.From())
+		return false
+	}
+	rt.retries++
+	return true
+}
+
+// unsentError is the error of a request that was not sent
+// because no upstream host was available.
+type unsentError string
+
+func (e unsentError) Error() string { return string(e) }
+
+// retryBudgetBuckets is the number of one second buckets
+// the retry budget counts requests in.
+const retryBudgetBuckets = 10
+
+// retryBudget limits the retries to an upstream to Percent of
+// the requests within the last ten seconds, but allows at least
+// MinPerSecond retries per second.
+type retryBudget struct {
+	Percent      float64
+	MinPerSecond float64
+
+	mu      sync.Mutex
+	buckets [retryBudgetBuckets]budgetBucket
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+func newRetryBudget(percent, minPerSecond float64) *retryBudget {
+	return &retryBudget{Percent: percent, MinPerSecond: minPerSecond}
+}
+
+// bucket returns the bucket of the current second.
+// b.mu must be held.
+func (b *retryBudget) bucket() *budgetBucket {
+	second := now().Unix()
+	bucket := &b.buckets[second%retryBudgetBuckets]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+// request counts a request.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.bucket().requests++
+	b.mu.Unlock()
+}
+
+// withdraw takes a retry from the budget, if it allows another one.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.bucket()
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if current.second-bucket.second < retryBudgetBuckets {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := b.Percent / 100 * float64(requests)
+	if min := b.MinPerSecond * retryBudgetBuckets; allowed < min {
+		allowed = min
+	}
+	if float64(retries+1) > allowed {
+		return false
+	}
+	current.retries++
+	return true
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func newRetryTestProxy(t *testing.T, hosts, block string) *Proxy {
+	config := "proxy / " + hosts + " {\n" + block + "\n}"
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Proxy{Upstreams: upstreams}
+}
+
+func TestRetryStatus(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("SlowDown"))
+			return
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	p := newRetryTestProxy(t, backend.URL, "retry_statuses 500 503\nretry_backoff 1ms")
+
+	for _, method := range []string{"GET", "PUT"} {
+		atomic.StoreInt32(&requests, 0)
+		w := httptest.NewRecorder()
+		code, err := p.ServeHTTP(w, httptest.NewRequest(method, "/bucket/key", strings.NewReader("object")))
+		if code != 0 || err != nil {
+			t.Fatalf("%s: expected retry to succeed, got %d, %v", method, code, err)
+		}
+		if w.Code != http.StatusOK || (method == "PUT" && w.Body.String() != "object") {
+			t.Errorf("%s: expected response of the retry, got %d %q", method, w.Code, w.Body.String())
+		}
+		if n := atomic.LoadInt32(&requests); n != 2 {
+			t.Errorf("%s: expected 2 requests to the backend, got %d", method, n)
+		}
+	}
+
+	// requests that are not idempotent get the response as is
+	atomic.StoreInt32(&requests, 0)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/bucket/key?uploads", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "SlowDown" {
+		t.Errorf("Expected POST not to be retried, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRetryStatusNoHostLeft(t *testing.T) {
+	var p *Proxy
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the only host goes down before the retry
+		atomic.StoreInt32(&p.Upstreams[0].(*staticUpstream).Hosts[0].Unhealthy, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	p = newRetryTestProxy(t, backend.URL, "retry_statuses 503\nretry_backoff 0s")
+	code, err := p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if code != http.StatusServiceUnavailable || err == nil {
+		t.Errorf("Expected status of the discarded response, got %d, %v", code, err)
+	}
+}
+
+func TestRetryStatusNotUpdated(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := NewSingleHostReverseProxy(target, "", http.DefaultMaxIdleConnsPerHost, 30*time.Second, 300*time.Millisecond)
+	updated := false
+	update := func(*http.Response) { updated = true }
+	retry := func(status int) bool { return status == http.StatusServiceUnavailable }
+	err = rp.serveHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), update, retry)
+	if err != retryStatusError(http.StatusServiceUnavailable) {
+		t.Fatalf("Expected response to be retried, got %v", err)
+	}
+	if updated {
+		t.Error("Expected a retried response not to be updated")
+	}
+}
+
+func TestRetryMax(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	p := newRetryTestProxy(t, backend.URL, "retry_statuses 500\nretry_max 3\nretry_backoff 0s")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected last response to be passed on, got %d", w.Code)
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Errorf("Expected 4 requests to the backend, got %d", n)
+	}
+
+	// an exhausted budget stops retries
+	atomic.StoreInt32(&requests, 0)
+	p = newRetryTestProxy(t, backend.URL, "retry_statuses 500\nretry_budget 0% 0")
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected no retries without budget, got %d requests", n)
+	}
+}
+
+func TestRetryConnectError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// an address nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "http://" + l.Addr().String()
+	l.Close()
+
+	// round robin starts with the second host
+	p := newRetryTestProxy(t, backend.URL+" "+dead, "policy round_robin\nretry_backoff 1ms")
+	w := httptest.NewRecorder()
+	code, err := p.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("data")))
+	if code != 0 || err != nil || w.Body.String() != "ok" {
+		t.Errorf("Expected connection failure to be retried on the other host, got %d, %v", code, err)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, dialErr := (&http.Transport{}).RoundTrip(httptest.NewRequest("GET", "http://"+addr+"/", nil))
+
+	for i, test := range []struct {
+		err   error
+		class string
+	}{
+		{dialErr, errorClassConnect},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, errorClassTimeout},
+		{&net.OpError{Op: "read", Err: errConnReset}, errorClassReset},
+		{errOther, errorClassOther},
+	} {
+		if class := errorClass(test.err); class != test.class {
+			t.Errorf("Test %d: expected class %s for %v, got %s", i, test.class, test.err, class)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var (
+	errConnReset = stringError("connection reset by peer")
+	errOther     = stringError("malformed HTTP response")
+)
+
+type stringError string
+
+func (e stringError) Error() string { return string(e) }
+
+func TestRetryBudget(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	defer setNow(start)()
+	b := newRetryBudget(10, 0.2)
+
+	// the minimum allows 2 retries within 10 seconds
+	if !b.withdraw() || !b.withdraw() || b.withdraw() {
+		t.Fatal("Expected the minimum to allow 2 retries")
+	}
+
+	for i := 0; i < 50; i++ {
+		b.request()
+	}
+	if !b.withdraw() || !b.withdraw() || !b.withdraw() || b.withdraw() {
+		t.Error("Expected 10% of 50 requests to allow 5 retries")
+	}
+
+	// old requests and retries are forgotten
+	defer setNow(start.Add(10 * time.Second))()
+	if !b.withdraw() || !b.withdraw() || b.withdraw() {
+		t.Error("Expected the window to start over")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := newRetryPolicy()
+	p.BackoffBase = 10 * time.Millisecond
+	p.BackoffMax = 50 * time.Millisecond
+	for attempt, limit := range []time.Duration{10, 20, 40, 50, 50} {
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(attempt); d < 0 || d >= limit*time.Millisecond {
+				t.Errorf("Attempt %d: expected backoff below %v, got %v", attempt, limit*time.Millisecond, d)
+			}
+		}
+	}
+}
+
+func TestParseBlockRetry(t *testing.T) {
+	config := `retry_statuses 500 503
+	retry_errors connect reset
+	retry_methods get head put delete
+	retry_max 4
+	retry_max_body 65536
+	retry_backoff 10ms 2s
+	retry_budget 25% 5`
+
+	u := staticUpstream{}
+	c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+	for c.Next() {
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	p := u.Retry
+	if p == nil {
+		t.Fatal("Expected retry policy to be enabled")
+	}
+	if len(p.Statuses) != 2 || !p.Statuses[503] || len(p.Errors) != 2 || !p.Errors["reset"] ||
+		len(p.Methods) != 4 || !p.Methods["DELETE"] || p.MaxRetries != 4 || p.MaxBody != 65536 ||
+		p.BackoffBase != 10*time.Millisecond || p.BackoffMax != 2*time.Second ||
+		p.Budget == nil || p.Budget.Percent != 25 || p.Budget.MinPerSecond != 5 {
+		t.Errorf("Unexpected retry policy %+v", p)
+	}
+
+	u = staticUpstream{}
+	c = caddyfile.NewDispenser("Testfile", strings.NewReader("retry_budget off"))
+	c.Next()
+	if err := parseBlock(&c, &u, false); err != nil || u.Retry.Budget != nil {
+		t.Errorf("Expected retry budget to be disabled, got %v", err)
+	}
+
+	for i, config := range []string{
+		"retry_statuses",
+		"retry_statuses 5xx",
+		"retry_errors refused",
+		"retry_max -1",
+		"retry_max_body 1MB",
+		"retry_backoff 1s 10ms",
+		"retry_budget 120%",
+		"retry_budget 20% -1",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
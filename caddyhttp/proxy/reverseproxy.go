@@ -30,9 +30,11 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -99,6 +101,10 @@ type ReverseProxy struct {
 	dialer *net.Dialer
 
 	srvResolver srvResolver
+
+	// cutoff returns a channel that is closed when the
+	// requests to the host are to be cut off; may be nil
+	cutoff func() <-chan struct{}
 }
 
 // Though the relevant directive prefix is just "unix:", url.Parse
@@ -313,6 +319,21 @@ func (rp *ReverseProxy) UseInsecureTransport() {
 // ServeHTTP serves the proxied request to the upstream by performing a roundtrip.
 // It is designed to handle websocket connection upgrades as well.
 func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request, respUpdateFn respUpdateFn) error {
+	return rp.serveHTTP(rw, outreq, respUpdateFn, nil)
+}
+
+// retryStatusError is returned by serveHTTP instead of
+// copying a response whose status is to be retried.
+type retryStatusError int
+
+func (e retryStatusError) Error() string {
+	return "upstream responded with status " + strconv.Itoa(int(e))
+}
+
+// serveHTTP is ServeHTTP, but a response for which retryStatus
+// returns true is discarded and returned as a retryStatusError,
+// without being passed to respUpdateFn.
+func (rp *ReverseProxy) serveHTTP(rw http.ResponseWriter, outreq *http.Request, respUpdateFn respUpdateFn, retryStatus func(int) bool) error {
 	transport := rp.Transport
 	if requestIsWebsocket(outreq) {
 		transport = newConnHijackerTransport(transport)
@@ -324,6 +345,23 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 		outreq.URL.Scheme = "https" // Change scheme back to https for QUIC RoundTripper
 	}
 
+	// requests to a draining host end at its deadline,
+	// including websocket connections
+	var cut <-chan struct{}
+	if rp.cutoff != nil {
+		cut = rp.cutoff()
+		ctx, cancel := context.WithCancel(outreq.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-cut:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		outreq = outreq.WithContext(ctx)
+	}
+
 	res, err := transport.RoundTrip(outreq)
 	if err != nil {
 		return err
@@ -345,6 +383,13 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 		res.Header.Del(h)
 	}
 
+	if retryStatus != nil && !isWebsocket && retryStatus(res.StatusCode) {
+		// read a little so that the connection can be reused
+		io.CopyN(ioutil.Discard, res.Body, 4096)
+		res.Body.Close()
+		return retryStatusError(res.StatusCode)
+	}
+
 	if respUpdateFn != nil {
 		respUpdateFn(res)
 	}
@@ -405,7 +450,10 @@ func (rp *ReverseProxy) ServeHTTP(rw http.ResponseWriter, outreq *http.Request,
 		}()
 
 		// If one side is done, we are done.
-		<-proxyDone
+		select {
+		case <-proxyDone:
+		case <-cut:
+		}
 	} else {
 		// NOTE:
 		//   Closing the Body involves acquiring a mutex, which is a
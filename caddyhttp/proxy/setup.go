@@ -24,6 +24,10 @@ func init() {
 		ServerType: "http",
 		Action:     setup,
 	})
+	caddy.RegisterPlugin("proxy_admin", caddy.Plugin{
+		ServerType: "http",
+		Action:     setupAdmin,
+	})
 }
 
 // setup configures a new Proxy middleware instance.
@@ -36,7 +40,33 @@ func setup(c *caddy.Controller) error {
 		return Proxy{Next: next, Upstreams: upstreams}
 	})
 
+	// The upstreams join the registry only once the instance
+	// starts. Its servers may still fail to start after that, in
+	// which case the running instance restores the registry.
+	c.OnStartup(func() error {
+		registerUpstreams(upstreams)
+		return nil
+	})
+	var before []Upstream
+	restarting := false
+	c.OnRestart(func() error {
+		before, restarting = registeredUpstreams(), true
+		return nil
+	})
+	c.OnRestartFailed(func() error {
+		if restarting {
+			restoreUpstreams(before)
+		}
+		restarting = false
+		return nil
+	})
+
 	// Register shutdown handlers.
+	c.OnShutdown(func() error {
+		unregisterUpstreams(upstreams)
+		drainRemovedHosts(upstreams)
+		return nil
+	})
 	for _, upstream := range upstreams {
 		c.OnShutdown(upstream.Stop)
 	}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// splitter is an upstream that shares its path with other
+// upstreams, and takes part in splitting the traffic between them.
+type splitter interface {
+	// splitWeight returns the share of the traffic the upstream
+	// gets, relative to the other upstreams of the path.
+	splitWeight() int64
+
+	// splitKey returns the request property used to send
+	// the same clients to the same upstream.
+	splitKey() string
+
+	// splitMatches reports whether r is sent to the upstream
+	// regardless of the weights.
+	splitMatches(r *http.Request) bool
+}
+
+// split chooses one of candidates, upstreams of the same path, for r:
+// the first whose conditions r meets, or else one at random in
+// proportion to their weights, and the same one for requests with
+// the same split key. Without weights, the first one is chosen.
+func split(candidates []Upstream, r *http.Request) Upstream {
+	var total int64
+	var key string
+	for _, upstream := range candidates {
+		s, ok := upstream.(splitter)
+		if !ok {
+			continue
+		}
+		if s.splitMatches(r) {
+			return upstream
+		}
+		total += s.splitWeight()
+		if key == "" {
+			key = s.splitKey()
+		}
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+
+	var point int64
+	if key == "" {
+		point = rand.Int63n(total)
+	} else {
+		// the salt keeps the choice independent of consistent
+		// hashing within the chosen upstream
+		point = int64(hash64("split:"+splitKeyOf(key, r)) % uint64(total))
+	}
+	for _, upstream := range candidates {
+		if s, ok := upstream.(splitter); ok {
+			if point -= s.splitWeight(); point < 0 {
+				return upstream
+			}
+		}
+	}
+	return candidates[0]
+}
+
+// validSplitKey reports whether key is a known split key.
+func validSplitKey(key string) bool {
+	switch key {
+	case "bucket", "access_key", "ip":
+		return true
+	}
+	return strings.HasPrefix(key, "header:") && len(key) > len("header:")
+}
+
+// splitKeyOf returns the value of key for r. Anonymous requests
+// are split by client IP when splitting by access key.
+func splitKeyOf(key string, r *http.Request) string {
+	switch key {
+	case "bucket", "access_key":
+		s3req := httpserver.GetS3Request(r)
+		if s3req == nil {
+			s3req = httpserver.ParseS3Request(r, nil)
+		}
+		if key == "bucket" {
+			return s3req.Bucket
+		}
+		if s3req.AccessKey != "" {
+			return s3req.AccessKey
+		}
+	case "ip":
+	default:
+		return r.Header.Get(strings.TrimPrefix(key, "header:"))
+	}
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	return clientIP
+}
+
+// splitWeight implements splitter.
+func (u *staticUpstream) splitWeight() int64 {
+	return int64(atomic.LoadInt32(&u.SplitWeight))
+}
+
+// splitKey implements splitter.
+func (u *staticUpstream) splitKey() string {
+	return u.SplitKey
+}
+
+// splitMatches implements splitter.
+func (u *staticUpstream) splitMatches(r *http.Request) bool {
+	return u.SplitMatcher.Enabled && u.SplitMatcher.Match(r)
+}
+
+// readSplitWeight reads a split weight from the file at path.
+func readSplitWeight(path string) (int32, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	weight, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil || weight < 0 {
+		return 0, fmt.Errorf("%s: split weight must be a non-negative number", path)
+	}
+	return int32(weight), nil
+}
+
+// watchSplitWeight updates the split weight of u from the file
+// at path every interval, until stop is closed.
+func (u *staticUpstream) watchSplitWeight(path string, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			weight, err := readSplitWeight(path)
+			if err != nil {
+				log.Printf("[ERROR] proxy: updating split weight of upstream %s: %v", u.from, err)
+				continue
+			}
+			if old := atomic.SwapInt32(&u.SplitWeight, weight); old != weight {
+				log.Printf("[INFO] proxy: split weight of upstream %s is now %d (was %d)", u.from, weight, old)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
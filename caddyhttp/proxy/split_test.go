@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyfile"
+)
+
+func newSplitTestProxy(t *testing.T, config string) Proxy {
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Proxy{Upstreams: upstreams}
+}
+
+func TestSplitWeights(t *testing.T) {
+	p := newSplitTestProxy(t, `proxy / stable:8080 {
+		split_weight 95
+		split_key ip
+	}
+	proxy / canary:8080 {
+		split_weight 5
+	}
+	proxy /other other:8080`)
+	stable, canary := p.Upstreams[0], p.Upstreams[1]
+
+	canaries := 0
+	for i := 0; i < 2000; i++ {
+		r := httptest.NewRequest("GET", "/bucket/key", nil)
+		r.RemoteAddr = "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ":1234"
+		u := p.match(r)
+		if u == canary {
+			canaries++
+		} else if u != stable {
+			t.Fatalf("Expected stable or canary upstream, got %s", u.From())
+		}
+		// clients stick to their upstream
+		if p.match(r) != u {
+			t.Fatalf("Expected %s to get the same upstream again", r.RemoteAddr)
+		}
+	}
+	if canaries < 50 || canaries > 150 {
+		t.Errorf("Expected about 5%% of clients to get the canary, got %d of 2000", canaries)
+	}
+
+	if u := p.match(httptest.NewRequest("GET", "/other/key", nil)); u != p.Upstreams[2] {
+		t.Error("Expected a longer path to take precedence over the split")
+	}
+
+	atomic.StoreInt32(&canary.(*staticUpstream).SplitWeight, 0)
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest("GET", "/bucket/key", nil)
+		r.RemoteAddr = "10.1.0." + strconv.Itoa(i) + ":1234"
+		if p.match(r) != stable {
+			t.Fatal("Expected no traffic to an upstream without weight")
+		}
+	}
+}
+
+func TestSplitWeightsWithoutKey(t *testing.T) {
+	p := newSplitTestProxy(t, `proxy / stable:8080 {
+		split_weight 95
+	}
+	proxy / canary:8080 {
+		split_weight 5
+	}`)
+	canary := p.Upstreams[1]
+
+	canaries := 0
+	for i := 0; i < 2000; i++ {
+		if p.match(httptest.NewRequest("GET", "/bucket/key", nil)) == canary {
+			canaries++
+		}
+	}
+	if canaries < 50 || canaries > 150 {
+		t.Errorf("Expected about 5%% of requests to get the canary, got %d of 2000", canaries)
+	}
+}
+
+func TestSplitConditions(t *testing.T) {
+	p := newSplitTestProxy(t, `proxy / stable:8080 {
+		split_weight 1
+	}
+	proxy / canary:8080 {
+		if {s3_bucket} is canary-bucket
+		if {>X-Canary} is 1
+		if_op or
+	}`)
+	stable, canary := p.Upstreams[0], p.Upstreams[1]
+
+	if u := p.match(httptest.NewRequest("GET", "/canary-bucket/key", nil)); u != canary {
+		t.Error("Expected request to canary-bucket to go to the canary")
+	}
+	r := httptest.NewRequest("GET", "/bucket/key", nil)
+	r.Header.Set("X-Canary", "1")
+	if u := p.match(r); u != canary {
+		t.Error("Expected request with X-Canary header to go to the canary")
+	}
+	if u := p.match(httptest.NewRequest("GET", "/bucket/key", nil)); u != stable {
+		t.Error("Expected other requests to go to the stable upstream")
+	}
+}
+
+func TestSplitWithoutWeights(t *testing.T) {
+	p := newSplitTestProxy(t, "proxy / first:8080\nproxy / second:8080")
+	for i := 0; i < 10; i++ {
+		if u := p.match(httptest.NewRequest("GET", "/bucket"+strconv.Itoa(i), nil)); u != p.Upstreams[0] {
+			t.Fatal("Expected the first upstream without split weights")
+		}
+	}
+}
+
+func TestSplitKeyOf(t *testing.T) {
+	r := httptest.NewRequest("GET", "/bucket/key", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Tenant", "acme")
+	for _, test := range []struct {
+		key, value string
+	}{
+		{"bucket", "bucket"},
+		{"access_key", "10.0.0.1"},
+		{"ip", "10.0.0.1"},
+		{"header:X-Tenant", "acme"},
+	} {
+		if value := splitKeyOf(test.key, r); value != test.value {
+			t.Errorf("Expected %s of %s, got %s", test.key, test.value, value)
+		}
+	}
+
+	r.Header.Set("Authorization", "AWS AKIDEXAMPLE:signature")
+	if value := splitKeyOf("access_key", r); value != "AKIDEXAMPLE" {
+		t.Errorf("Expected access key AKIDEXAMPLE, got %s", value)
+	}
+}
+
+func TestSplitWeightFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy_proxy_split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "canary.weight")
+	if err := ioutil.WriteFile(path, []byte("5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newSplitTestProxy(t, "proxy / canary:8080 {\n split_weight_file "+path+"\n}")
+	u := p.Upstreams[0].(*staticUpstream)
+	u.Stop()
+	if u.splitWeight() != 5 {
+		t.Fatalf("Expected split weight 5, got %d", u.splitWeight())
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		u.watchSplitWeight(path, 10*time.Millisecond, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	if err := ioutil.WriteFile(path, []byte("20"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for u.splitWeight() != 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected split weight to be updated, got %d", u.splitWeight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSplitConfigErrors(t *testing.T) {
+	for i, config := range []string{
+		"proxy / a:8080 {\n split_weight -1\n}",
+		"proxy / a:8080 {\n split_weight many\n}",
+		"proxy / a:8080 {\n split_key cookie\n}",
+		"proxy / a:8080 {\n split_weight_file /nonexistent/weight\n}",
+		"proxy / a:8080 {\n if {s3_bucket} is\n}",
+	} {
+		_, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
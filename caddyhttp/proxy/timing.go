@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// upstreamTrace records the connection and the timing of a
+// request to an upstream host, to expose them as placeholders.
+// Hedged requests share the trace; the first response counts.
+type upstreamTrace struct {
+	start time.Time
+
+	mu           sync.Mutex
+	addr         string
+	connectStart time.Time
+	connect      time.Duration
+	firstByte    time.Duration
+}
+
+// withTrace returns ctx with a client trace that records into t.
+func (t *upstreamTrace) withTrace(ctx context.Context) context.Context {
+	t.start = time.Now()
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			if err == nil && t.connect == 0 && !t.connectStart.IsZero() {
+				t.connect = time.Since(t.connectStart)
+			}
+			t.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			if t.addr == "" && info.Conn != nil {
+				t.addr = info.Conn.RemoteAddr().String()
+			}
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			if t.firstByte == 0 {
+				t.firstByte = time.Since(t.start)
+			}
+			t.mu.Unlock()
+		},
+	})
+}
+
+// setUpstreamPlaceholders sets the placeholders of the
+// response of host to the request traced by t:
+//
+//   {upstream_addr}       address the request was sent to
+//   {upstream_connect_ms} time to connect, 0 for reused connections
+//   {upstream_ttfb_ms}    time to the first byte of the response
+//   {upstream_status}     status of the response
+func (t *upstreamTrace) setUpstreamPlaceholders(repl httpserver.Replacer, host *UpstreamHost, status int) {
+	t.mu.Lock()
+	addr, connect, firstByte := t.addr, t.connect, t.firstByte
+	t.mu.Unlock()
+	if addr == "" {
+		addr = host.Name
+	}
+	repl.Set("upstream_addr", addr)
+	repl.Set("upstream_connect_ms", formatMilliseconds(connect))
+	repl.Set("upstream_ttfb_ms", formatMilliseconds(firstByte))
+	if status != 0 {
+		repl.Set("upstream_status", strconv.Itoa(status))
+	}
+}
+
+func formatMilliseconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// upstreamReplacer returns the replacer to set the upstream
+// placeholders on: the one of the log directive if it records w,
+// or else the one of r. It is nil if there is neither.
+func upstreamReplacer(w http.ResponseWriter, r *http.Request) httpserver.Replacer {
+	if rr, ok := w.(*httpserver.ResponseRecorder); ok && rr.Replacer != nil {
+		return rr.Replacer
+	}
+	repl, _ := r.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer)
+	return repl
+}
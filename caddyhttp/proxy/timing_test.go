@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestUpstreamPlaceholders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	p := newRetryTestProxy(t, backend.URL, "header_downstream X-Upstream-Status {upstream_status}")
+	r := httptest.NewRequest("GET", "/bucket/key", nil)
+	repl := httpserver.NewReplacer(r, nil, "")
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.ReplacerCtxKey, repl))
+	w := httptest.NewRecorder()
+	if _, err := p.ServeHTTP(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := w.Header().Get("X-Upstream-Status"); got != "202" {
+		t.Errorf("Expected upstream status in downstream header, got %q", got)
+	}
+	for placeholder, expected := range map[string]string{
+		"{upstream}":          backend.URL,
+		"{upstream_addr}":     backend.Listener.Addr().String(),
+		"{upstream_status}":   "202",
+		"{upstream_retries}":  "0",
+		"{upstream_hedged}":   "false",
+		"{upstream_mirrored}": "false",
+	} {
+		if got := repl.Replace(placeholder); got != expected {
+			t.Errorf("Expected %s to be %q, got %q", placeholder, expected, got)
+		}
+	}
+	for _, placeholder := range []string{"{upstream_connect_ms}", "{upstream_ttfb_ms}", "{upstream_latency_ms}"} {
+		if _, err := strconv.Atoi(repl.Replace(placeholder)); err != nil {
+			t.Errorf("Expected %s to be a number of milliseconds, got %q", placeholder, repl.Replace(placeholder))
+		}
+	}
+}
+
+func TestUpstreamPlaceholdersRetries(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	p := newRetryTestProxy(t, down.URL+" "+backend.URL, "policy first\ntry_duration 1s\nfail_timeout 10s\nmax_fails 1")
+	r := httptest.NewRequest("GET", "/bucket/key", nil)
+	repl := httpserver.NewReplacer(r, nil, "")
+	r = r.WithContext(context.WithValue(r.Context(), httpserver.ReplacerCtxKey, repl))
+	if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	if got := repl.Replace("{upstream_retries}"); got != "1" {
+		t.Errorf("Expected 1 retry, got %q", got)
+	}
+	if got := repl.Replace("{upstream}"); got != backend.URL {
+		t.Errorf("Expected the second host to serve the request, got %q", got)
+	}
+}
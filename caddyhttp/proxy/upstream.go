@@ -32,8 +32,10 @@ import (
 
 	"crypto/tls"
 
+	"github.com/journeymidnight/yig-front-caddy"
 	"github.com/journeymidnight/yig-front-caddy/caddyfile"
 	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
 )
 
 var (
@@ -44,8 +46,10 @@ type staticUpstream struct {
 	from              string
 	upstreamHeaders   http.Header
 	downstreamHeaders http.Header
-	stop              chan struct{}  // Signals running goroutines to stop.
-	wg                sync.WaitGroup // Used to wait for running goroutines to stop.
+	stop              chan struct{}      // Signals running goroutines to stop.
+	wg                sync.WaitGroup     // Used to wait for running goroutines to stop.
+	checkNow          chan chan struct{} // Requests an immediate health check.
+	hostsMu           sync.RWMutex       // Guards Hosts once the upstream is in use.
 	Hosts             HostPool
 	Policy            Policy
 	KeepAlive         int
@@ -55,6 +59,12 @@ type staticUpstream struct {
 	TryDuration       time.Duration
 	TryInterval       time.Duration
 	MaxConns          int64
+	SlowStart         time.Duration
+	DrainTimeout      time.Duration
+	VerifyChecksums   bool
+	AWSChunked        bool    // aws-chunked uploads are verified
+	DecodeAWSChunked  bool    // and forwarded decoded
+	HashLoadFactor    float64 // -1 unless set by hash_load_factor
 	HealthCheck       struct {
 		Client        http.Client
 		Path          string
@@ -63,12 +73,28 @@ type staticUpstream struct {
 		Host          string
 		Port          string
 		ContentString string
+		Method        string
+		Headers       http.Header
+		Statuses      []string // like 200 or 2xx; 2xx and 3xx if empty
+		MaxLatency    time.Duration
+		Passes        int32 // consecutive passes before a host is healthy again
+		Fails         int32 // consecutive fails before a host is unhealthy
 	}
 	WithoutPathPrefix  string
 	IgnoredSubPaths    []string
 	insecureSkipVerify bool
 	MaxFails           int32
 	resolver           srvResolver
+	Outlier            *outlierDetector      // nil unless passive health checks are enabled
+	Breaker            *circuitBreakerConfig // nil unless circuit breakers are enabled
+	Retry              *retryPolicy          // nil unless a retry policy is configured
+	Hedge              *hedgePolicy          // nil unless requests are hedged
+	Mirror             *mirrorPolicy         // nil unless requests are mirrored
+	Coalesce           *coalescePolicy       // nil unless requests are coalesced
+	SplitWeight        int32                 // share of the traffic of the path; updated atomically
+	SplitKey           string
+	SplitMatcher       httpserver.IfMatcher // requests sent here regardless of weights
+	splitWeightFile    string
 }
 
 type srvResolver interface {
@@ -93,6 +119,7 @@ func NewStaticUpstreams(c caddyfile.Dispenser, host string) ([]Upstream, error)
 			MaxFails:          1,
 			TryInterval:       250 * time.Millisecond,
 			MaxConns:          0,
+			HashLoadFactor:    -1,
 			KeepAlive:         http.DefaultMaxIdleConnsPerHost,
 			Timeout:           30 * time.Second,
 			resolver:          net.DefaultResolver,
@@ -103,7 +130,10 @@ func NewStaticUpstreams(c caddyfile.Dispenser, host string) ([]Upstream, error)
 		}
 
 		var to []string
+		weights := make(map[string]int32)
 		hasSrv := false
+		var source HostSource
+		sourceInterval := defaultSourceInterval
 
 		for _, t := range c.RemainingArgs() {
 			if len(to) > 0 && hasSrv {
@@ -125,8 +155,17 @@ func NewStaticUpstreams(c caddyfile.Dispenser, host string) ([]Upstream, error)
 			to = append(to, parsed...)
 		}
 
+		matcher, err := httpserver.SetupIfMatcher(&caddy.Controller{Dispenser: c})
+		if err != nil {
+			return upstreams, err
+		}
+		upstream.SplitMatcher = matcher.(httpserver.IfMatcher)
+
 		for c.NextBlock() {
 			switch c.Val() {
+			case "if", "if_op":
+				// parsed by SetupIfMatcher
+				c.RemainingArgs()
 			case "upstream":
 				if !c.NextArg() {
 					return upstreams, c.ArgErr()
@@ -140,7 +179,41 @@ func NewStaticUpstreams(c caddyfile.Dispenser, host string) ([]Upstream, error)
 				if err != nil {
 					return upstreams, err
 				}
+				weight, err := parseWeight(c.RemainingArgs())
+				if err != nil {
+					return upstreams, c.Err(err.Error())
+				}
+				for _, host := range parsed {
+					weights[hostName(host)] = weight
+				}
 				to = append(to, parsed...)
+			case "upstream_source":
+				if hasSrv {
+					return upstreams, c.Err("upstream_source is not supported when backend is service locator")
+				}
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				newSource, ok := supportedSources[c.Val()]
+				if !ok {
+					return upstreams, c.Errf("unknown upstream source '%s'", c.Val())
+				}
+				var err error
+				if source, err = newSource(c.RemainingArgs()); err != nil {
+					return upstreams, c.Errf("upstream_source: %v", err)
+				}
+			case "upstream_source_interval":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return upstreams, err
+				}
+				if dur <= 0 {
+					return upstreams, c.Err("upstream_source_interval must be positive")
+				}
+				sourceInterval = dur
 			default:
 				if err := parseBlock(&c, upstream, hasSrv); err != nil {
 					return upstreams, err
@@ -148,16 +221,83 @@ func NewStaticUpstreams(c caddyfile.Dispenser, host string) ([]Upstream, error)
 			}
 		}
 
+		if source != nil {
+			if len(to) > 0 {
+				return upstreams, c.Err("upstream_source can not be mixed with host names")
+			}
+			names, err := source.Hosts()
+			if err != nil {
+				return upstreams, c.Errf("upstream_source: %v", err)
+			}
+			if to, weights, err = expandHosts(names); err != nil {
+				return upstreams, c.Errf("upstream_source: %v", err)
+			}
+			if len(to) == 0 {
+				return upstreams, c.Err("upstream_source: no hosts")
+			}
+		}
+
 		if len(to) == 0 {
 			return upstreams, c.ArgErr()
 		}
 
+		if upstream.Outlier != nil && upstream.Outlier.ErrorRatio == 0 && upstream.Outlier.MaxLatency == 0 {
+			return upstreams, c.Err("outlier detection requires outlier_error_ratio or outlier_latency")
+		}
+		if policy, ok := upstream.Policy.(*ConsistentHash); ok {
+			if !validHashKey(policy.Key) {
+				return upstreams, c.Errf("unknown consistent_hash key '%s'", policy.Key)
+			}
+			if upstream.HashLoadFactor >= 0 {
+				policy.LoadFactor = upstream.HashLoadFactor
+			}
+		} else if upstream.HashLoadFactor >= 0 {
+			return upstreams, c.Err("hash_load_factor requires the consistent_hash policy")
+		}
+		if upstream.SlowStart > 0 && !isWeighted(upstream.Policy) {
+			return upstreams, c.Err("slow_start requires a weighted policy")
+		}
+		if upstream.Breaker != nil && upstream.Breaker.ErrorRatio == 0 &&
+			upstream.Breaker.ConsecutiveFailures == 0 && upstream.Breaker.Latency == 0 {
+			return upstreams, c.Err("circuit breaker requires breaker_error_ratio, breaker_consecutive_failures or breaker_latency")
+		}
+
+		if upstream.SplitKey != "" && !validSplitKey(upstream.SplitKey) {
+			return upstreams, c.Errf("unknown split_key '%s'", upstream.SplitKey)
+		}
+		if upstream.splitWeightFile != "" {
+			weight, err := readSplitWeight(upstream.splitWeightFile)
+			if err != nil {
+				return upstreams, c.Err(err.Error())
+			}
+			upstream.SplitWeight = weight
+		}
+
+		if m := upstream.Mirror; m != nil {
+			if m.URL == nil {
+				return upstreams, c.Err("mirroring requires a mirror host")
+			}
+			m.from = upstream.from
+			m.pending = make(chan struct{}, maxMirrorRequests)
+			m.proxy = NewSingleHostReverseProxy(m.URL, upstream.WithoutPathPrefix, upstream.KeepAlive, upstream.Timeout, upstream.FallbackDelay)
+			if upstream.insecureSkipVerify {
+				m.proxy.UseInsecureTransport()
+			}
+		}
+
+		if upstream.Coalesce != nil {
+			upstream.Coalesce.from = upstream.from
+		}
+
 		upstream.Hosts = make([]*UpstreamHost, len(to))
 		for i, host := range to {
 			uh, err := upstream.NewHost(host)
 			if err != nil {
 				return upstreams, err
 			}
+			if weight, ok := weights[uh.Name]; ok {
+				uh.Weight = weight
+			}
 			upstream.Hosts[i] = uh
 		}
 
@@ -176,12 +316,36 @@ func NewStaticUpstreams(c caddyfile.Dispenser, host string) ([]Upstream, error)
 					upstream.HealthCheck.Host = strings.Replace(hostHeader, "{host}", host, -1)
 				}
 			}
+			upstream.checkNow = make(chan chan struct{})
 			upstream.wg.Add(1)
 			go func() {
 				defer upstream.wg.Done()
 				upstream.HealthCheckWorker(upstream.stop)
 			}()
 		}
+
+		if upstream.splitWeightFile != "" {
+			upstream.wg.Add(1)
+			go func() {
+				defer upstream.wg.Done()
+				upstream.watchSplitWeight(upstream.splitWeightFile, defaultSourceInterval, upstream.stop)
+			}()
+		}
+
+		if source != nil {
+			dynamic := &dynamicUpstream{
+				staticUpstream: upstream,
+				Source:         source,
+				Interval:       sourceInterval,
+			}
+			upstream.wg.Add(1)
+			go func() {
+				defer upstream.wg.Done()
+				dynamic.watch(upstream.stop)
+			}()
+			upstreams = append(upstreams, dynamic)
+			continue
+		}
 		upstreams = append(upstreams, upstream)
 	}
 	return upstreams, nil
@@ -192,15 +356,8 @@ func (u *staticUpstream) From() string {
 }
 
 func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
-	if !strings.HasPrefix(host, "http") &&
-		!strings.HasPrefix(host, "unix:") &&
-		!strings.HasPrefix(host, "quic:") &&
-		!strings.HasPrefix(host, "srv://") &&
-		!strings.HasPrefix(host, "srv+https://") {
-		host = "http://" + host
-	}
 	uh := &UpstreamHost{
-		Name:              host,
+		Name:              hostName(host),
 		Conns:             0,
 		Fails:             0,
 		FailTimeout:       u.FailTimeout,
@@ -221,6 +378,15 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 		WithoutPathPrefix: u.WithoutPathPrefix,
 		MaxConns:          u.MaxConns,
 		HealthCheckResult: atomic.Value{},
+		Weight:            1,
+		SlowStart:         u.SlowStart,
+	}
+
+	if u.Outlier != nil {
+		uh.outlierStats = &hostStats{detector: u.Outlier}
+	}
+	if u.Breaker != nil {
+		uh.breaker = newCircuitBreaker(u.Breaker, uh.Name)
 	}
 
 	baseURL, err := url.Parse(uh.Name)
@@ -229,6 +395,7 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 	}
 
 	uh.ReverseProxy = NewSingleHostReverseProxy(baseURL, uh.WithoutPathPrefix, u.KeepAlive, u.Timeout, u.FallbackDelay)
+	uh.ReverseProxy.cutoff = uh.cutoff
 	if u.insecureSkipVerify {
 		uh.ReverseProxy.UseInsecureTransport()
 	}
@@ -236,6 +403,41 @@ func (u *staticUpstream) NewHost(host string) (*UpstreamHost, error) {
 	return uh, nil
 }
 
+// hostName returns the name of the UpstreamHost for host,
+// which defaults to plain HTTP if no scheme is given.
+func hostName(host string) string {
+	if !strings.HasPrefix(host, "http") &&
+		!strings.HasPrefix(host, "unix:") &&
+		!strings.HasPrefix(host, "quic:") &&
+		!strings.HasPrefix(host, "srv://") &&
+		!strings.HasPrefix(host, "srv+https://") {
+		host = "http://" + host
+	}
+	return host
+}
+
+// maxWeight bounds host weights; a host gets ringReplicas
+// points per unit of weight on a consistent hash ring.
+const maxWeight = 1000
+
+// parseWeight parses the options that may follow a host,
+// which is only weight=N for now. The weight defaults to 1
+// and may be at most maxWeight.
+func parseWeight(options []string) (int32, error) {
+	weight := int32(1)
+	for _, option := range options {
+		if !strings.HasPrefix(option, "weight=") {
+			return 0, fmt.Errorf("unknown host option '%s'", option)
+		}
+		n, err := strconv.ParseInt(strings.TrimPrefix(option, "weight="), 10, 32)
+		if err != nil || n < 1 || n > maxWeight {
+			return 0, fmt.Errorf("weight must be an integer from 1 to %d, got '%s'", maxWeight, option)
+		}
+		weight = int32(n)
+	}
+	return weight, nil
+}
+
 func parseUpstream(u string) ([]string, error) {
 	if strings.HasPrefix(u, "unix:") {
 		return []string{u}, nil
@@ -424,6 +626,489 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 			return c.ArgErr()
 		}
 		u.HealthCheck.ContentString = c.Val()
+	case "health_check_method":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		u.HealthCheck.Method = strings.ToUpper(c.Val())
+	case "health_check_header":
+		var header, value string
+		if !c.Args(&header, &value) {
+			return c.ArgErr()
+		}
+		if u.HealthCheck.Headers == nil {
+			u.HealthCheck.Headers = make(http.Header)
+		}
+		u.HealthCheck.Headers.Add(header, value)
+	case "health_check_status":
+		statuses := c.RemainingArgs()
+		if len(statuses) == 0 {
+			return c.ArgErr()
+		}
+		for _, status := range statuses {
+			if !validStatusPattern(status) {
+				return c.Errf("invalid health_check_status '%s'", status)
+			}
+		}
+		u.HealthCheck.Statuses = append(u.HealthCheck.Statuses, statuses...)
+	case "health_check_max_latency":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		u.HealthCheck.MaxLatency = dur
+	case "health_check_passes", "health_check_fails":
+		what := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return c.Errf("%s must be at least 1", what)
+		}
+		if what == "health_check_passes" {
+			u.HealthCheck.Passes = int32(n)
+		} else {
+			u.HealthCheck.Fails = int32(n)
+		}
+	case "hash_load_factor":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		factor, err := strconv.ParseFloat(c.Val(), 64)
+		if err != nil || (factor != 0 && factor <= 1) {
+			return c.Errf("hash_load_factor must be above 1, or 0 to disable bounded load, got '%s'", c.Val())
+		}
+		u.HashLoadFactor = factor
+	case "retry_statuses":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			status, err := strconv.Atoi(arg)
+			if err != nil || status < 100 || status > 599 {
+				return c.Errf("invalid retry status '%s'", arg)
+			}
+			u.retry().Statuses[status] = true
+		}
+	case "retry_errors":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		classes := make(map[string]bool)
+		for _, arg := range args {
+			switch arg {
+			case errorClassConnect, errorClassTimeout, errorClassReset, errorClassOther:
+				classes[arg] = true
+			default:
+				return c.Errf("unknown retry error class '%s'", arg)
+			}
+		}
+		u.retry().Errors = classes
+	case "retry_methods":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		methods := make(map[string]bool)
+		for _, arg := range args {
+			methods[strings.ToUpper(arg)] = true
+		}
+		u.retry().Methods = methods
+	case "retry_max":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil || n < 0 {
+			return c.Errf("retry_max must be a number of retries, got '%s'", c.Val())
+		}
+		u.retry().MaxRetries = n
+	case "retry_max_body":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseInt(c.Val(), 10, 64)
+		if err != nil || n < 0 {
+			return c.Errf("retry_max_body must be a number of bytes, got '%s'", c.Val())
+		}
+		u.retry().MaxBody = n
+	case "retry_backoff":
+		args := c.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		base, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		max := base * 40
+		if len(args) == 2 {
+			if max, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+		}
+		if base < 0 || max < base {
+			return c.Err("retry_backoff must not be negative and not exceed its maximum")
+		}
+		u.retry().BackoffBase = base
+		u.retry().BackoffMax = max
+	case "retry_budget":
+		args := c.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		if args[0] == "off" && len(args) == 1 {
+			u.retry().Budget = nil
+			break
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return c.Errf("retry_budget must be a percentage, got '%s'", args[0])
+		}
+		minPerSecond := 3.0
+		if len(args) == 2 {
+			minPerSecond, err = strconv.ParseFloat(args[1], 64)
+			if err != nil || minPerSecond < 0 {
+				return c.Errf("retry_budget minimum must be a number of retries per second, got '%s'", args[1])
+			}
+		}
+		u.retry().Budget = newRetryBudget(percent, minPerSecond)
+	case "hedge":
+		args := c.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		hedge := &hedgePolicy{}
+		if strings.HasPrefix(args[0], "p") {
+			pct, err := strconv.ParseFloat(args[0][1:], 64)
+			if err != nil || pct <= 0 || pct >= 100 {
+				return c.Errf("hedge percentile must be between p0 and p100, got '%s'", args[0])
+			}
+			hedge.Percentile = pct / 100
+			hedge.Delay = 10 * time.Millisecond
+			if len(args) == 2 {
+				dur, err := time.ParseDuration(args[1])
+				if err != nil {
+					return err
+				}
+				hedge.Delay = dur
+			}
+		} else {
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			hedge.Delay = dur
+		}
+		if hedge.Delay < 0 {
+			return c.Err("hedge delay must not be negative")
+		}
+		u.Hedge = hedge
+	case "mirror":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if strings.HasPrefix(c.Val(), "srv://") || strings.HasPrefix(c.Val(), "srv+https://") {
+			return c.Err("mirror does not support service locators")
+		}
+		mirrorURL, err := url.Parse(hostName(c.Val()))
+		if err != nil {
+			return err
+		}
+		u.mirror().URL = mirrorURL
+	case "mirror_percent":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(c.Val(), "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return c.Errf("mirror_percent must be a percentage, got '%s'", c.Val())
+		}
+		u.mirror().Percent = percent
+	case "mirror_methods":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		methods := make(map[string]bool)
+		for _, arg := range args {
+			methods[strings.ToUpper(arg)] = true
+		}
+		u.mirror().Methods = methods
+	case "mirror_paths":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		u.mirror().Paths = args
+	case "mirror_buckets":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		buckets := make(map[string]bool)
+		for _, arg := range args {
+			buckets[arg] = true
+		}
+		u.mirror().Buckets = buckets
+	case "mirror_max_body":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseInt(c.Val(), 10, 64)
+		if err != nil || n < 0 {
+			return c.Errf("mirror_max_body must be a number of bytes, got '%s'", c.Val())
+		}
+		u.mirror().MaxBody = n
+	case "mirror_latency_threshold":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return c.Err("mirror_latency_threshold must not be negative")
+		}
+		u.mirror().LatencyThreshold = dur
+	case "coalesce":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		u.coalesce()
+	case "coalesce_buckets":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			u.coalesce().Buckets[arg] = true
+		}
+	case "coalesce_max_buffer":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.ParseInt(c.Val(), 10, 64)
+		if err != nil || n <= 0 {
+			return c.Errf("coalesce_max_buffer must be a positive number of bytes, got '%s'", c.Val())
+		}
+		u.coalesce().MaxBuffer = n
+	case "coalesce_stall_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Err("coalesce_stall_timeout must be positive")
+		}
+		u.coalesce().StallTimeout = dur
+	case "split_weight":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		weight, err := strconv.ParseInt(c.Val(), 10, 32)
+		if err != nil || weight < 0 {
+			return c.Errf("split_weight must be a non-negative number, got '%s'", c.Val())
+		}
+		u.SplitWeight = int32(weight)
+	case "split_weight_file":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		u.splitWeightFile = c.Val()
+	case "split_key":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		u.SplitKey = c.Val()
+	case "slow_start":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Err("slow_start must be positive")
+		}
+		u.SlowStart = dur
+	case "drain_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return c.Err("drain_timeout must not be negative")
+		}
+		u.DrainTimeout = dur
+	case "outlier_window":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < outlierBuckets*time.Millisecond {
+			return c.Errf("outlier_window '%s' is too short", c.Val())
+		}
+		u.outlier().Window = dur
+	case "outlier_min_requests":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return c.Err("outlier_min_requests must be at least 1")
+		}
+		u.outlier().MinRequests = n
+	case "outlier_error_ratio":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		ratio, err := strconv.ParseFloat(c.Val(), 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return c.Errf("outlier_error_ratio must be between 0 and 1, got '%s'", c.Val())
+		}
+		u.outlier().ErrorRatio = ratio
+	case "outlier_latency":
+		var percentile, latency string
+		if !c.Args(&percentile, &latency) {
+			return c.ArgErr()
+		}
+		p, err := strconv.ParseFloat(strings.TrimPrefix(percentile, "p"), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return c.Errf("invalid outlier_latency percentile '%s'", percentile)
+		}
+		dur, err := time.ParseDuration(latency)
+		if err != nil {
+			return err
+		}
+		u.outlier().Percentile = p / 100
+		u.outlier().MaxLatency = dur
+	case "outlier_ejection_time":
+		args := c.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		base, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		max := base * 10
+		if len(args) == 2 {
+			if max, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+		}
+		if base <= 0 || max < base {
+			return c.Err("outlier_ejection_time must be positive and not exceed its maximum")
+		}
+		u.outlier().BaseEjectionTime = base
+		u.outlier().MaxEjectionTime = max
+	case "outlier_max_ejected":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(c.Val(), "%"))
+		if err != nil || n < 0 || n > 100 {
+			return c.Errf("outlier_max_ejected must be a percentage, got '%s'", c.Val())
+		}
+		u.outlier().MaxEjectedPercent = n
+	case "breaker_error_ratio":
+		args := c.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		ratio, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return c.Errf("breaker_error_ratio must be between 0 and 1, got '%s'", args[0])
+		}
+		u.breaker().ErrorRatio = ratio
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return c.Errf("breaker_error_ratio minimum requests must be at least 1, got '%s'", args[1])
+			}
+			u.breaker().MinRequests = n
+		}
+	case "breaker_consecutive_failures":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil || n < 1 {
+			return c.Errf("breaker_consecutive_failures must be at least 1, got '%s'", c.Val())
+		}
+		u.breaker().ConsecutiveFailures = n
+	case "breaker_latency":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Err("breaker_latency must be positive")
+		}
+		u.breaker().Latency = dur
+	case "breaker_window":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Err("breaker_window must be positive")
+		}
+		u.breaker().Window = dur
+	case "breaker_open_time":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return c.Err("breaker_open_time must be positive")
+		}
+		u.breaker().OpenTime = dur
+	case "breaker_half_open_requests":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil || n < 1 {
+			return c.Errf("breaker_half_open_requests must be at least 1, got '%s'", c.Val())
+		}
+		u.breaker().HalfOpenRequests = n
 	case "header_upstream":
 		var header, value string
 		if !c.Args(&header, &value) {
@@ -442,6 +1127,18 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 			}
 		}
 		u.downstreamHeaders.Add(header, value)
+	case "verify_checksums":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		u.VerifyChecksums = true
+	case "aws_chunked":
+		args := c.RemainingArgs()
+		if len(args) > 1 || (len(args) == 1 && args[0] != "decode") {
+			return c.ArgErr()
+		}
+		u.AWSChunked = true
+		u.DecodeAWSChunked = len(args) == 1
 	case "transparent":
 		// Note: X-Forwarded-For header is always being appended for proxy connections
 		// See implementation of createUpstreamRequest in proxy.go
@@ -491,6 +1188,87 @@ func parseBlock(c *caddyfile.Dispenser, u *staticUpstream, hasSrv bool) error {
 	return nil
 }
 
+// outlier returns the outlier detector of u, creating
+// it with default settings if there is none yet.
+func (u *staticUpstream) outlier() *outlierDetector {
+	if u.Outlier == nil {
+		u.Outlier = newOutlierDetector(u)
+	}
+	return u.Outlier
+}
+
+// retry returns the retry policy of u, creating it
+// with default settings if there is none yet.
+func (u *staticUpstream) retry() *retryPolicy {
+	if u.Retry == nil {
+		u.Retry = newRetryPolicy()
+	}
+	return u.Retry
+}
+
+// retries returns the retry policy of u, or nil if
+// requests are retried until try_duration is over.
+func (u *staticUpstream) retries() *retryPolicy {
+	return u.Retry
+}
+
+// mirror returns the mirror policy of u, creating it
+// with default settings if there is none yet.
+func (u *staticUpstream) mirror() *mirrorPolicy {
+	if u.Mirror == nil {
+		u.Mirror = newMirrorPolicy()
+	}
+	return u.Mirror
+}
+
+// mirrors returns the mirror policy of u, or nil
+// if requests are not mirrored.
+func (u *staticUpstream) mirrors() *mirrorPolicy {
+	return u.Mirror
+}
+
+// coalesce returns the coalescing policy of u, creating
+// it with default settings if there is none yet.
+func (u *staticUpstream) coalesce() *coalescePolicy {
+	if u.Coalesce == nil {
+		u.Coalesce = newCoalescePolicy()
+	}
+	return u.Coalesce
+}
+
+// coalescing returns the coalescing policy of u, or nil
+// if requests are not coalesced.
+func (u *staticUpstream) coalescing() *coalescePolicy {
+	return u.Coalesce
+}
+
+// verifiesChecksums reports whether the digests of request
+// bodies are verified before they reach the backend.
+func (u *staticUpstream) verifiesChecksums() bool {
+	return u.VerifyChecksums
+}
+
+// awsChunked reports whether aws-chunked uploads are
+// verified, and whether they are forwarded decoded.
+func (u *staticUpstream) awsChunked() (verify, decode bool) {
+	return u.AWSChunked, u.DecodeAWSChunked
+}
+
+// hedging returns the hedge policy of u, or nil
+// if requests are not hedged.
+func (u *staticUpstream) hedging() *hedgePolicy {
+	return u.Hedge
+}
+
+// breaker returns the circuit breaker settings of u, creating
+// them with default values if there are none yet.
+func (u *staticUpstream) breaker() *circuitBreakerConfig {
+	if u.Breaker == nil {
+		u.Breaker = newCircuitBreakerConfig()
+	}
+	return u.Breaker
+}
+
 func (u *staticUpstream) resolveHost(h string) ([]string, bool, error) {
 	names := []string{}
 	proto := "http"
@@ -515,7 +1293,11 @@ func (u *staticUpstream) resolveHost(h string) ([]string, bool, error) {
 }
 
 func (u *staticUpstream) healthCheck() {
-	for _, host := range u.Hosts {
+	for _, host := range u.pool() {
+		if atomic.LoadInt32(&host.adminState) == hostDisabled {
+			host.HealthCheckResult.Store("Disabled")
+			continue
+		}
 		candidates, isSrv, err := u.resolveHost(host.Name)
 		if err != nil {
 			host.HealthCheckResult.Store(err.Error())
@@ -524,6 +1306,7 @@ func (u *staticUpstream) healthCheck() {
 		}
 
 		unhealthyCount := 0
+		var latency time.Duration
 		for _, addr := range candidates {
 			hostURL := addr
 			if !isSrv && u.HealthCheck.Port != "" {
@@ -531,58 +1314,125 @@ func (u *staticUpstream) healthCheck() {
 			}
 			hostURL += u.HealthCheck.Path
 
-			unhealthy := func() bool {
-				// set up request, needed to be able to modify headers
-				// possible errors are bad HTTP methods or un-parsable urls
-				req, err := http.NewRequest("GET", hostURL, nil)
-				if err != nil {
-					return true
-				}
-				// set host for request going upstream
-				if u.HealthCheck.Host != "" {
-					req.Host = u.HealthCheck.Host
-				}
-				r, err := u.HealthCheck.Client.Do(req)
-				if err != nil {
-					return true
-				}
-				defer func() {
-					io.Copy(ioutil.Discard, r.Body)
-					r.Body.Close()
-				}()
-				if r.StatusCode < 200 || r.StatusCode >= 400 {
-					return true
-				}
-				if u.HealthCheck.ContentString == "" { // don't check for content string
-					return false
-				}
-				// TODO ReadAll will be replaced if deemed necessary
-				//      See https://github.com/mholt/caddy/pull/1691
-				buf, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					return true
-				}
-				if bytes.Contains(buf, []byte(u.HealthCheck.ContentString)) {
-					return false
-				}
-				return true
-			}()
-
-			if unhealthy {
+			healthy, took := u.checkHost(hostURL)
+			if !healthy {
 				unhealthyCount++
 			}
+			if took > latency {
+				latency = took
+			}
 		}
 
 		if unhealthyCount == len(candidates) {
-			atomic.StoreInt32(&host.Unhealthy, 1)
 			host.HealthCheckResult.Store("Failed")
+			u.recordHealthCheck(host, false)
 		} else {
-			atomic.StoreInt32(&host.Unhealthy, 0)
 			host.HealthCheckResult.Store("OK")
+			u.recordHealthCheck(host, true)
 		}
+		prometheus.SetUpstreamHealth(host.Name, atomic.LoadInt32(&host.Unhealthy) == 0, latency)
 	}
 }
 
+// checkHost performs a single health check against hostURL. It
+// returns whether the check passed and how long the response took.
+func (u *staticUpstream) checkHost(hostURL string) (bool, time.Duration) {
+	method := u.HealthCheck.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	// set up request, needed to be able to modify headers
+	// possible errors are bad HTTP methods or un-parsable urls
+	req, err := http.NewRequest(method, hostURL, nil)
+	if err != nil {
+		return false, 0
+	}
+	// set host for request going upstream
+	if u.HealthCheck.Host != "" {
+		req.Host = u.HealthCheck.Host
+	}
+	for name, values := range u.HealthCheck.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+
+	start := time.Now()
+	r, err := u.HealthCheck.Client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return false, latency
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+	if u.HealthCheck.MaxLatency > 0 && latency > u.HealthCheck.MaxLatency {
+		return false, latency
+	}
+	if len(u.HealthCheck.Statuses) == 0 {
+		if r.StatusCode < 200 || r.StatusCode >= 400 {
+			return false, latency
+		}
+	} else if !statusMatches(r.StatusCode, u.HealthCheck.Statuses) {
+		return false, latency
+	}
+	if u.HealthCheck.ContentString == "" { // don't check for content string
+		return true, latency
+	}
+	// TODO ReadAll will be replaced if deemed necessary
+	//      See https://github.com/mholt/caddy/pull/1691
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return false, latency
+	}
+	return bytes.Contains(buf, []byte(u.HealthCheck.ContentString)), latency
+}
+
+// recordHealthCheck counts the outcome of a health check of host and
+// flips its health once enough consecutive checks agree.
+func (u *staticUpstream) recordHealthCheck(host *UpstreamHost, healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&host.healthCheckFails, 0)
+		if atomic.AddInt32(&host.healthCheckPasses, 1) >= u.HealthCheck.Passes &&
+			atomic.CompareAndSwapInt32(&host.Unhealthy, 1, 0) {
+			atomic.StoreInt64(&host.healthySince, now().UnixNano())
+		}
+	} else {
+		atomic.StoreInt32(&host.healthCheckPasses, 0)
+		if atomic.AddInt32(&host.healthCheckFails, 1) >= u.HealthCheck.Fails {
+			atomic.StoreInt32(&host.Unhealthy, 1)
+		}
+	}
+}
+
+// validStatusPattern reports whether s is a status code
+// like 200 or a class of status codes like 2xx.
+func validStatusPattern(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// statusMatches reports whether status matches one of patterns.
+func statusMatches(status int, patterns []string) bool {
+	code := strconv.Itoa(status)
+	for _, pattern := range patterns {
+		if pattern == code || (strings.HasSuffix(pattern, "xx") && pattern[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *staticUpstream) HealthCheckWorker(stop chan struct{}) {
 	ticker := time.NewTicker(u.HealthCheck.Interval)
 	u.healthCheck()
@@ -590,6 +1440,9 @@ func (u *staticUpstream) HealthCheckWorker(stop chan struct{}) {
 		select {
 		case <-ticker.C:
 			u.healthCheck()
+		case done := <-u.checkNow:
+			u.healthCheck()
+			close(done)
 		case <-stop:
 			ticker.Stop()
 			return
@@ -598,7 +1451,7 @@ func (u *staticUpstream) HealthCheckWorker(stop chan struct{}) {
 }
 
 func (u *staticUpstream) Select(r *http.Request) *UpstreamHost {
-	pool := u.Hosts
+	pool := u.pool()
 	if len(pool) == 1 {
 		if !pool[0].Available() {
 			return nil
@@ -651,7 +1504,15 @@ func (u *staticUpstream) GetTimeout() time.Duration {
 }
 
 func (u *staticUpstream) GetHostCount() int {
-	return len(u.Hosts)
+	return len(u.pool())
+}
+
+// pool returns the current hosts of u. Hosts may be
+// replaced at any time by upstreams with a host source.
+func (u *staticUpstream) pool() HostPool {
+	u.hostsMu.RLock()
+	defer u.hostsMu.RUnlock()
+	return u.Hosts
 }
 
 // Stop sends a signal to all goroutines started by this staticUpstream to exit
@@ -213,6 +213,117 @@ func TestParseBlockHealthCheck(t *testing.T) {
 	}
 }
 
+func TestParseBlockHealthCheckS3(t *testing.T) {
+	config := `health_check /canary/object
+	health_check_method head
+	health_check_header Host s3.example.com
+	health_check_header X-Canary yes
+	health_check_status 200 403 5xx
+	health_check_max_latency 250ms
+	health_check_passes 3
+	health_check_fails 2`
+
+	u := staticUpstream{}
+	c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+	for c.Next() {
+		if err := parseBlock(&c, &u, false); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if u.HealthCheck.Method != "HEAD" {
+		t.Errorf("Expected method HEAD, got %s", u.HealthCheck.Method)
+	}
+	if u.HealthCheck.Headers.Get("Host") != "s3.example.com" || u.HealthCheck.Headers.Get("X-Canary") != "yes" {
+		t.Errorf("Unexpected headers %v", u.HealthCheck.Headers)
+	}
+	if !reflect.DeepEqual(u.HealthCheck.Statuses, []string{"200", "403", "5xx"}) {
+		t.Errorf("Unexpected statuses %v", u.HealthCheck.Statuses)
+	}
+	if u.HealthCheck.MaxLatency != 250*time.Millisecond {
+		t.Errorf("Expected max latency 250ms, got %v", u.HealthCheck.MaxLatency)
+	}
+	if u.HealthCheck.Passes != 3 || u.HealthCheck.Fails != 2 {
+		t.Errorf("Expected 3 passes and 2 fails, got %d and %d", u.HealthCheck.Passes, u.HealthCheck.Fails)
+	}
+
+	for i, config := range []string{
+		"health_check_status",
+		"health_check_status 20x",
+		"health_check_status 600",
+		"health_check_header X-Canary",
+		"health_check_max_latency soon",
+		"health_check_passes 0",
+		"health_check_fails many",
+	} {
+		u := staticUpstream{}
+		c := caddyfile.NewDispenser("Testfile", strings.NewReader(config))
+		c.Next()
+		if err := parseBlock(&c, &u, false); err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
+
+func TestHealthCheckS3(t *testing.T) {
+	var status int32 = http.StatusForbidden
+	var delay int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.Host != "canary.s3.example.com" || r.Header.Get("X-Canary") != "yes" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	config := "proxy / " + server.URL + ` {
+		health_check /object
+		health_check_interval 1h
+		health_check_method HEAD
+		health_check_header Host canary.s3.example.com
+		health_check_header X-Canary yes
+		health_check_status 2xx 403
+		health_check_max_latency 100ms
+		health_check_passes 2
+		health_check_fails 2
+	}`
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := upstreams[0].(*staticUpstream)
+	// wait for the initial check of the worker, so
+	// that it does not interfere with the steps below
+	upstream.Stop()
+	host := upstream.Hosts[0]
+
+	for i, step := range []struct {
+		status            int32
+		delay             time.Duration
+		expectedUnhealthy bool
+		expectedResult    string
+	}{
+		{http.StatusForbidden, 0, false, "OK"},
+		{http.StatusNotFound, 0, false, "Failed"}, // one fail is not enough
+		{http.StatusNotFound, 0, true, "Failed"},
+		{http.StatusOK, 0, true, "OK"}, // one pass is not enough
+		{http.StatusOK, 200 * time.Millisecond, true, "Failed"},
+		{http.StatusOK, 0, true, "OK"},
+		{http.StatusOK, 0, false, "OK"},
+	} {
+		atomic.StoreInt32(&status, step.status)
+		atomic.StoreInt64(&delay, int64(step.delay))
+		upstream.healthCheck()
+		if unhealthy := atomic.LoadInt32(&host.Unhealthy) != 0; unhealthy != step.expectedUnhealthy {
+			t.Errorf("Step %d: expected unhealthy %v, got %v", i, step.expectedUnhealthy, unhealthy)
+		}
+		if result := host.HealthCheckResult.Load(); result != step.expectedResult {
+			t.Errorf("Step %d: expected result %s, got %v", i, step.expectedResult, result)
+		}
+	}
+}
+
 func TestStop(t *testing.T) {
 	config := "proxy / %s {\n health_check /healthcheck \nhealth_check_interval %dms \n}"
 	tests := []struct {
@@ -774,3 +885,76 @@ func TestSRVHealthCheck(t *testing.T) {
 		}
 	}
 }
+
+func TestWeightedUpstreams(t *testing.T) {
+	config := `proxy / {
+		policy weighted_round_robin
+		upstream localhost:8080 weight=3
+		upstream localhost:8081-8082 weight=2
+		upstream localhost:8083
+		slow_start 30s
+	}`
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := upstreams[0].(*staticUpstream)
+	for i, want := range []int32{3, 2, 2, 1} {
+		if u.Hosts[i].Weight != want {
+			t.Errorf("Expected host %s to have weight %d, got %d", u.Hosts[i].Name, want, u.Hosts[i].Weight)
+		}
+		if u.Hosts[i].SlowStart != 30*time.Second {
+			t.Errorf("Expected host %s to have slow start of 30s, got %v", u.Hosts[i].Name, u.Hosts[i].SlowStart)
+		}
+	}
+
+	// a host that passes its health checks again starts slowly
+	host := u.Hosts[0]
+	atomic.StoreInt32(&host.Unhealthy, 1)
+	u.HealthCheck.Passes = 1
+	u.recordHealthCheck(host, true)
+	if atomic.LoadInt32(&host.Unhealthy) != 0 || atomic.LoadInt64(&host.healthySince) == 0 {
+		t.Error("Expected recovered host to start slowly")
+	}
+
+	for i, config := range []string{
+		"proxy / {\n upstream localhost:8080 weight=0\n}",
+		"proxy / {\n upstream localhost:8080 weight=heavy\n}",
+		"proxy / {\n upstream localhost:8080 weight=2147483647\n}",
+		"proxy / {\n upstream localhost:8080 backup\n}",
+		"proxy / localhost:8080 {\n slow_start 30s\n}",
+		"proxy / localhost:8080 {\n policy weighted_least_conn\n slow_start 0s\n}",
+	} {
+		_, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
+
+func TestConsistentHashUpstreams(t *testing.T) {
+	config := "proxy / localhost:8080 localhost:8081 {\n policy consistent_hash bucket_key\n hash_load_factor 1.5\n}"
+	upstreams, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, ok := upstreams[0].(*staticUpstream).Policy.(*ConsistentHash)
+	if !ok {
+		t.Fatalf("Expected consistent hash policy, got %T", upstreams[0].(*staticUpstream).Policy)
+	}
+	if policy.Key != "bucket_key" || policy.LoadFactor != 1.5 {
+		t.Errorf("Unexpected policy %+v", policy)
+	}
+
+	for i, config := range []string{
+		"proxy / localhost:8080 {\n policy consistent_hash object\n}",
+		"proxy / localhost:8080 {\n policy consistent_hash header:\n}",
+		"proxy / localhost:8080 {\n policy consistent_hash\n hash_load_factor 0.5\n}",
+		"proxy / localhost:8080 {\n hash_load_factor 2\n}",
+	} {
+		_, err := NewStaticUpstreams(caddyfile.NewDispenser("Testfile", strings.NewReader(config)), "")
+		if err == nil {
+			t.Errorf("Test %d: expected error for %q", i, config)
+		}
+	}
+}
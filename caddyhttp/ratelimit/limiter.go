@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a Limiter forgets about
+// keys whose buckets have refilled completely.
+const sweepInterval = time.Minute
+
+// Limiter is a set of token buckets, one per key, that
+// refill at Rate tokens per second up to Burst tokens.
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate requests per
+// second with bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take takes a token from the bucket of key. If there is
+// none, it returns how long it takes until there is one.
+func (l *Limiter) Take(key string) time.Duration {
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if t.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(t)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: t}
+		l.buckets[key] = b
+	}
+	b.refill(t, l.Rate, l.Burst)
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func (b *tokenBucket) refill(t time.Time, rate float64, burst int) {
+	if elapsed := t.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = t
+}
+
+// sweep removes full buckets, which behave the same as new ones.
+// l.mu must be held.
+func (l *Limiter) sweep(t time.Time) {
+	for key, b := range l.buckets {
+		b.refill(t, l.Rate, l.Burst)
+		if b.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = t
+}
@@ -0,0 +1,119 @@
+// Package ratelimit is middleware that limits the rate of requests
+// per client IP, bucket, access key or any other placeholder value,
+// so that a single tenant cannot degrade a shared cluster.
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/prometheus"
+)
+
+// Operation classes that can be limited separately.
+const (
+	ClassRead  = "read"
+	ClassWrite = "write"
+	ClassList  = "list"
+	ClassAll   = "all"
+)
+
+// RateLimit is middleware that rejects requests exceeding the
+// configured rates with an S3 SlowDown error.
+type RateLimit struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule limits the requests that share the same value of Key.
+type Rule struct {
+	// Key is a placeholder string like {remote} or {s3_bucket};
+	// requests for which it evaluates to the empty string are not
+	// limited by this rule.
+	Key string
+
+	// Limits maps an operation class to the rate requests of that
+	// class are limited to. The ClassAll limit applies to every
+	// request, in addition to the limit of its class.
+	Limits map[string]*Limiter
+
+	// Except lists paths that are not limited.
+	Except []string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (rl RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	class := operationClass(r)
+	repl := httpserver.NewReplacer(r, nil, "")
+
+	for _, rule := range rl.Rules {
+		if rule.excepted(r) {
+			continue
+		}
+		key := repl.Replace(rule.Key)
+		if key == "" || key == "-" {
+			continue
+		}
+		for _, c := range []string{class, ClassAll} {
+			limiter, ok := rule.Limits[c]
+			if !ok {
+				continue
+			}
+			if wait := limiter.Take(key); wait > 0 {
+				prometheus.CountRateLimited(rule.Key, c)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				httpserver.WriteS3Error(w, r, errSlowDown)
+				return 0, nil
+			}
+		}
+	}
+
+	return rl.Next.ServeHTTP(w, r)
+}
+
+func (rule *Rule) excepted(r *http.Request) bool {
+	for _, path := range rule.Except {
+		if httpserver.Path(r.URL.Path).Matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// listOperations are the S3 operations of ClassList.
+var listOperations = map[string]bool{
+	"ListBuckets":          true,
+	"ListObjects":          true,
+	"ListObjectsV2":        true,
+	"ListObjectVersions":   true,
+	"ListMultipartUploads": true,
+	"ListParts":            true,
+}
+
+// operationClass returns the operation class of r.
+func operationClass(r *http.Request) string {
+	s3req := httpserver.GetS3Request(r)
+	if s3req == nil {
+		s3req = httpserver.ParseS3Request(r, nil)
+	}
+	if listOperations[s3req.Operation] {
+		return ClassList
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ClassRead
+	}
+	return ClassWrite
+}
+
+var errSlowDown = httpserver.S3Error{
+	Code:       "SlowDown",
+	Message:    "Please reduce your request rate.",
+	HTTPStatus: http.StatusServiceUnavailable,
+}
+
+// now is time.Now; it is a variable so tests can change the clock.
+var now = time.Now
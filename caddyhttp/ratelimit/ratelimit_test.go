@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func setNow(t time.Time) func() {
+	old := now
+	now = func() time.Time { return t }
+	return func() { now = old }
+}
+
+func TestLimiter(t *testing.T) {
+	start := time.Now()
+	defer setNow(start)()
+
+	l := NewLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if wait := l.Take("a"); wait != 0 {
+			t.Fatalf("Request %d: expected burst to be allowed, got wait %v", i, wait)
+		}
+	}
+	if wait := l.Take("a"); wait != 500*time.Millisecond {
+		t.Errorf("Expected wait of 500ms, got %v", wait)
+	}
+	if wait := l.Take("b"); wait != 0 {
+		t.Errorf("Expected other key to be allowed, got wait %v", wait)
+	}
+
+	defer setNow(start.Add(500 * time.Millisecond))()
+	if wait := l.Take("a"); wait != 0 {
+		t.Errorf("Expected refilled token to be allowed, got wait %v", wait)
+	}
+
+	defer setNow(start.Add(time.Hour))()
+	l.Take("c")
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("Expected full bucket to be swept")
+	}
+}
+
+func TestOperationClass(t *testing.T) {
+	for i, test := range []struct {
+		method, url string
+		expected    string
+	}{
+		{"GET", "/bucket/key", ClassRead},
+		{"HEAD", "/bucket/key", ClassRead},
+		{"GET", "/bucket", ClassList},
+		{"GET", "/bucket?list-type=2", ClassList},
+		{"GET", "/", ClassList},
+		{"GET", "/bucket/key?uploadId=1", ClassList},
+		{"PUT", "/bucket/key", ClassWrite},
+		{"DELETE", "/bucket/key", ClassWrite},
+		{"POST", "/bucket?delete", ClassWrite},
+	} {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if class := operationClass(r); class != test.expected {
+			t.Errorf("Test %d: expected class %s, got %s", i, test.expected, class)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer setNow(time.Now())()
+
+	rl := RateLimit{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Rules: []*Rule{{
+			Key: "{s3_bucket}",
+			Limits: map[string]*Limiter{
+				ClassWrite: NewLimiter(1, 1),
+				ClassAll:   NewLimiter(1, 3),
+			},
+			Except: []string{"/health"},
+		}},
+	}
+
+	for i, test := range []struct {
+		method, url    string
+		expectedStatus int
+	}{
+		{"PUT", "/bucket1/a", http.StatusOK},
+		{"PUT", "/bucket1/b", http.StatusServiceUnavailable},
+		{"PUT", "/bucket2/a", http.StatusOK},
+		{"GET", "/bucket1/a", http.StatusOK},
+		{"GET", "/bucket1/a", http.StatusOK},
+		{"GET", "/bucket1/a", http.StatusServiceUnavailable},
+		{"GET", "/health", http.StatusOK},
+		{"GET", "/", http.StatusOK}, // no bucket, not limited
+		{"GET", "/", http.StatusOK},
+		{"GET", "/", http.StatusOK},
+		{"GET", "/", http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		w := httptest.NewRecorder()
+
+		code, err := rl.ServeHTTP(w, r)
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+		}
+		if code == 0 {
+			code = w.Code
+		}
+		if code != test.expectedStatus {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.expectedStatus, code)
+		}
+		if code == http.StatusServiceUnavailable {
+			if !strings.Contains(w.Body.String(), "<Code>SlowDown</Code>") {
+				t.Errorf("Test %d: expected SlowDown error, got %s", i, w.Body.String())
+			}
+			if w.Header().Get("Retry-After") != "1" {
+				t.Errorf("Test %d: expected Retry-After 1, got %s", i, w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
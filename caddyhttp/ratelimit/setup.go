@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("ratelimit", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// keyAliases are shorthands for common rate limiting keys. Rate
+// limits apply after s3auth, so that only signatures it verified
+// count against an access key; requests s3auth rejects are not
+// counted against any key. Sites without s3auth should not limit
+// by access_key, since anyone can claim any access key there.
+var keyAliases = map[string]string{
+	"ip":         "{remote}",
+	"bucket":     "{s3_bucket}",
+	"access_key": "{s3_access_key}",
+}
+
+// setup configures a new RateLimit middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := rateLimitParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return RateLimit{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// rateLimitParse parses blocks like:
+//
+//	ratelimit [ip|bucket|access_key|<placeholder>] {
+//		read  <rate> [burst]
+//		write <rate> [burst]
+//		list  <rate> [burst]
+//		all   <rate> [burst]
+//		except <paths...>
+//	}
+//
+// The rate is a number of requests per second, or per
+// minute or hour if followed by /m or /h.
+func rateLimitParse(c *caddy.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{Key: keyAliases["ip"], Limits: make(map[string]*Limiter)}
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			rule.Key = args[0]
+			if key, ok := keyAliases[args[0]]; ok {
+				rule.Key = key
+			}
+		default:
+			return rules, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch class := c.Val(); class {
+			case ClassRead, ClassWrite, ClassList, ClassAll:
+				if _, ok := rule.Limits[class]; ok {
+					return rules, c.Errf("ratelimit: duplicate %s limit", class)
+				}
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return rules, c.ArgErr()
+				}
+				rate, err := parseRate(args[0])
+				if err != nil {
+					return rules, c.Errf("ratelimit: %v", err)
+				}
+				burst := int(math.Ceil(rate))
+				if len(args) == 2 {
+					burst, err = strconv.Atoi(args[1])
+					if err != nil || burst < 1 {
+						return rules, c.Errf("ratelimit: invalid burst '%s'", args[1])
+					}
+				}
+				if burst < 1 {
+					burst = 1
+				}
+				rule.Limits[class] = NewLimiter(rate, burst)
+			case "except":
+				paths := c.RemainingArgs()
+				if len(paths) == 0 {
+					return rules, c.ArgErr()
+				}
+				rule.Except = append(rule.Except, paths...)
+			default:
+				return rules, c.Errf("ratelimit: unknown property '%s'", c.Val())
+			}
+		}
+
+		if len(rule.Limits) == 0 {
+			return rules, c.Err("ratelimit: at least one of read, write, list or all must be set")
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseRate parses a rate like 100, 100/s, 6000/m or 1000/h
+// and returns it in requests per second.
+func parseRate(s string) (float64, error) {
+	per := 1.0
+	if i := strings.Index(s, "/"); i >= 0 {
+		switch s[i+1:] {
+		case "s":
+		case "m":
+			per = 60
+		case "h":
+			per = 3600
+		default:
+			return 0, fmt.Errorf("invalid rate unit in '%s'", s)
+		}
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+	return n / per, nil
+}
@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `ratelimit {
+		all 100
+	}`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(RateLimit)
+	if !ok {
+		t.Fatalf("Expected handler to be type RateLimit, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestRateLimitParse(t *testing.T) {
+	type limit struct {
+		rate  float64
+		burst int
+	}
+	tests := []struct {
+		input          string
+		shouldErr      bool
+		expectedKeys   []string
+		expectedLimits []map[string]limit
+	}{
+		{`ratelimit {
+			all 10
+		}`, false, []string{"{remote}"}, []map[string]limit{{ClassAll: {10, 10}}}},
+		{`ratelimit access_key {
+			read 100 200
+			write 600/m
+			list 3600/h 5
+			except /health
+		}`, false, []string{"{s3_access_key}"}, []map[string]limit{{
+			ClassRead:  {100, 200},
+			ClassWrite: {10, 10},
+			ClassList:  {1, 5},
+		}}},
+		{`ratelimit bucket {
+			write 0.5
+		}
+		ratelimit {>X-Tenant} {
+			all 50
+		}`, false, []string{"{s3_bucket}", "{>X-Tenant}"}, []map[string]limit{
+			{ClassWrite: {0.5, 1}},
+			{ClassAll: {50, 50}},
+		}},
+		{`ratelimit`, true, nil, nil},
+		{`ratelimit a b {
+			all 1
+		}`, true, nil, nil},
+		{`ratelimit {
+			all 1
+			all 2
+		}`, true, nil, nil},
+		{`ratelimit {
+			all fast
+		}`, true, nil, nil},
+		{`ratelimit {
+			all 10/d
+		}`, true, nil, nil},
+		{`ratelimit {
+			all NaN
+		}`, true, nil, nil},
+		{`ratelimit {
+			read Inf
+		}`, true, nil, nil},
+		{`ratelimit {
+			write 1e400
+		}`, true, nil, nil},
+		{`ratelimit {
+			all 10 0
+		}`, true, nil, nil},
+		{`ratelimit {
+			delete 10
+		}`, true, nil, nil},
+	}
+
+	for i, test := range tests {
+		rules, err := rateLimitParse(caddy.NewTestController("http", test.input))
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(rules) != len(test.expectedKeys) {
+			t.Fatalf("Test %d: expected %d rules, got %d", i, len(test.expectedKeys), len(rules))
+		}
+		for j, rule := range rules {
+			if rule.Key != test.expectedKeys[j] {
+				t.Errorf("Test %d, rule %d: expected key %s, got %s", i, j, test.expectedKeys[j], rule.Key)
+			}
+			if len(rule.Limits) != len(test.expectedLimits[j]) {
+				t.Errorf("Test %d, rule %d: expected %d limits, got %d", i, j, len(test.expectedLimits[j]), len(rule.Limits))
+			}
+			for class, expected := range test.expectedLimits[j] {
+				l, ok := rule.Limits[class]
+				if !ok {
+					t.Errorf("Test %d, rule %d: expected %s limit", i, j, class)
+					continue
+				}
+				if l.Rate != expected.rate || l.Burst != expected.burst {
+					t.Errorf("Test %d, rule %d: expected %s limit %v/%d, got %v/%d",
+						i, j, class, expected.rate, expected.burst, l.Rate, l.Burst)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package s3auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchAccessKey is returned by a CredentialProvider
+// if it does not know the access key.
+var ErrNoSuchAccessKey = errors.New("no such access key")
+
+// CredentialProvider is a source of S3 credentials.
+type CredentialProvider interface {
+	// SecretKey returns the secret key that belongs to accessKey,
+	// or ErrNoSuchAccessKey if there is none.
+	SecretKey(accessKey string) (string, error)
+}
+
+var supportedProviders = make(map[string]func(args []string) (CredentialProvider, error))
+
+func init() {
+	RegisterCredentialProvider("file", newFileCredentials)
+	RegisterCredentialProvider("http", newHTTPCredentials)
+}
+
+// RegisterCredentialProvider adds a custom credential source to
+// s3auth. newProvider is called with the arguments that follow
+// the name in the credentials subdirective.
+func RegisterCredentialProvider(name string, newProvider func(args []string) (CredentialProvider, error)) {
+	supportedProviders[name] = newProvider
+}
+
+// StaticCredentials is a fixed map of access keys to secret keys.
+type StaticCredentials map[string]string
+
+// SecretKey implements CredentialProvider.
+func (s StaticCredentials) SecretKey(accessKey string) (string, error) {
+	secret, ok := s[accessKey]
+	if !ok {
+		return "", ErrNoSuchAccessKey
+	}
+	return secret, nil
+}
+
+// ReadCredentials reads StaticCredentials from r. Every non-empty
+// line that is not a # comment holds an access key and its secret
+// key, separated by whitespace.
+func ReadCredentials(r io.Reader) (StaticCredentials, error) {
+	creds := make(StaticCredentials)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected access key and secret key, got %d fields", line, len(fields))
+		}
+		creds[fields[0]] = fields[1]
+	}
+	return creds, scanner.Err()
+}
+
+// credentials file <path>
+func newFileCredentials(args []string) (CredentialProvider, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected a credentials file")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCredentials(f)
+}
+
+// HTTPCredentials looks up secret keys from an HTTP endpoint. The
+// access key replaces the {access_key} placeholder in URL, or is
+// appended as the access_key query parameter if there is none. The
+// endpoint must answer with a JSON object like {"secret_key": "..."}
+// or with status 404 for unknown access keys.
+type HTTPCredentials struct {
+	URL    string
+	Client *http.Client
+}
+
+// SecretKey implements CredentialProvider.
+func (h HTTPCredentials) SecretKey(accessKey string) (string, error) {
+	u := h.URL
+	if strings.Contains(u, "{access_key}") {
+		u = strings.Replace(u, "{access_key}", url.PathEscape(accessKey), -1)
+	} else if strings.Contains(u, "?") {
+		u += "&access_key=" + url.QueryEscape(accessKey)
+	} else {
+		u += "?access_key=" + url.QueryEscape(accessKey)
+	}
+
+	resp, err := h.Client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", ErrNoSuchAccessKey
+	default:
+		return "", fmt.Errorf("credential lookup returned %s", resp.Status)
+	}
+
+	var body struct {
+		SecretKey string `json:"secret_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.SecretKey == "" {
+		return "", ErrNoSuchAccessKey
+	}
+	return body.SecretKey, nil
+}
+
+// credentials http <url> [timeout]
+func newHTTPCredentials(args []string) (CredentialProvider, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("expected a lookup URL and an optional timeout")
+	}
+	timeout := 5 * time.Second
+	if len(args) == 2 {
+		dur, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		timeout = dur
+	}
+	return HTTPCredentials{
+		URL:    args[0],
+		Client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// maxCachedCredentials bounds the size of a CachedCredentials
+// map, which also caches misses and thus could otherwise be
+// grown without limit by clients sending random access keys.
+const maxCachedCredentials = 10000
+
+// CachedCredentials remembers the results of another provider,
+// both hits and misses, for TTL.
+type CachedCredentials struct {
+	Provider CredentialProvider
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedCredential
+}
+
+type cachedCredential struct {
+	secret  string
+	err     error
+	expires time.Time
+}
+
+// NewCachedCredentials returns a CachedCredentials for provider.
+func NewCachedCredentials(provider CredentialProvider, ttl time.Duration) *CachedCredentials {
+	return &CachedCredentials{
+		Provider: provider,
+		TTL:      ttl,
+		entries:  make(map[string]cachedCredential),
+	}
+}
+
+// SecretKey implements CredentialProvider. Lookup errors other
+// than ErrNoSuchAccessKey are not cached.
+func (c *CachedCredentials) SecretKey(accessKey string) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[accessKey]
+	c.mu.Unlock()
+	if ok && now().Before(entry.expires) {
+		return entry.secret, entry.err
+	}
+
+	secret, err := c.Provider.SecretKey(accessKey)
+	if err != nil && err != ErrNoSuchAccessKey {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCachedCredentials {
+		c.entries = make(map[string]cachedCredential)
+	}
+	c.entries[accessKey] = cachedCredential{secret: secret, err: err, expires: now().Add(c.TTL)}
+	c.mu.Unlock()
+
+	return secret, err
+}
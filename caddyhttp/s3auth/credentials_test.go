@@ -0,0 +1,107 @@
+package s3auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCredentials(t *testing.T) {
+	creds, err := ReadCredentials(strings.NewReader(`
+# comment
+AK1 SK1
+	AK2   SK2
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(creds) != 2 || creds["AK1"] != "SK1" || creds["AK2"] != "SK2" {
+		t.Errorf("Unexpected credentials %v", creds)
+	}
+
+	if _, err := ReadCredentials(strings.NewReader("AK1 SK1\nAK2\n")); err == nil {
+		t.Error("Expected error for a line without secret key, got none")
+	}
+}
+
+func TestHTTPCredentials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ak := r.URL.Query().Get("access_key")
+		if ak == "" {
+			ak = strings.TrimPrefix(r.URL.Path, "/keys/")
+		}
+		switch ak {
+		case "AK1":
+			fmt.Fprint(w, `{"secret_key": "SK1"}`)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	for i, test := range []struct {
+		url, accessKey string
+		expectedSecret string
+		expectedErr    bool
+		noSuchKey      bool
+	}{
+		{ts.URL + "/lookup", "AK1", "SK1", false, false},
+		{ts.URL + "/lookup?tenant=x", "AK1", "SK1", false, false},
+		{ts.URL + "/keys/{access_key}", "AK1", "SK1", false, false},
+		{ts.URL + "/lookup", "AK2", "", true, true},
+		{ts.URL + "/lookup", "broken", "", true, false},
+	} {
+		h := HTTPCredentials{URL: test.url, Client: ts.Client()}
+		secret, err := h.SecretKey(test.accessKey)
+		if test.expectedErr != (err != nil) {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.expectedErr, err)
+		}
+		if test.noSuchKey && err != ErrNoSuchAccessKey {
+			t.Errorf("Test %d: expected ErrNoSuchAccessKey, got %v", i, err)
+		}
+		if secret != test.expectedSecret {
+			t.Errorf("Test %d: expected secret %q, got %q", i, test.expectedSecret, secret)
+		}
+	}
+}
+
+type countingProvider struct {
+	StaticCredentials
+	lookups int
+}
+
+func (c *countingProvider) SecretKey(accessKey string) (string, error) {
+	c.lookups++
+	return c.StaticCredentials.SecretKey(accessKey)
+}
+
+func TestCachedCredentials(t *testing.T) {
+	start := time.Now()
+	defer setNow(start)()
+
+	provider := &countingProvider{StaticCredentials: StaticCredentials{"AK1": "SK1"}}
+	cache := NewCachedCredentials(provider, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if secret, err := cache.SecretKey("AK1"); err != nil || secret != "SK1" {
+			t.Errorf("Expected SK1, got %q, %v", secret, err)
+		}
+		if _, err := cache.SecretKey("AK2"); err != ErrNoSuchAccessKey {
+			t.Errorf("Expected ErrNoSuchAccessKey, got %v", err)
+		}
+	}
+	if provider.lookups != 2 {
+		t.Errorf("Expected 2 lookups, got %d", provider.lookups)
+	}
+
+	defer setNow(start.Add(2 * time.Minute))()
+	cache.SecretKey("AK1")
+	if provider.lookups != 3 {
+		t.Errorf("Expected expired entry to be looked up again, got %d lookups", provider.lookups)
+	}
+}
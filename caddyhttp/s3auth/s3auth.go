@@ -0,0 +1,154 @@
+// Package s3auth is middleware that verifies AWS Signature Version 4
+// and Version 2 signatures of S3 requests at the edge, so that forged
+// or expired requests are rejected before they reach the backend.
+package s3auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// S3Auth is middleware that verifies the signatures of S3 requests.
+// Anonymous requests are passed through unless DenyAnonymous is set,
+// since only the backend knows which buckets are public.
+type S3Auth struct {
+	Next          httpserver.Handler
+	Credentials   CredentialProvider
+	Region        string        // if set, the credential scope must name this region
+	MaxSkew       time.Duration // how far the request time may be off from ours
+	DenyAnonymous bool
+	Except        []string // paths that are not authenticated
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (a S3Auth) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	// CORS preflight requests are never signed
+	if r.Method == http.MethodOptions {
+		return a.Next.ServeHTTP(w, r)
+	}
+	for _, path := range a.Except {
+		if httpserver.Path(r.URL.Path).Matches(path) {
+			return a.Next.ServeHTTP(w, r)
+		}
+	}
+
+	err := a.verify(r)
+	if s3err, ok := err.(httpserver.S3Error); ok {
+		httpserver.WriteS3Error(w, r, s3err)
+		return 0, nil
+	}
+	if err != nil {
+		// the backend verifies signatures as well, so rather than
+		// failing every request while the credential source is
+		// unreachable, let it have the final say
+		log.Printf("[WARNING] s3auth: unable to verify request to %s: %v", r.URL.Path, err)
+	} else if signer := a.chunkSigner(r); signer != nil {
+		// the chunks of the body are verified as it is proxied
+		r = r.WithContext(context.WithValue(r.Context(), httpserver.S3ChunkSignerCtxKey, signer))
+	}
+
+	return a.Next.ServeHTTP(w, r)
+}
+
+// originalURL returns the URL r was received with, which is
+// what the client signed, before any rewrite.
+func originalURL(r *http.Request) *url.URL {
+	if u, ok := r.Context().Value(httpserver.OriginalURLCtxKey).(url.URL); ok {
+		return &u
+	}
+	return r.URL
+}
+
+// verify checks the signature of r. It returns an httpserver.S3Error
+// if the request must be rejected, or any other error if the request
+// could not be verified.
+func (a S3Auth) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	query := originalURL(r).Query()
+
+	switch {
+	case strings.HasPrefix(auth, httpserver.S3SignV4Algorithm+" "):
+		return a.verifyV4(r, auth)
+	case strings.HasPrefix(auth, "AWS "):
+		return a.verifyV2(r, auth)
+	case auth != "":
+		return errUnsupportedAuthorization
+	case query.Get("X-Amz-Algorithm") != "":
+		return a.verifyV4Presigned(r, query)
+	case query.Get("AWSAccessKeyId") != "" || query.Get("Signature") != "":
+		return a.verifyV2Presigned(r, query)
+	}
+
+	if a.DenyAnonymous {
+		return errAccessDenied
+	}
+	return nil
+}
+
+// secretKey looks up the secret key of accessKey.
+func (a S3Auth) secretKey(accessKey string) (string, error) {
+	secret, err := a.Credentials.SecretKey(accessKey)
+	if err == ErrNoSuchAccessKey {
+		return "", errInvalidAccessKeyID
+	}
+	return secret, err
+}
+
+// checkSkew returns errRequestTimeTooSkewed if t is too far
+// from the current time.
+func (a S3Auth) checkSkew(t time.Time) error {
+	skew := now().Sub(t)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.MaxSkew {
+		return errRequestTimeTooSkewed
+	}
+	return nil
+}
+
+// parseHTTPDate parses the value of a Date header. Besides the
+// formats of http.ParseTime, S3 clients commonly send RFC 1123
+// dates with a numeric zone.
+func parseHTTPDate(value string) (time.Time, error) {
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Parse(time.RFC1123Z, value)
+	}
+	return t, nil
+}
+
+// now is time.Now; it is a variable so tests can change the clock.
+var now = time.Now
+
+// Errors reported to clients, as defined by the S3 API.
+var (
+	errAccessDenied = httpserver.S3Error{
+		Code: "AccessDenied", Message: "Access Denied.", HTTPStatus: http.StatusForbidden}
+	errExpiredPresignedRequest = httpserver.S3Error{
+		Code: "AccessDenied", Message: "Request has expired.", HTTPStatus: http.StatusForbidden}
+	errPresignedRequestNotYetValid = httpserver.S3Error{
+		Code: "AccessDenied", Message: "Request is not valid yet.", HTTPStatus: http.StatusForbidden}
+	errMissingDate = httpserver.S3Error{
+		Code: "AccessDenied", Message: "AWS authentication requires a valid Date or x-amz-date header.", HTTPStatus: http.StatusForbidden}
+	errUnsupportedAuthorization = httpserver.S3Error{
+		Code: "AccessDenied", Message: "Unsupported Authorization Type.", HTTPStatus: http.StatusForbidden}
+	errInvalidAccessKeyID = httpserver.S3Error{
+		Code: "InvalidAccessKeyId", Message: "The AWS Access Key Id you provided does not exist in our records.", HTTPStatus: http.StatusForbidden}
+	errSignatureDoesNotMatch = httpserver.S3Error{
+		Code: "SignatureDoesNotMatch", Message: "The request signature we calculated does not match the signature you provided. Check your key and signing method.", HTTPStatus: http.StatusForbidden}
+	errRequestTimeTooSkewed = httpserver.S3Error{
+		Code: "RequestTimeTooSkewed", Message: "The difference between the request time and the current time is too large.", HTTPStatus: http.StatusForbidden}
+	errAuthorizationHeaderMalformed = httpserver.S3Error{
+		Code: "AuthorizationHeaderMalformed", Message: "The authorization header is malformed.", HTTPStatus: http.StatusBadRequest}
+	errAuthorizationQueryParametersError = httpserver.S3Error{
+		Code: "AuthorizationQueryParametersError", Message: "Error parsing the X-Amz-Credential parameter.", HTTPStatus: http.StatusBadRequest}
+	errInvalidRegion = httpserver.S3Error{
+		Code: "AuthorizationHeaderMalformed", Message: "The authorization header is malformed; the region is wrong.", HTTPStatus: http.StatusBadRequest}
+)
@@ -0,0 +1,117 @@
+package s3auth
+
+import (
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("s3auth", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// defaultMaxSkew is the clock skew S3 tolerates.
+const defaultMaxSkew = 15 * time.Minute
+
+// setup configures a new S3Auth middleware instance.
+func setup(c *caddy.Controller) error {
+	auth, err := s3AuthParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		auth.Next = next
+		return auth
+	})
+
+	return nil
+}
+
+// s3AuthParse parses a block like:
+//
+//	s3auth {
+//		credentials file|http <args...>
+//		cache <ttl>
+//		region <region>
+//		max_skew <duration>
+//		deny_anonymous
+//		except <paths...>
+//	}
+func s3AuthParse(c *caddy.Controller) (S3Auth, error) {
+	auth := S3Auth{MaxSkew: defaultMaxSkew}
+	var cacheTTL time.Duration
+
+	for c.Next() {
+		if auth.Credentials != nil {
+			return auth, c.Err("s3auth: can only be configured once per site")
+		}
+		if len(c.RemainingArgs()) != 0 {
+			return auth, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "credentials":
+				if !c.NextArg() {
+					return auth, c.ArgErr()
+				}
+				newProvider, ok := supportedProviders[c.Val()]
+				if !ok {
+					return auth, c.Errf("s3auth: unknown credential source '%s'", c.Val())
+				}
+				provider, err := newProvider(c.RemainingArgs())
+				if err != nil {
+					return auth, c.Errf("s3auth: %v", err)
+				}
+				auth.Credentials = provider
+			case "cache":
+				if !c.NextArg() {
+					return auth, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return auth, c.Errf("s3auth: unable to parse cache duration '%s'", c.Val())
+				}
+				cacheTTL = dur
+			case "region":
+				if !c.NextArg() {
+					return auth, c.ArgErr()
+				}
+				auth.Region = c.Val()
+			case "max_skew":
+				if !c.NextArg() {
+					return auth, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return auth, c.Errf("s3auth: unable to parse max_skew duration '%s'", c.Val())
+				}
+				auth.MaxSkew = dur
+			case "deny_anonymous":
+				auth.DenyAnonymous = true
+			case "except":
+				paths := c.RemainingArgs()
+				if len(paths) == 0 {
+					return auth, c.ArgErr()
+				}
+				auth.Except = append(auth.Except, paths...)
+			default:
+				return auth, c.Errf("s3auth: unknown property '%s'", c.Val())
+			}
+		}
+
+		if auth.Credentials == nil {
+			return auth, c.Err("s3auth: credentials are required")
+		}
+		if cacheTTL > 0 {
+			auth.Credentials = NewCachedCredentials(auth.Credentials, cacheTTL)
+		}
+	}
+
+	return auth, nil
+}
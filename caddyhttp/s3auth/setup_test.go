@@ -0,0 +1,120 @@
+package s3auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `s3auth {
+		credentials http http://localhost:8080/keys
+	}`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(S3Auth)
+	if !ok {
+		t.Fatalf("Expected handler to be type S3Auth, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestS3AuthParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credFile := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credFile, []byte("AK1 SK1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input           string
+		shouldErr       bool
+		expectedRegion  string
+		expectedSkew    time.Duration
+		expectedDeny    bool
+		expectedExcept  []string
+		expectedCaching bool
+	}{
+		{`s3auth {
+			credentials file ` + credFile + `
+		}`, false, "", defaultMaxSkew, false, nil, false},
+		{`s3auth {
+			credentials http http://localhost:8080/keys 2s
+			cache 1m
+			region us-east-1
+			max_skew 5m
+			deny_anonymous
+			except /health /metrics
+		}`, false, "us-east-1", 5 * time.Minute, true, []string{"/health", "/metrics"}, true},
+		{`s3auth`, true, "", 0, false, nil, false},
+		{`s3auth arg {
+			credentials file ` + credFile + `
+		}`, true, "", 0, false, nil, false},
+		{`s3auth {
+			credentials ldap
+		}`, true, "", 0, false, nil, false},
+		{`s3auth {
+			credentials file /does/not/exist
+		}`, true, "", 0, false, nil, false},
+		{`s3auth {
+			credentials http http://localhost:8080/keys
+			max_skew forever
+		}`, true, "", 0, false, nil, false},
+		{`s3auth {
+			credentials http http://localhost:8080/keys
+			unknown
+		}`, true, "", 0, false, nil, false},
+		{`s3auth {
+			credentials http http://localhost:8080/keys
+		}
+		s3auth {
+			credentials http http://localhost:8080/keys
+		}`, true, "", 0, false, nil, false},
+	}
+
+	for i, test := range tests {
+		auth, err := s3AuthParse(caddy.NewTestController("http", test.input))
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if auth.Region != test.expectedRegion {
+			t.Errorf("Test %d: expected region %q, got %q", i, test.expectedRegion, auth.Region)
+		}
+		if auth.MaxSkew != test.expectedSkew {
+			t.Errorf("Test %d: expected max skew %v, got %v", i, test.expectedSkew, auth.MaxSkew)
+		}
+		if auth.DenyAnonymous != test.expectedDeny {
+			t.Errorf("Test %d: expected deny_anonymous %v, got %v", i, test.expectedDeny, auth.DenyAnonymous)
+		}
+		if len(auth.Except) != len(test.expectedExcept) {
+			t.Errorf("Test %d: expected except %v, got %v", i, test.expectedExcept, auth.Except)
+		}
+		if _, ok := auth.Credentials.(*CachedCredentials); ok != test.expectedCaching {
+			t.Errorf("Test %d: expected cached credentials %v, got %T", i, test.expectedCaching, auth.Credentials)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package s3auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// v2Subresources are the query parameters that are part of the
+// canonicalized resource of a SigV2 request, in sorted order.
+var v2Subresources = []string{
+	"acl",
+	"cors",
+	"delete",
+	"lifecycle",
+	"location",
+	"logging",
+	"notification",
+	"partNumber",
+	"policy",
+	"requestPayment",
+	"response-cache-control",
+	"response-content-disposition",
+	"response-content-encoding",
+	"response-content-language",
+	"response-content-type",
+	"response-expires",
+	"tagging",
+	"torrent",
+	"uploadId",
+	"uploads",
+	"versionId",
+	"versioning",
+	"versions",
+	"website",
+}
+
+// verifyV2 verifies a request signed with an "AWS" Authorization header.
+func (a S3Auth) verifyV2(r *http.Request, auth string) error {
+	credential := auth[len("AWS "):]
+	i := strings.LastIndex(credential, ":")
+	if i <= 0 || i == len(credential)-1 {
+		return errAuthorizationHeaderMalformed
+	}
+	accessKey, signature := credential[:i], credential[i+1:]
+
+	// with x-amz-date set, the Date line of the string to sign
+	// stays empty; x-amz-date is signed as an amz header instead
+	var date time.Time
+	var dateLine string
+	if amzDate := r.Header.Get("X-Amz-Date"); amzDate != "" {
+		t, err := parseHTTPDate(amzDate)
+		if err != nil {
+			return errMissingDate
+		}
+		date = t
+	} else if httpDate := r.Header.Get("Date"); httpDate != "" {
+		t, err := parseHTTPDate(httpDate)
+		if err != nil {
+			return errMissingDate
+		}
+		date, dateLine = t, httpDate
+	} else {
+		return errMissingDate
+	}
+	if err := a.checkSkew(date); err != nil {
+		return err
+	}
+
+	secret, err := a.secretKey(accessKey)
+	if err != nil {
+		return err
+	}
+
+	expected := signatureV2(secret, stringToSignV2(r, dateLine))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+// verifyV2Presigned verifies a request with a SigV2 presigned URL.
+func (a S3Auth) verifyV2Presigned(r *http.Request, query url.Values) error {
+	accessKey := query.Get("AWSAccessKeyId")
+	signature := query.Get("Signature")
+	expires := query.Get("Expires")
+	if accessKey == "" || signature == "" || expires == "" {
+		return errAccessDenied
+	}
+	seconds, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errAccessDenied
+	}
+	if now().After(time.Unix(seconds, 0)) {
+		return errExpiredPresignedRequest
+	}
+
+	secret, err := a.secretKey(accessKey)
+	if err != nil {
+		return err
+	}
+
+	expected := signatureV2(secret, stringToSignV2(r, expires))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+// stringToSignV2 builds the string to sign of r as defined by
+// http://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html
+// dateLine is the value of the Date line: the Date header, the
+// Expires parameter of a presigned URL or empty.
+func stringToSignV2(r *http.Request, dateLine string) string {
+	var buf bytes.Buffer
+	buf.WriteString(r.Method)
+	buf.WriteByte('\n')
+	buf.WriteString(r.Header.Get("Content-MD5"))
+	buf.WriteByte('\n')
+	buf.WriteString(r.Header.Get("Content-Type"))
+	buf.WriteByte('\n')
+	buf.WriteString(dateLine)
+	buf.WriteByte('\n')
+	buf.WriteString(canonicalAmzHeadersV2(r.Header))
+	buf.WriteString(canonicalResourceV2(r))
+	return buf.String()
+}
+
+// canonicalAmzHeadersV2 returns the x-amz-* headers, lower-cased and
+// sorted, one per line.
+func canonicalAmzHeadersV2(header http.Header) string {
+	var names []string
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		values := make([]string, len(header[name]))
+		for i, v := range header[name] {
+			values[i] = strings.TrimSpace(v)
+		}
+		buf.WriteString(strings.ToLower(name))
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(values, ","))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// canonicalResourceV2 returns the path of r, prefixed by the bucket for
+// virtual-host style requests, followed by the signed subresources.
+func canonicalResourceV2(r *http.Request) string {
+	u := originalURL(r)
+	resource := u.EscapedPath()
+	if resource == "" {
+		resource = "/"
+	}
+	s3req := httpserver.GetS3Request(r)
+	if s3req != nil && s3req.Style == httpserver.S3VirtualHostStyle {
+		resource = "/" + s3req.Bucket + resource
+	}
+
+	query := u.Query()
+	var subresources []string
+	for _, name := range v2Subresources {
+		values, ok := query[name]
+		if !ok {
+			continue
+		}
+		if len(values) == 0 || values[0] == "" {
+			subresources = append(subresources, name)
+		} else {
+			subresources = append(subresources, name+"="+values[0])
+		}
+	}
+	if len(subresources) > 0 {
+		resource += "?" + strings.Join(subresources, "&")
+	}
+	return resource
+}
+
+// signatureV2 returns the base64 encoded signature of stringToSign.
+func signatureV2(secret, stringToSign string) string {
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -1,29 +1,28 @@
+// Package s3endpoint is middleware that parses requests as S3
+// requests and attaches the result to the request context, so
+// that other middleware can share a single view of bucket, key
+// and operation.
 package s3endpoint
 
 import (
-	"github.com/journeymidnight/yig-front-caddy"
+	"context"
+	"net/http"
+
 	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
 )
 
-func init() {
-	caddy.RegisterPlugin("s3endpoint", caddy.Plugin{
-		ServerType: "s3endpoint",
-		Action:     setupS3Endpoint,
-	})
+// S3Endpoint is middleware that attaches a parsed
+// httpserver.S3Request to every request.
+type S3Endpoint struct {
+	Next      httpserver.Handler
+	Endpoints []string
 }
 
-func setupS3Endpoint(c *caddy.Controller) error {
-	config := httpserver.GetConfig(c)
+// ServeHTTP implements the httpserver.Handler interface.
+func (s S3Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	s3req := httpserver.ParseS3Request(r, s.Endpoints)
+	c := context.WithValue(r.Context(), httpserver.S3RequestCtxKey, s3req)
+	r = r.WithContext(c)
 
-	for c.Next() {
-		if !c.NextArg() {
-			return c.ArgErr()
-		}
-		config.S3Endpoint = c.Val()
-		if c.NextArg() {
-			// only one argument allowed
-			return c.ArgErr()
-		}
-	}
-	return nil
+	return s.Next.ServeHTTP(w, r)
 }
@@ -0,0 +1,39 @@
+package s3endpoint
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestS3EndpointHandler(t *testing.T) {
+	var got *httpserver.S3Request
+	handler := S3Endpoint{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			got = httpserver.GetS3Request(r)
+			return 0, nil
+		}),
+		Endpoints: []string{"s3.example.com"},
+	}
+
+	req, err := http.NewRequest("PUT", "http://photos.s3.example.com/2018/cat.jpg?partNumber=2&uploadId=abc", nil)
+	if err != nil {
+		t.Fatal("Could not create HTTP request:", err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got == nil {
+		t.Fatal("Expected S3 request on the context, got none")
+	}
+	expected := httpserver.S3Request{
+		Bucket:    "photos",
+		Key:       "2018/cat.jpg",
+		Style:     httpserver.S3VirtualHostStyle,
+		Operation: "UploadPart",
+	}
+	if *got != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *got)
+	}
+}
@@ -0,0 +1,34 @@
+package s3endpoint
+
+import (
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("s3endpoint", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup configures a new S3Endpoint middleware instance.
+//
+//	s3endpoint s3.example.com [s3.example.net...]
+func setup(c *caddy.Controller) error {
+	config := httpserver.GetConfig(c)
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		config.S3Endpoints = append(config.S3Endpoints, args...)
+	}
+
+	config.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return S3Endpoint{Next: next, Endpoints: config.S3Endpoints}
+	})
+
+	return nil
+}
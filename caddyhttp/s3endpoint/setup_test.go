@@ -0,0 +1,51 @@
+package s3endpoint
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `s3endpoint s3.example.com s3.example.net`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(S3Endpoint)
+	if !ok {
+		t.Fatalf("Expected handler to be type S3Endpoint, got: %#v", handler)
+	}
+
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+
+	expected := []string{"s3.example.com", "s3.example.net"}
+	if !reflect.DeepEqual(myHandler.Endpoints, expected) {
+		t.Errorf("Expected endpoints %v, got %v", expected, myHandler.Endpoints)
+	}
+	if !reflect.DeepEqual(httpserver.GetConfig(c).S3Endpoints, expected) {
+		t.Errorf("Expected site endpoints %v, got %v", expected, httpserver.GetConfig(c).S3Endpoints)
+	}
+}
+
+func TestSetupWithoutArgs(t *testing.T) {
+	c := caddy.NewTestController("http", `s3endpoint`)
+	err := setup(c)
+	if err == nil {
+		t.Error("Expected an error, got none")
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) != 0 {
+		t.Fatal("Expected no middleware")
+	}
+}
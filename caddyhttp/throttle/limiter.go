@@ -0,0 +1,86 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a Limiter forgets about
+// keys whose buckets have refilled completely.
+const sweepInterval = time.Minute
+
+// Limiter is a set of token buckets, one per key, that
+// refill at Rate bytes per second up to Burst bytes.
+type Limiter struct {
+	Rate  float64
+	Burst int64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate bytes per
+// second with bursts of up to burst bytes.
+func NewLimiter(rate float64, burst int64) *Limiter {
+	return &Limiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Reserve takes n tokens from the bucket of key and returns
+// how long the caller has to wait before using them. Tokens
+// are taken even if the bucket runs into debt, so that
+// concurrent callers sharing a key queue up behind each other.
+func (l *Limiter) Reserve(key string, n int) time.Duration {
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if t.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(t)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: t}
+		l.buckets[key] = b
+	}
+	b.refill(t, l.Rate, l.Burst)
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.Rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(t time.Time, rate float64, burst int64) {
+	if elapsed := t.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = t
+}
+
+// sweep removes full buckets, which behave the same as new ones.
+// l.mu must be held.
+func (l *Limiter) sweep(t time.Time) {
+	for key, b := range l.buckets {
+		b.refill(t, l.Rate, l.Burst)
+		if b.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = t
+}
@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("throttle", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// keyAliases are shorthands for common throttling keys.
+var keyAliases = map[string]string{
+	"connection": "{remote}:{port}",
+	"ip":         "{remote}",
+	"bucket":     "{s3_bucket}",
+}
+
+// setup configures a new Throttle middleware instance.
+func setup(c *caddy.Controller) error {
+	rules, err := throttleParse(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return Throttle{Next: next, Rules: rules}
+	})
+
+	return nil
+}
+
+// throttleParse parses blocks like:
+//
+//	throttle [connection|ip|bucket|<placeholder>] {
+//		upload   <rate> [burst]
+//		download <rate> [burst]
+//		except <paths...>
+//	}
+//
+// Rates are sizes per second like 512KB or 10MB; the burst
+// defaults to one second worth of bytes.
+func throttleParse(c *caddy.Controller) ([]*Rule, error) {
+	var rules []*Rule
+
+	for c.Next() {
+		rule := &Rule{Key: keyAliases["connection"]}
+
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			rule.Key = args[0]
+			if key, ok := keyAliases[args[0]]; ok {
+				rule.Key = key
+			}
+		default:
+			return rules, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch what := c.Val(); what {
+			case "upload", "download":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return rules, c.ArgErr()
+				}
+				rate, err := parseSize(strings.TrimSuffix(args[0], "/s"))
+				if err != nil {
+					return rules, c.Errf("throttle: invalid rate: %v", err)
+				}
+				burst := rate
+				if len(args) == 2 {
+					burst, err = parseSize(args[1])
+					if err != nil {
+						return rules, c.Errf("throttle: invalid burst: %v", err)
+					}
+				}
+				limiter := NewLimiter(float64(rate), burst)
+				if what == "upload" {
+					if rule.Upload != nil {
+						return rules, c.Err("throttle: duplicate upload limit")
+					}
+					rule.Upload = limiter
+				} else {
+					if rule.Download != nil {
+						return rules, c.Err("throttle: duplicate download limit")
+					}
+					rule.Download = limiter
+				}
+			case "except":
+				paths := c.RemainingArgs()
+				if len(paths) == 0 {
+					return rules, c.ArgErr()
+				}
+				rule.Except = append(rule.Except, paths...)
+			default:
+				return rules, c.Errf("throttle: unknown property '%s'", c.Val())
+			}
+		}
+
+		if rule.Upload == nil && rule.Download == nil {
+			return rules, c.Err("throttle: upload or download must be set")
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+var validUnits = []struct {
+	symbol     string
+	multiplier int64
+}{
+	{"KB", 1024},
+	{"MB", 1024 * 1024},
+	{"GB", 1024 * 1024 * 1024},
+	{"B", 1},
+	{"", 1}, // defaulting to "B"
+}
+
+// parseSize parses a positive size like 512KB or 10MB in bytes.
+func parseSize(s string) (int64, error) {
+	upper := strings.ToUpper(s)
+	for _, unit := range validUnits {
+		if strings.HasSuffix(upper, unit.symbol) {
+			size, err := strconv.ParseInt(upper[:len(upper)-len(unit.symbol)], 10, 64)
+			if err != nil || size < 1 {
+				return 0, fmt.Errorf("'%s' is not a positive size", s)
+			}
+			return size * unit.multiplier, nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not a positive size", s)
+}
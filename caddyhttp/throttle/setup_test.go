@@ -0,0 +1,114 @@
+package throttle
+
+import (
+	"testing"
+
+	"github.com/journeymidnight/yig-front-caddy"
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("http", `throttle {
+		download 1MB
+	}`)
+	err := setup(c)
+	if err != nil {
+		t.Errorf("Expected no errors, got: %v", err)
+	}
+	mids := httpserver.GetConfig(c).Middleware()
+	if len(mids) == 0 {
+		t.Fatal("Expected middleware, got 0 instead")
+	}
+
+	handler := mids[0](httpserver.EmptyNext)
+	myHandler, ok := handler.(Throttle)
+	if !ok {
+		t.Fatalf("Expected handler to be type Throttle, got: %#v", handler)
+	}
+	if !httpserver.SameNext(myHandler.Next, httpserver.EmptyNext) {
+		t.Error("'Next' field of handler was not set properly")
+	}
+}
+
+func TestThrottleParse(t *testing.T) {
+	type limit struct {
+		rate  float64
+		burst int64
+	}
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		expectedKey      string
+		expectedUpload   *limit
+		expectedDownload *limit
+	}{
+		{`throttle {
+			download 1MB
+		}`, false, "{remote}:{port}", nil, &limit{1 << 20, 1 << 20}},
+		{`throttle bucket {
+			upload 512KB/s 4MB
+			download 10mb
+			except /health
+		}`, false, "{s3_bucket}", &limit{512 << 10, 4 << 20}, &limit{10 << 20, 10 << 20}},
+		{`throttle {>X-Tenant} {
+			upload 1000
+		}`, false, "{>X-Tenant}", &limit{1000, 1000}, nil},
+		{`throttle`, true, "", nil, nil},
+		{`throttle ip bucket {
+			upload 1MB
+		}`, true, "", nil, nil},
+		{`throttle {
+			upload 1MB
+			upload 2MB
+		}`, true, "", nil, nil},
+		{`throttle {
+			upload fast
+		}`, true, "", nil, nil},
+		{`throttle {
+			download 0
+		}`, true, "", nil, nil},
+		{`throttle {
+			download 1MB 1TB
+		}`, true, "", nil, nil},
+		{`throttle {
+			both 1MB
+		}`, true, "", nil, nil},
+	}
+
+	check := func(i int, what string, expected *limit, actual *Limiter) {
+		if expected == nil {
+			if actual != nil {
+				t.Errorf("Test %d: expected no %s limit, got %v/%d", i, what, actual.Rate, actual.Burst)
+			}
+			return
+		}
+		if actual == nil {
+			t.Errorf("Test %d: expected %s limit", i, what)
+			return
+		}
+		if actual.Rate != expected.rate || actual.Burst != expected.burst {
+			t.Errorf("Test %d: expected %s limit %v/%d, got %v/%d",
+				i, what, expected.rate, expected.burst, actual.Rate, actual.Burst)
+		}
+	}
+
+	for i, test := range tests {
+		rules, err := throttleParse(caddy.NewTestController("http", test.input))
+		if err == nil && test.shouldErr {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		} else if err != nil && !test.shouldErr {
+			t.Errorf("Test %d errored, but it shouldn't have; got '%v'", i, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(rules) != 1 {
+			t.Fatalf("Test %d: expected 1 rule, got %d", i, len(rules))
+		}
+		if rules[0].Key != test.expectedKey {
+			t.Errorf("Test %d: expected key %s, got %s", i, test.expectedKey, rules[0].Key)
+		}
+		check(i, "upload", test.expectedUpload, rules[0].Upload)
+		check(i, "download", test.expectedDownload, rules[0].Download)
+	}
+}
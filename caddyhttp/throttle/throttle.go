@@ -0,0 +1,152 @@
+// Package throttle is middleware that limits the upload and download
+// throughput of requests per connection, client IP, bucket or any
+// other placeholder value.
+package throttle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// Throttle is middleware that slows down request and response
+// bodies to the configured number of bytes per second.
+type Throttle struct {
+	Next  httpserver.Handler
+	Rules []*Rule
+}
+
+// Rule limits the throughput of the requests that share
+// the same value of Key.
+type Rule struct {
+	// Key is a placeholder string like {remote} or {s3_bucket};
+	// requests for which it evaluates to the empty string are not
+	// throttled by this rule.
+	Key string
+
+	// Upload limits request bodies, Download limits response
+	// bodies; either may be nil.
+	Upload   *Limiter
+	Download *Limiter
+
+	// Except lists paths that are not throttled.
+	Except []string
+}
+
+// ServeHTTP implements the httpserver.Handler interface.
+func (t Throttle) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	repl := httpserver.NewReplacer(r, nil, "")
+
+	for _, rule := range t.Rules {
+		if rule.excepted(r) {
+			continue
+		}
+		key := repl.Replace(rule.Key)
+		if key == "" || key == "-" {
+			continue
+		}
+		if rule.Upload != nil && r.Body != nil {
+			r.Body = &throttledReader{
+				ReadCloser: r.Body,
+				limiter:    rule.Upload,
+				key:        key,
+				ctx:        r.Context(),
+			}
+		}
+		if rule.Download != nil {
+			w = &throttledResponseWriter{
+				ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: w},
+				limiter:               rule.Download,
+				key:                   key,
+				ctx:                   r.Context(),
+			}
+		}
+	}
+
+	return t.Next.ServeHTTP(w, r)
+}
+
+func (rule *Rule) excepted(r *http.Request) bool {
+	for _, path := range rule.Except {
+		if httpserver.Path(r.URL.Path).Matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttledReader is a request body that is read no faster
+// than its limiter allows.
+type throttledReader struct {
+	io.ReadCloser
+	limiter *Limiter
+	key     string
+	ctx     context.Context
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > tr.limiter.Burst {
+		p = p[:tr.limiter.Burst]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := sleep(tr.ctx, tr.limiter.Reserve(tr.key, n)); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// throttledResponseWriter is a response writer that writes
+// the body no faster than its limiter allows.
+type throttledResponseWriter struct {
+	*httpserver.ResponseWriterWrapper
+	limiter *Limiter
+	key     string
+	ctx     context.Context
+}
+
+func (tw *throttledResponseWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if int64(len(chunk)) > tw.limiter.Burst {
+			chunk = chunk[:tw.limiter.Burst]
+		}
+		if err := sleep(tw.ctx, tw.limiter.Reserve(tw.key, len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriterWrapper.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// sleep waits for d, or until ctx is done. It is a variable
+// so tests do not have to wait.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// now is time.Now; it is a variable so tests can change the clock.
+var now = time.Now
+
+// Interface guards
+var _ httpserver.HTTPInterfaces = (*throttledResponseWriter)(nil)
@@ -0,0 +1,127 @@
+package throttle
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/journeymidnight/yig-front-caddy/caddyhttp/httpserver"
+)
+
+// fakeClock replaces now and sleep, advancing the clock
+// instead of sleeping.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func useFakeClock() (*fakeClock, func()) {
+	clock := &fakeClock{t: time.Now()}
+	oldNow, oldSleep := now, sleep
+	now = func() time.Time { return clock.t }
+	sleep = func(ctx context.Context, d time.Duration) error {
+		if d > 0 {
+			clock.t = clock.t.Add(d)
+			clock.slept += d
+		}
+		return nil
+	}
+	return clock, func() { now, sleep = oldNow, oldSleep }
+}
+
+func TestLimiter(t *testing.T) {
+	clock, restore := useFakeClock()
+	defer restore()
+
+	l := NewLimiter(100, 100)
+	if wait := l.Reserve("a", 100); wait != 0 {
+		t.Errorf("Expected burst to be free, got wait %v", wait)
+	}
+	if wait := l.Reserve("a", 50); wait != 500*time.Millisecond {
+		t.Errorf("Expected 500ms wait, got %v", wait)
+	}
+	if wait := l.Reserve("a", 50); wait != time.Second {
+		t.Errorf("Expected queued reservation to wait 1s, got %v", wait)
+	}
+	if wait := l.Reserve("b", 100); wait != 0 {
+		t.Errorf("Expected other key to be free, got wait %v", wait)
+	}
+
+	clock.t = clock.t.Add(time.Hour)
+	l.Reserve("c", 1)
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("Expected full bucket to be swept")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	clock, restore := useFakeClock()
+	defer restore()
+
+	const size = 4096
+	th := Throttle{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			w.Write(body)
+			return http.StatusOK, nil
+		}),
+		Rules: []*Rule{{
+			Key:      "{s3_bucket}",
+			Upload:   NewLimiter(1024, 1024),
+			Download: NewLimiter(2048, 1024),
+			Except:   []string{"/bucket/free"},
+		}},
+	}
+
+	for i, test := range []struct {
+		url           string
+		expectedSlept time.Duration
+	}{
+		// 3KB over the upload burst at 1KB/s, and 3KB
+		// over the download burst at 2KB/s
+		{"/bucket/a", 3*time.Second + 1500*time.Millisecond},
+		{"/bucket/free", 0},
+	} {
+		clock.slept = 0
+		clock.t = clock.t.Add(time.Hour) // refill everything
+
+		r := httptest.NewRequest("PUT", test.url, strings.NewReader(strings.Repeat("a", size)))
+		w := httptest.NewRecorder()
+
+		if _, err := th.ServeHTTP(w, r); err != nil {
+			t.Errorf("Test %d: expected no error, got %v", i, err)
+		}
+		if w.Body.Len() != size {
+			t.Errorf("Test %d: expected %d bytes of response, got %d", i, size, w.Body.Len())
+		}
+		if clock.slept != test.expectedSlept {
+			t.Errorf("Test %d: expected to sleep %v, slept %v", i, test.expectedSlept, clock.slept)
+		}
+	}
+}
+
+func TestThrottleCanceled(t *testing.T) {
+	tw := &throttledResponseWriter{
+		ResponseWriterWrapper: &httpserver.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()},
+		limiter:               NewLimiter(1, 1),
+		key:                   "a",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tw.ctx = ctx
+
+	n, err := tw.Write([]byte("abc"))
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected the burst to be written before canceling, got %d bytes", n)
+	}
+}